@@ -12,6 +12,18 @@ type EnvMap struct {
 	Env     map[string]string
 	Parent  *EnvMap
 	Flatten bool
+
+	// Secrets and SecretPatterns flag keys whose values should not be
+	// displayed. See MarkSecret and AddSecretPatterns.
+	Secrets        map[string]bool
+	SecretPatterns []string
+
+	// Masked holds keys removed with Unset, which hides any value inherited
+	// from a parent.
+	Masked map[string]bool
+
+	// frozen is set by Freeze and prevents further modification.
+	frozen bool
 }
 
 func NewEnvMap() (r *EnvMap) {
@@ -24,11 +36,43 @@ func NewEnvMap() (r *EnvMap) {
 // FlattenMap when set to false will not flatten the
 // results of an EnvMap.
 func (e *EnvMap) FlattenMap(flatMap bool) {
+	e.checkWritable()
 	e.Flatten = flatMap
 }
 
+// Freeze makes this map and all of its parents immutable. Any later attempt to
+// modify them through their methods will panic. A frozen map is safe for
+// concurrent use by multiple readers, and children created from it with
+// NewChild remain writable.
+func (e *EnvMap) Freeze() {
+	for ; e != nil; e = e.Parent {
+		e.frozen = true
+	}
+}
+
+// Frozen returns true if Freeze has been called on this map or one of its
+// children.
+func (e *EnvMap) Frozen() bool {
+	return e.frozen
+}
+
+// checkWritable panics if the map has been frozen.
+func (e *EnvMap) checkWritable() {
+	if e.frozen {
+		panic("envmap: modification of frozen EnvMap")
+	}
+}
+
 func (e *EnvMap) Set(key, value string) {
-	if prev, ok := e.Env[key]; ok == true {
+	e.checkWritable()
+	prev, ok := e.Env[key]
+	if e.Masked[key] {
+		// A self reference to an unset variable expands to nothing rather
+		// than reaching past the mask into the parent.
+		delete(e.Masked, key)
+		ok = true
+	}
+	if ok == true {
 		resolve := func(s string) string {
 			if s == key {
 				return prev
@@ -41,6 +85,18 @@ func (e *EnvMap) Set(key, value string) {
 	}
 }
 
+// Unset removes a key from this map. Unlike deleting it from Env directly,
+// this also hides any value the key has in a parent, so that Get, Map and
+// Strings treat it as undefined until it is Set again.
+func (e *EnvMap) Unset(key string) {
+	e.checkWritable()
+	delete(e.Env, key)
+	if e.Masked == nil {
+		e.Masked = make(map[string]bool, 1)
+	}
+	e.Masked[key] = true
+}
+
 func (e *EnvMap) get(
 	key string, top *EnvMap, processQueue map[string]*EnvMap,
 	cache map[string]string,
@@ -70,6 +126,8 @@ func (e *EnvMap) get(
 			s := os.Expand(value, resolve)
 			delete(processQueue, key)
 			return s, true
+		} else if e.Masked[key] {
+			break
 		}
 		e = e.Parent
 	}
@@ -88,6 +146,8 @@ func (e *EnvMap) GetRaw(key string) (string, bool) {
 	for e != nil {
 		if value, ok := e.Env[key]; ok == true {
 			return value, true
+		} else if e.Masked[key] {
+			break
 		}
 		e = e.Parent
 	}
@@ -101,10 +161,15 @@ func (e *EnvMap) Map() map[string]string {
 	for p := e; p != nil; p = p.Parent {
 		for k := range p.Env {
 			if _, ok := cache[k]; ok == false {
+				var value string
+				var found bool
 				if e.Flatten {
-					cache[k], _ = e.get(k, e, processQueue, cache)
+					value, found = e.get(k, e, processQueue, cache)
 				} else {
-					cache[k], _ = e.GetRaw(k)
+					value, found = e.GetRaw(k)
+				}
+				if found {
+					cache[k] = value
 				}
 			}
 		}
@@ -132,6 +197,8 @@ func (e *EnvMap) Keys() []string {
 	return keys
 }
 
+// NewChild returns a new EnvMap layered on top of this one. Keys flagged as
+// secret in the parent remain secret in the child.
 func (e *EnvMap) NewChild() *EnvMap {
 	return &EnvMap{
 		Env:     make(map[string]string, 0),
@@ -0,0 +1,99 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"sort"
+)
+
+// A Source describes which layer of an EnvMap chain supplied a variable.
+type Source struct {
+	// Layer is the map that defines or unsets the variable.
+	Layer *EnvMap
+
+	// Depth is the position of Layer in the chain, where 0 is the map that
+	// Lookup was called on, 1 its parent, and so on.
+	Depth int
+
+	// Raw is the value as stored in Layer, before expansion.
+	Raw string
+
+	// Value is the fully expanded value as returned by Get.
+	Value string
+
+	// Masked is true if the variable was removed by Unset in Layer.
+	Masked bool
+}
+
+// Lookup returns the value of key along with the layer that supplied it. If
+// the key is hidden by Unset, the returned Source identifies the layer that
+// unset it and the boolean is false. If the key is not defined anywhere the
+// Source is empty.
+func (e *EnvMap) Lookup(key string) (Source, bool) {
+	depth := 0
+	for p := e; p != nil; p = p.Parent {
+		if raw, ok := p.Env[key]; ok == true {
+			value, _ := e.Get(key)
+			return Source{Layer: p, Depth: depth, Raw: raw, Value: value}, true
+		} else if p.Masked[key] {
+			return Source{Layer: p, Depth: depth, Masked: true}, false
+		}
+		depth++
+	}
+	return Source{}, false
+}
+
+// A Scope summarizes the variables a single layer of an EnvMap chain sets or
+// unsets itself.
+type Scope struct {
+	// Layer is the map being described.
+	Layer *EnvMap
+
+	// Depth is the position of Layer in the chain, where 0 is the map that
+	// Scopes was called on.
+	Depth int
+
+	// Set holds the raw values defined in this layer.
+	Set map[string]string
+
+	// Unset lists, in sorted order, the keys this layer removed.
+	Unset []string
+
+	// Overrides lists, in sorted order, the keys set or unset in this layer
+	// that hide a value defined by one of its parents.
+	Overrides []string
+}
+
+// Scopes returns a description of every layer in the chain, starting with
+// this map and ending with the root.
+func (e *EnvMap) Scopes() []Scope {
+	var scopes []Scope
+	depth := 0
+	for p := e; p != nil; p = p.Parent {
+		s := Scope{
+			Layer: p,
+			Depth: depth,
+			Set:   make(map[string]string, len(p.Env)),
+		}
+		for k, v := range p.Env {
+			s.Set[k] = v
+			if _, ok := p.Parent.GetRaw(k); ok {
+				s.Overrides = append(s.Overrides, k)
+			}
+		}
+		for k, masked := range p.Masked {
+			if !masked {
+				continue
+			}
+			s.Unset = append(s.Unset, k)
+			if _, ok := p.Parent.GetRaw(k); ok {
+				s.Overrides = append(s.Overrides, k)
+			}
+		}
+		sort.Strings(s.Unset)
+		sort.Strings(s.Overrides)
+		scopes = append(scopes, s)
+		depth++
+	}
+	return scopes
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"encoding/json"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestEnvMapUnset(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.Set("A", "1")
+	root.Set("B", "2")
+	root.Set("REF", "$A")
+
+	c := root.NewChild()
+	c.Unset("A")
+	c.Set("C", "x$A")
+
+	_, ok := c.Get("A")
+	tt.TestEqual(t, ok, false)
+	_, ok = c.GetRaw("A")
+	tt.TestEqual(t, ok, false)
+	tt.TestEqual(t, c.Map(), map[string]string{"B": "2", "REF": "", "C": "x"})
+
+	// The parent is unaffected.
+	v, _ := root.Get("A")
+	tt.TestEqual(t, v, "1")
+
+	// Setting after Unset does not reach into the parent.
+	c.Set("A", "0$A")
+	v, _ = c.Get("A")
+	tt.TestEqual(t, v, "0")
+	v, _ = c.Get("REF")
+	tt.TestEqual(t, v, "0")
+
+	// Masks survive a JSON round trip.
+	c.Unset("B")
+	b, err := json.Marshal(c)
+	tt.TestExpectSuccess(t, err)
+	var c2 *EnvMap
+	tt.TestExpectSuccess(t, json.Unmarshal(b, &c2))
+	tt.TestEqual(t, c2.Map(), c.Map())
+}
+
+func TestEnvMapLookup(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.Set("A", "1")
+	root.Set("B", "2")
+	mid := root.NewChild()
+	mid.Set("B", "$B$A")
+	mid.Unset("A")
+	leaf := mid.NewChild()
+
+	src, ok := leaf.Lookup("B")
+	tt.TestEqual(t, ok, true)
+	tt.TestEqual(t, src.Layer == mid, true)
+	tt.TestEqual(t, src.Depth, 1)
+	tt.TestEqual(t, src.Raw, "$B$A")
+	tt.TestEqual(t, src.Value, "2")
+
+	src, ok = leaf.Lookup("A")
+	tt.TestEqual(t, ok, false)
+	tt.TestEqual(t, src.Masked, true)
+	tt.TestEqual(t, src.Depth, 1)
+
+	src, ok = leaf.Lookup("MISSING")
+	tt.TestEqual(t, ok, false)
+	tt.TestEqual(t, src.Layer == nil, true)
+}
+
+func TestEnvMapScopes(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.Set("A", "1")
+	root.Set("B", "2")
+	c := root.NewChild()
+	c.Set("B", "3")
+	c.Set("C", "4")
+	c.Unset("A")
+	c.Unset("NEVER_SET")
+
+	scopes := c.Scopes()
+	tt.TestEqual(t, len(scopes), 2)
+
+	tt.TestEqual(t, scopes[0].Depth, 0)
+	tt.TestEqual(t, scopes[0].Set, map[string]string{"B": "3", "C": "4"})
+	tt.TestEqual(t, scopes[0].Unset, []string{"A", "NEVER_SET"})
+	tt.TestEqual(t, scopes[0].Overrides, []string{"A", "B"})
+
+	tt.TestEqual(t, scopes[1].Depth, 1)
+	tt.TestEqual(t, scopes[1].Layer == root, true)
+	tt.TestEqual(t, scopes[1].Set, map[string]string{"A": "1", "B": "2"})
+	tt.TestEqual(t, len(scopes[1].Overrides), 0)
+}
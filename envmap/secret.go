@@ -0,0 +1,149 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// RedactedValue is substituted for the value of secret variables when an
+// EnvMap is rendered for display or logging.
+const RedactedValue = "[REDACTED]"
+
+// DefaultSecretPatterns are name patterns that commonly hold credentials. They
+// are not applied automatically; pass them to AddSecretPatterns to opt in.
+var DefaultSecretPatterns = []string{
+	"*_TOKEN",
+	"*_SECRET",
+	"*_SECRET_KEY",
+	"*_PASSWORD",
+	"*_ACCESS_KEY",
+}
+
+// MarkSecret flags the given keys as sensitive. The flag applies to the key
+// for this map and any children created from it, regardless of which layer
+// ends up supplying the value.
+func (e *EnvMap) MarkSecret(keys ...string) {
+	e.checkWritable()
+	if e.Secrets == nil {
+		e.Secrets = make(map[string]bool, len(keys))
+	}
+	for _, key := range keys {
+		e.Secrets[key] = true
+	}
+}
+
+// SetSecret sets a value and flags its key as sensitive.
+func (e *EnvMap) SetSecret(key, value string) {
+	e.Set(key, value)
+	e.MarkSecret(key)
+}
+
+// AddSecretPatterns flags every key matching one of the given shell patterns
+// (as understood by path.Match, such as "*_TOKEN") as sensitive. Patterns are
+// inherited by children in the same way as keys passed to MarkSecret.
+func (e *EnvMap) AddSecretPatterns(patterns ...string) error {
+	e.checkWritable()
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid secret pattern %q: %s", pattern, err)
+		}
+	}
+	e.SecretPatterns = append(e.SecretPatterns, patterns...)
+	return nil
+}
+
+// IsSecret returns true if the key has been flagged as sensitive in this map
+// or one of its parents, either explicitly or by pattern, or if its value
+// expands a variable that is itself secret.
+func (e *EnvMap) IsSecret(key string) bool {
+	processQueue := make(map[string]*EnvMap, 10)
+	return e.isSecret(key, e, processQueue)
+}
+
+// markedSecret reports whether the key is flagged by name anywhere in the
+// chain of maps starting at e.
+func (e *EnvMap) markedSecret(key string) bool {
+	for ; e != nil; e = e.Parent {
+		if e.Secrets[key] {
+			return true
+		}
+		for _, pattern := range e.SecretPatterns {
+			if ok, _ := path.Match(pattern, key); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSecret follows the same resolution order as get so that a variable is
+// only considered secret when the value it would actually expand to
+// includes a secret.
+func (e *EnvMap) isSecret(
+	key string, top *EnvMap, processQueue map[string]*EnvMap,
+) bool {
+	if top.markedSecret(key) {
+		return true
+	}
+
+	resolve := func(s string) bool {
+		if top.markedSecret(s) {
+			return true
+		}
+		if last, ok := processQueue[s]; ok == true {
+			if last == nil {
+				return false
+			}
+			processQueue[s] = last.Parent
+			return last.isSecret(s, top, processQueue)
+		}
+		processQueue[s] = top
+		return top.isSecret(s, top, processQueue)
+	}
+
+	for e != nil {
+		if value, ok := e.Env[key]; ok == true {
+			processQueue[key] = e.Parent
+			secret := false
+			os.Expand(value, func(s string) string {
+				if !secret {
+					secret = resolve(s)
+				}
+				return ""
+			})
+			delete(processQueue, key)
+			return secret
+		} else if e.Masked[key] {
+			break
+		}
+		e = e.Parent
+	}
+	return false
+}
+
+// RedactedMap works like Map, except that the values of secret variables are
+// replaced with RedactedValue.
+func (e *EnvMap) RedactedMap() map[string]string {
+	m := e.Map()
+	for k := range m {
+		if e.IsSecret(k) {
+			m[k] = RedactedValue
+		}
+	}
+	return m
+}
+
+// RedactedStrings works like Strings, except that the values of secret
+// variables are replaced with RedactedValue. Use it whenever an environment
+// is written to a log or shown to a user.
+func (e *EnvMap) RedactedStrings() []string {
+	m := e.RedactedMap()
+	r := make([]string, 0, len(m))
+	for k, v := range m {
+		r = append(r, fmt.Sprintf("%s=%s", k, v))
+	}
+	return r
+}
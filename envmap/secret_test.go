@@ -0,0 +1,102 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"sort"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestEnvMapSecretExplicit(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	e := NewEnvMap()
+	e.Set("USER", "bob")
+	e.SetSecret("PASS", "hunter2")
+
+	tt.TestEqual(t, e.IsSecret("PASS"), true)
+	tt.TestEqual(t, e.IsSecret("USER"), false)
+	tt.TestEqual(t, e.RedactedMap(), map[string]string{
+		"USER": "bob",
+		"PASS": RedactedValue,
+	})
+
+	// The plain rendering is left untouched.
+	v, _ := e.Get("PASS")
+	tt.TestEqual(t, v, "hunter2")
+
+	strs := e.RedactedStrings()
+	sort.Strings(strs)
+	tt.TestEqual(t, strs, []string{"PASS=" + RedactedValue, "USER=bob"})
+}
+
+func TestEnvMapSecretPatterns(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	e := NewEnvMap()
+	tt.TestExpectSuccess(t, e.AddSecretPatterns(DefaultSecretPatterns...))
+	tt.TestExpectError(t, e.AddSecretPatterns("[A-"))
+
+	e.Set("GITHUB_TOKEN", "abc")
+	e.Set("CLIENT_SECRET", "def")
+	e.Set("TOKEN_COUNT", "3")
+
+	tt.TestEqual(t, e.IsSecret("GITHUB_TOKEN"), true)
+	tt.TestEqual(t, e.IsSecret("CLIENT_SECRET"), true)
+	tt.TestEqual(t, e.IsSecret("TOKEN_COUNT"), false)
+}
+
+func TestEnvMapSecretInheritance(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.SetSecret("PASS", "hunter2")
+	tt.TestExpectSuccess(t, root.AddSecretPatterns("*_TOKEN"))
+
+	c := root.NewChild()
+	c.Set("PASS", "override")
+	c.Set("API_TOKEN", "xyz")
+	c.Set("OTHER", "value")
+
+	tt.TestEqual(t, c.RedactedMap(), map[string]string{
+		"PASS":      RedactedValue,
+		"API_TOKEN": RedactedValue,
+		"OTHER":     "value",
+	})
+
+	// Flags set on the child do not leak into the parent.
+	c.MarkSecret("SHARED")
+	root.Set("SHARED", "visible")
+	tt.TestEqual(t, root.IsSecret("SHARED"), false)
+	tt.TestEqual(t, c.IsSecret("SHARED"), true)
+}
+
+func TestEnvMapSecretExpansion(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.SetSecret("PASS", "hunter2")
+	root.Set("DSN", "postgres://bob:$PASS@db")
+	root.Set("INDIRECT", "$DSN")
+	root.Set("PLAIN", "$HOME")
+
+	c := root.NewChild()
+	c.Set("PLAIN", "$PLAIN:$INDIRECT")
+
+	tt.TestEqual(t, root.IsSecret("DSN"), true)
+	tt.TestEqual(t, root.IsSecret("INDIRECT"), true)
+	tt.TestEqual(t, root.IsSecret("PLAIN"), false)
+	tt.TestEqual(t, c.IsSecret("PLAIN"), true)
+
+	// Recursive references must terminate.
+	e := NewEnvMap()
+	e.Set("A", "$B")
+	e.Set("B", "$A")
+	tt.TestEqual(t, e.IsSecret("A"), false)
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SyncEnvMap is an EnvMap that is safe for concurrent use. Writers are
+// serialized and each write publishes a new frozen copy of the local layer, so
+// readers never block and always see a consistent view. Parents are shared
+// between snapshots rather than copied, and are frozen when the SyncEnvMap is
+// created.
+type SyncEnvMap struct {
+	// mu serializes writers.
+	mu sync.Mutex
+
+	// current holds the latest frozen *EnvMap.
+	current atomic.Value
+}
+
+// NewSyncEnvMap returns an empty SyncEnvMap layered on top of parent, which
+// may be nil. The parent and its ancestors are frozen.
+func NewSyncEnvMap(parent *EnvMap) *SyncEnvMap {
+	e := NewEnvMap()
+	if parent != nil {
+		parent.Freeze()
+		e.Parent = parent
+	}
+	e.frozen = true
+
+	s := &SyncEnvMap{}
+	s.current.Store(e)
+	return s
+}
+
+// Snapshot returns the current contents as a frozen EnvMap. The snapshot is
+// never modified by later writes and may be shared freely between goroutines.
+func (s *SyncEnvMap) Snapshot() *EnvMap {
+	return s.current.Load().(*EnvMap)
+}
+
+// update applies fn to a private copy of the current local layer and then
+// publishes it as the new snapshot.
+func (s *SyncEnvMap) update(fn func(e *EnvMap) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur := s.Snapshot()
+	next := &EnvMap{
+		Env:            make(map[string]string, len(cur.Env)+1),
+		Parent:         cur.Parent,
+		Flatten:        cur.Flatten,
+		SecretPatterns: append([]string(nil), cur.SecretPatterns...),
+	}
+	for k, v := range cur.Env {
+		next.Env[k] = v
+	}
+	if cur.Masked != nil {
+		next.Masked = make(map[string]bool, len(cur.Masked))
+		for k, v := range cur.Masked {
+			next.Masked[k] = v
+		}
+	}
+	if cur.Secrets != nil {
+		next.Secrets = make(map[string]bool, len(cur.Secrets))
+		for k, v := range cur.Secrets {
+			next.Secrets[k] = v
+		}
+	}
+
+	if err := fn(next); err != nil {
+		return err
+	}
+	next.frozen = true
+	s.current.Store(next)
+	return nil
+}
+
+// Set sets a value. See EnvMap.Set.
+func (s *SyncEnvMap) Set(key, value string) {
+	s.update(func(e *EnvMap) error {
+		e.Set(key, value)
+		return nil
+	})
+}
+
+// Unset removes a key and hides any inherited value. See EnvMap.Unset.
+func (s *SyncEnvMap) Unset(key string) {
+	s.update(func(e *EnvMap) error {
+		e.Unset(key)
+		return nil
+	})
+}
+
+// SetSecret sets a value and flags its key as sensitive. See
+// EnvMap.SetSecret.
+func (s *SyncEnvMap) SetSecret(key, value string) {
+	s.update(func(e *EnvMap) error {
+		e.SetSecret(key, value)
+		return nil
+	})
+}
+
+// MarkSecret flags the given keys as sensitive. See EnvMap.MarkSecret.
+func (s *SyncEnvMap) MarkSecret(keys ...string) {
+	s.update(func(e *EnvMap) error {
+		e.MarkSecret(keys...)
+		return nil
+	})
+}
+
+// AddSecretPatterns flags keys matching the given patterns as sensitive. See
+// EnvMap.AddSecretPatterns.
+func (s *SyncEnvMap) AddSecretPatterns(patterns ...string) error {
+	return s.update(func(e *EnvMap) error {
+		return e.AddSecretPatterns(patterns...)
+	})
+}
+
+// FlattenMap controls whether Map and Strings expand variables. See
+// EnvMap.FlattenMap.
+func (s *SyncEnvMap) FlattenMap(flatMap bool) {
+	s.update(func(e *EnvMap) error {
+		e.FlattenMap(flatMap)
+		return nil
+	})
+}
+
+// Get returns the expanded value of key from the current snapshot.
+func (s *SyncEnvMap) Get(key string) (string, bool) {
+	return s.Snapshot().Get(key)
+}
+
+// GetRaw returns the unexpanded value of key from the current snapshot.
+func (s *SyncEnvMap) GetRaw(key string) (string, bool) {
+	return s.Snapshot().GetRaw(key)
+}
+
+// Lookup reports where the value of key comes from in the current snapshot.
+// See EnvMap.Lookup.
+func (s *SyncEnvMap) Lookup(key string) (Source, bool) {
+	return s.Snapshot().Lookup(key)
+}
+
+// Scopes describes each layer of the current snapshot. See EnvMap.Scopes.
+func (s *SyncEnvMap) Scopes() []Scope {
+	return s.Snapshot().Scopes()
+}
+
+// Map returns the contents of the current snapshot.
+func (s *SyncEnvMap) Map() map[string]string {
+	return s.Snapshot().Map()
+}
+
+// Strings returns the contents of the current snapshot as KEY=value strings.
+func (s *SyncEnvMap) Strings() []string {
+	return s.Snapshot().Strings()
+}
+
+// Keys returns the keys of the current snapshot.
+func (s *SyncEnvMap) Keys() []string {
+	return s.Snapshot().Keys()
+}
+
+// IsSecret reports whether key is sensitive in the current snapshot.
+func (s *SyncEnvMap) IsSecret(key string) bool {
+	return s.Snapshot().IsSecret(key)
+}
+
+// RedactedMap returns the current snapshot with secret values redacted.
+func (s *SyncEnvMap) RedactedMap() map[string]string {
+	return s.Snapshot().RedactedMap()
+}
+
+// RedactedStrings returns the current snapshot as KEY=value strings with
+// secret values redacted.
+func (s *SyncEnvMap) RedactedStrings() []string {
+	return s.Snapshot().RedactedStrings()
+}
+
+// NewChild returns a new, writable EnvMap layered on top of the current
+// snapshot. It is not affected by later writes to the SyncEnvMap.
+func (s *SyncEnvMap) NewChild() *EnvMap {
+	return s.Snapshot().NewChild()
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package envmap
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func TestEnvMapFreeze(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.Set("A", "1")
+	c := root.NewChild()
+	c.Set("B", "2")
+	c.Freeze()
+
+	tt.TestEqual(t, c.Frozen(), true)
+	tt.TestEqual(t, root.Frozen(), true)
+
+	expectPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				tt.Fatalf(t, "%s on a frozen map should have panicked", name)
+			}
+		}()
+		fn()
+	}
+	expectPanic("Set", func() { root.Set("A", "2") })
+	expectPanic("MarkSecret", func() { c.MarkSecret("B") })
+	expectPanic("FlattenMap", func() { c.FlattenMap(false) })
+
+	// Children of a frozen map can still be written.
+	gc := c.NewChild()
+	gc.Set("C", "$A$B")
+	v, _ := gc.Get("C")
+	tt.TestEqual(t, v, "12")
+}
+
+func TestSyncEnvMapSnapshot(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	root := NewEnvMap()
+	root.Set("PATH", "/bin")
+
+	s := NewSyncEnvMap(root)
+	tt.TestEqual(t, root.Frozen(), true)
+
+	s.Set("PATH", "/usr/bin:$PATH")
+	before := s.Snapshot()
+	s.Set("PATH", "/opt/bin:$PATH")
+	s.SetSecret("TOKEN", "abc")
+	tt.TestExpectError(t, s.AddSecretPatterns("[A-"))
+
+	tt.TestEqual(t, before.Map(), map[string]string{"PATH": "/usr/bin:/bin"})
+	tt.TestEqual(t, s.Map(), map[string]string{
+		"PATH":  "/opt/bin:/usr/bin:/bin",
+		"TOKEN": "abc",
+	})
+	tt.TestEqual(t, s.RedactedMap()["TOKEN"], RedactedValue)
+	tt.TestEqual(t, before.Frozen(), true)
+	tt.TestEqual(t, s.Snapshot().Frozen(), true)
+
+	child := s.NewChild()
+	child.Set("EXTRA", "1")
+	s.Set("LATER", "2")
+	_, ok := child.Get("LATER")
+	tt.TestEqual(t, ok, false)
+}
+
+func TestSyncEnvMapConcurrent(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	s := NewSyncEnvMap(nil)
+	s.Set("COUNTER", "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.Set(fmt.Sprintf("W%d", i), fmt.Sprintf("%d", j))
+				s.Set("COUNTER", "x$COUNTER")
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				snap := s.Snapshot()
+				m := snap.Map()
+				if v, _ := snap.Get("COUNTER"); v != m["COUNTER"] {
+					t.Errorf("inconsistent snapshot: %q != %q", v, m["COUNTER"])
+				}
+				c := s.NewChild()
+				c.Set("LOCAL", "1")
+				c.Strings()
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, _ := s.Get("COUNTER")
+	tt.TestEqual(t, len(v), 8*50)
+	tt.TestEqual(t, len(s.Keys()), 9)
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// BLAKE2b as specified in RFC 7693, unkeyed, with a digest of up to 64 bytes.
+
+const (
+	blake2bBlockSize = 128
+	blake2bMaxSize   = 64
+)
+
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [12][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+}
+
+type blake2b struct {
+	h    [8]uint64
+	t    [2]uint64
+	buf  [blake2bBlockSize]byte
+	n    int
+	size int
+}
+
+// newBlake2b returns an unkeyed BLAKE2b hash with a digest of size bytes.
+func newBlake2b(size int) hash.Hash {
+	if size < 1 || size > blake2bMaxSize {
+		panic("hashutil: invalid BLAKE2b digest size")
+	}
+	d := &blake2b{size: size}
+	d.Reset()
+	return d
+}
+
+func (d *blake2b) Size() int      { return d.size }
+func (d *blake2b) BlockSize() int { return blake2bBlockSize }
+
+func (d *blake2b) Reset() {
+	d.h = blake2bIV
+	// Parameter block: digest length, no key, fanout and depth of 1.
+	d.h[0] ^= 0x01010000 ^ uint64(d.size)
+	d.t = [2]uint64{}
+	d.n = 0
+}
+
+func (d *blake2b) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// The last block is compressed differently, so a full buffer is
+		// only compressed once more data arrives.
+		if d.n == blake2bBlockSize {
+			d.compress(false)
+			d.n = 0
+		}
+		m := copy(d.buf[d.n:], p)
+		d.n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (d *blake2b) Sum(b []byte) []byte {
+	c := *d
+	for i := c.n; i < blake2bBlockSize; i++ {
+		c.buf[i] = 0
+	}
+	c.compress(true)
+	var out [blake2bMaxSize]byte
+	for i, v := range c.h {
+		binary.LittleEndian.PutUint64(out[i*8:], v)
+	}
+	return append(b, out[:d.size]...)
+}
+
+// compress mixes the buffered block, of which d.n bytes are used, into the
+// state.
+func (d *blake2b) compress(last bool) {
+	d.t[0] += uint64(d.n)
+	if d.t[0] < uint64(d.n) {
+		d.t[1]++
+	}
+
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(d.buf[i*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], d.h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= d.t[0]
+	v[13] ^= d.t[1]
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, dd int, x, y uint64) {
+		v[a] += v[b] + x
+		v[dd] = rotr64(v[dd]^v[a], 32)
+		v[c] += v[dd]
+		v[b] = rotr64(v[b]^v[c], 24)
+		v[a] += v[b] + y
+		v[dd] = rotr64(v[dd]^v[a], 16)
+		v[c] += v[dd]
+		v[b] = rotr64(v[b]^v[c], 63)
+	}
+	for _, s := range blake2bSigma {
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range d.h {
+		d.h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+func rotr64(x uint64, n uint) uint64 {
+	return x>>n | x<<(64-n)
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"fmt"
+	"io"
+)
+
+// Content-defined chunking with FastCDC, as described in "FastCDC: a Fast
+// and Efficient Content-Defined Chunking Approach for Data Deduplication"
+// (Xia et al., USENIX ATC 2016). Boundaries depend only on nearby content,
+// so an insertion or deletion only changes the chunks around it.
+
+// Default chunk sizes, suited to deduplicating image layers and artifacts.
+const (
+	DefaultChunkMinSize = 16 * 1024
+	DefaultChunkAvgSize = 64 * 1024
+	DefaultChunkMaxSize = 256 * 1024
+)
+
+// gearTable maps each byte to a pseudo-random value for the rolling gear
+// hash. It is generated from a fixed seed with splitmix64, so chunk
+// boundaries are the same on every run and every machine.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6170636572612e63)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return
+}()
+
+// ChunkerOptions sets the chunk sizes. Every chunk but the last is at least
+// MinSize bytes and at most MaxSize bytes, and chunks average about AvgSize
+// bytes.
+type ChunkerOptions struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// withDefaults returns a copy of o with zero sizes set to their defaults,
+// after checking that the sizes are usable.
+func (o *ChunkerOptions) withDefaults() (ChunkerOptions, error) {
+	var c ChunkerOptions
+	if o != nil {
+		c = *o
+	}
+	if c.MinSize == 0 {
+		c.MinSize = DefaultChunkMinSize
+	}
+	if c.AvgSize == 0 {
+		c.AvgSize = DefaultChunkAvgSize
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultChunkMaxSize
+	}
+	if c.MinSize < 64 || c.AvgSize <= c.MinSize || c.MaxSize <= c.AvgSize || c.MaxSize > 1<<30 {
+		return c, fmt.Errorf("hashutil: invalid chunk sizes %d/%d/%d; need 64 <= min < avg < max <= 1GiB",
+			c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	return c, nil
+}
+
+// Chunk is a piece of the chunked stream.
+type Chunk struct {
+	// Offset is the position of the chunk in the stream.
+	Offset int64
+
+	// Length is the size of the chunk.
+	Length int
+
+	// Digest is the SHA256 digest of the chunk.
+	Digest Digest
+
+	// Data holds the chunk's content. It is only valid until the next call
+	// to Next, and is nil in the chunks returned by Chunks.
+	Data []byte
+}
+
+// Chunker splits a stream into content-defined chunks.
+type Chunker struct {
+	source io.Reader
+	opts   ChunkerOptions
+
+	// Masks for the hash before and after the average size. The first has
+	// more bits set, making a cut less likely, which narrows the spread of
+	// chunk sizes around the average.
+	maskS, maskL uint64
+
+	buf    []byte
+	start  int
+	end    int
+	offset int64
+	err    error
+}
+
+// NewChunker returns a Chunker reading from r. A nil opts uses the default
+// sizes.
+func NewChunker(r io.Reader, opts *ChunkerOptions) (*Chunker, error) {
+	o, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	bits := uint(0)
+	for 1<<(bits+1) <= o.AvgSize {
+		bits++
+	}
+	c := &Chunker{
+		source: r,
+		opts:   o,
+		maskS:  highBits(bits + 2),
+		maskL:  highBits(bits - 2),
+		buf:    make([]byte, 2*o.MaxSize),
+	}
+	return c, nil
+}
+
+// highBits returns a mask of the n high bits. The gear hash shifts left by
+// one each byte, so its high bits depend on the most bytes.
+func highBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, or io.EOF once the stream is exhausted.
+func (c *Chunker) Next() (*Chunk, error) {
+	if c.end-c.start < c.opts.MaxSize && c.err == nil {
+		c.fill()
+	}
+	// A short read would move the boundary of the final chunk, so errors
+	// are returned before any of the remaining data.
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	d, _ := FromBytes(SHA256, data[:n])
+	chunk := &Chunk{Offset: c.offset, Length: n, Digest: d, Data: data[:n]}
+	c.start += n
+	c.offset += int64(n)
+	return chunk, nil
+}
+
+// fill moves the unread data to the front of the buffer and reads until it
+// is full or the source is exhausted.
+func (c *Chunker) fill() {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.source.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.opts.MinSize {
+		return n
+	}
+	if n > c.opts.MaxSize {
+		n = c.opts.MaxSize
+	}
+	center := c.opts.AvgSize
+	if n < center {
+		center = n
+	}
+	// Content before MinSize cannot hold a cut, so it is skipped.
+	var h uint64
+	i := c.opts.MinSize
+	for ; i < center; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunks reads r to EOF and returns its chunks, without their data.
+func Chunks(r io.Reader, opts *ChunkerOptions) ([]Chunk, error) {
+	c, err := NewChunker(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		chunk.Data = nil
+		chunks = append(chunks, *chunk)
+	}
+}
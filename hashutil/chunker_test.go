@@ -0,0 +1,146 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+var testChunkOptions = &ChunkerOptions{MinSize: 2048, AvgSize: 8192, MaxSize: 32768}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1, 1<<20)
+	c, err := NewChunker(iotest.HalfReader(bytes.NewReader(data)), testChunkOptions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var joined []byte
+	var count int
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if chunk.Offset != int64(len(joined)) || chunk.Length != len(chunk.Data) {
+			t.Fatalf("Chunk %d has offset %d and length %d", count, chunk.Offset, chunk.Length)
+		}
+		if chunk.Length > testChunkOptions.MaxSize ||
+			chunk.Length < testChunkOptions.MinSize && int(chunk.Offset)+chunk.Length != len(data) {
+			t.Fatalf("Chunk %d has length %d", count, chunk.Length)
+		}
+		sum := sha256.Sum256(chunk.Data)
+		if !bytes.Equal(chunk.Digest.Sum(), sum[:]) {
+			t.Fatalf("Chunk %d has the wrong digest", count)
+		}
+		joined = append(joined, chunk.Data...)
+		count++
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("Chunks do not reassemble the input")
+	}
+	// With normalized chunking the average should be close to AvgSize.
+	if avg := len(data) / count; avg < 6000 || avg > 12000 {
+		t.Fatalf("Average chunk size %d is far from %d", avg, testChunkOptions.AvgSize)
+	}
+}
+
+func TestChunkerReproducible(t *testing.T) {
+	data := randomData(2, 1<<20)
+	a, err := Chunks(bytes.NewReader(data), testChunkOptions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	b, _ := Chunks(iotest.OneByteReader(bytes.NewReader(data)), testChunkOptions)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("Chunks differ with a different read size")
+	}
+
+	// Inserting data near the start only changes the chunks around it.
+	edited := append(append(append([]byte(nil), data[:5000]...), "inserted"...), data[5000:]...)
+	c, _ := Chunks(bytes.NewReader(edited), testChunkOptions)
+	seen := make(map[Digest]bool)
+	for _, chunk := range a {
+		seen[chunk.Digest] = true
+	}
+	var shared int
+	for _, chunk := range c {
+		if seen[chunk.Digest] {
+			shared++
+		}
+	}
+	if shared < len(a)-3 {
+		t.Fatalf("Only %d of %d chunks survived an insertion", shared, len(a))
+	}
+}
+
+func TestChunkerEdgeCases(t *testing.T) {
+	if chunks, err := Chunks(bytes.NewReader(nil), nil); err != nil || len(chunks) != 0 {
+		t.Fatalf("Empty input gave %v, %v", chunks, err)
+	}
+	chunks, _ := Chunks(bytes.NewReader([]byte("small")), nil)
+	if len(chunks) != 1 || chunks[0].Length != 5 {
+		t.Fatalf("Small input gave %+v", chunks)
+	}
+
+	// Data that never matches a mask is cut at MaxSize.
+	zeros := make([]byte, 100000)
+	chunks, _ = Chunks(bytes.NewReader(zeros), testChunkOptions)
+	if chunks[0].Length != testChunkOptions.MaxSize {
+		t.Fatalf("First chunk of zeros has length %d", chunks[0].Length)
+	}
+
+	failure := errors.New("failure")
+	r := &errReader{bytes.NewReader(randomData(3, 100000)), failure}
+	if _, err := Chunks(r, testChunkOptions); err != failure {
+		t.Fatalf("Expected the read error; got %v", err)
+	}
+
+	bad := []ChunkerOptions{
+		{MinSize: 10, AvgSize: 8192, MaxSize: 32768},
+		{MinSize: 8192, AvgSize: 8192, MaxSize: 32768},
+		{MinSize: 2048, AvgSize: 8192, MaxSize: 4096},
+	}
+	for _, o := range bad {
+		if _, err := NewChunker(nil, &o); err == nil {
+			t.Errorf("Expected %+v to be rejected", o)
+		}
+	}
+}
+
+// errReader returns err in place of io.EOF.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		err = e.err
+	}
+	return n, err
+}
+
+func BenchmarkChunker(b *testing.B) {
+	data := randomData(4, 8<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		Chunks(bytes.NewReader(data), nil)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Digest is a content digest in the "algorithm:hex" form used by OCI image
+// registries, such as "sha256:e3b0c442...". Only SHA256 and SHA512 digests
+// are supported. The zero Digest is empty and matches no content.
+//
+// Digest implements encoding.TextMarshaler and encoding.TextUnmarshaler, so
+// it encodes as a plain string in JSON.
+type Digest struct {
+	alg Algorithm
+	hex string
+}
+
+// digestAlgorithms are the algorithms a Digest may use.
+var digestAlgorithms = map[Algorithm]bool{
+	SHA256: true,
+	SHA512: true,
+}
+
+// ParseDigest parses s as "algorithm:hex". The hex must be lower case and of
+// the right length for the algorithm.
+func ParseDigest(s string) (Digest, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Digest{}, fmt.Errorf("hashutil: invalid digest %q: missing algorithm", s)
+	}
+	alg, enc := Algorithm(s[:i]), s[i+1:]
+	if !digestAlgorithms[alg] {
+		return Digest{}, fmt.Errorf("hashutil: invalid digest %q: unsupported algorithm %q", s, alg)
+	}
+	if len(enc) != hex.EncodedLen(alg.Size()) {
+		return Digest{}, fmt.Errorf("hashutil: invalid digest %q: wrong length for %s", s, alg)
+	}
+	for _, c := range enc {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return Digest{}, fmt.Errorf("hashutil: invalid digest %q: not lower case hex", s)
+		}
+	}
+	return Digest{alg: alg, hex: enc}, nil
+}
+
+// NewDigest returns the Digest for a sum computed with alg.
+func NewDigest(alg Algorithm, sum []byte) (Digest, error) {
+	if !digestAlgorithms[alg] {
+		return Digest{}, fmt.Errorf("hashutil: unsupported digest algorithm %q", alg)
+	}
+	if len(sum) != alg.Size() {
+		return Digest{}, fmt.Errorf("hashutil: %s sum must be %d bytes; got %d", alg, alg.Size(), len(sum))
+	}
+	return Digest{alg: alg, hex: hex.EncodeToString(sum)}, nil
+}
+
+// FromBytes returns the digest of p computed with alg.
+func FromBytes(alg Algorithm, p []byte) (Digest, error) {
+	if !digestAlgorithms[alg] {
+		return Digest{}, fmt.Errorf("hashutil: unsupported digest algorithm %q", alg)
+	}
+	h := alg.New()
+	h.Write(p)
+	return NewDigest(alg, h.Sum(nil))
+}
+
+// FromReader reads r to EOF and returns its digest computed with alg and
+// the number of bytes read.
+func FromReader(alg Algorithm, r io.Reader) (Digest, int64, error) {
+	if !digestAlgorithms[alg] {
+		return Digest{}, 0, fmt.Errorf("hashutil: unsupported digest algorithm %q", alg)
+	}
+	h := alg.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return Digest{}, n, err
+	}
+	d, err := NewDigest(alg, h.Sum(nil))
+	return d, n, err
+}
+
+// Algorithm returns the digest's algorithm.
+func (d Digest) Algorithm() Algorithm {
+	return d.alg
+}
+
+// Hex returns the hex encoded sum.
+func (d Digest) Hex() string {
+	return d.hex
+}
+
+// Sum returns the decoded sum.
+func (d Digest) Sum() []byte {
+	b, _ := hex.DecodeString(d.hex)
+	return b
+}
+
+// IsZero reports whether d is the zero Digest.
+func (d Digest) IsZero() bool {
+	return d.alg == ""
+}
+
+// String returns the digest in "algorithm:hex" form, or "" for the zero
+// Digest.
+func (d Digest) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return string(d.alg) + ":" + d.hex
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Empty text gives the
+// zero Digest.
+func (d *Digest) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Digest{}
+		return nil
+	}
+	p, err := ParseDigest(string(text))
+	if err != nil {
+		return err
+	}
+	*d = p
+	return nil
+}
+
+// MismatchError is returned by a VerifyingReader when the content read does
+// not match the expected digest or size.
+type MismatchError struct {
+	Expected     Digest
+	Actual       Digest
+	ExpectedSize int64
+	ActualSize   int64
+}
+
+func (e *MismatchError) Error() string {
+	if e.ExpectedSize >= 0 && e.ActualSize != e.ExpectedSize {
+		return fmt.Sprintf("hashutil: size mismatch: expected %d bytes, got %d", e.ExpectedSize, e.ActualSize)
+	}
+	return fmt.Sprintf("hashutil: digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// VerifyingReader passes data through from a source and checks it against
+// an expected digest and size. Reads return a *MismatchError in place of
+// io.EOF when the content does not match, and as soon as more data than
+// expected is read.
+type VerifyingReader struct {
+	*hashReader
+
+	expected Digest
+	size     int64
+	verified bool
+}
+
+// NewVerifyingReader returns a VerifyingReader checking r against d. A
+// negative size skips the size check.
+func NewVerifyingReader(r io.Reader, d Digest, size int64) (*VerifyingReader, error) {
+	if d.IsZero() {
+		return nil, fmt.Errorf("hashutil: no digest to verify against")
+	}
+	v := &VerifyingReader{
+		hashReader: newHashReader(d.alg.New(), r),
+		expected:   d,
+		size:       size,
+	}
+	return v, nil
+}
+
+// Reads from the source, replacing io.EOF with a *MismatchError if the
+// content does not match.
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.hashReader.Read(p)
+	if v.size >= 0 && v.length > v.size {
+		return n, v.mismatch()
+	}
+	if err == io.EOF {
+		if (v.size >= 0 && v.length != v.size) || v.actual() != v.expected {
+			return n, v.mismatch()
+		}
+		v.verified = true
+	}
+	return n, err
+}
+
+// WriteTo copies the source to w through Read, so that the content is
+// verified.
+func (v *VerifyingReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, readerOnly{v})
+}
+
+// Verified reports whether the source has been read to EOF and matched.
+func (v *VerifyingReader) Verified() bool {
+	return v.verified
+}
+
+func (v *VerifyingReader) actual() Digest {
+	return Digest{alg: v.expected.alg, hex: hex.EncodeToString(v.hash.Sum(nil))}
+}
+
+func (v *VerifyingReader) mismatch() error {
+	return &MismatchError{
+		Expected:     v.expected,
+		Actual:       v.actual(),
+		ExpectedSize: v.size,
+		ActualSize:   v.length,
+	}
+}
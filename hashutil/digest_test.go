@@ -0,0 +1,105 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const helloDigest = "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+func TestParseDigest(t *testing.T) {
+	d, err := ParseDigest(helloDigest)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if d.Algorithm() != SHA256 || d.String() != helloDigest || len(d.Sum()) != 32 {
+		t.Fatalf("Unexpected digest %#v", d)
+	}
+	if f, _ := FromBytes(SHA256, []byte("hello world")); f != d {
+		t.Fatalf("FromBytes = %s, want %s", f, d)
+	}
+	if _, err := ParseDigest("sha512:" + strings.Repeat("0", 128)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	bad := []string{
+		"",
+		strings.Repeat("a", 64),
+		"md5:5eb63bbbe01eeed093cb22bb8f5acdc3",
+		"sha256:" + strings.Repeat("a", 63),
+		"sha256:" + strings.ToUpper(helloDigest[7:]),
+		"sha256:" + strings.Repeat("g", 64),
+	}
+	for _, s := range bad {
+		if _, err := ParseDigest(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestDigestJSON(t *testing.T) {
+	type descriptor struct {
+		Digest Digest `json:"digest"`
+		Size   int64  `json:"size"`
+	}
+	in := `{"digest":"` + helloDigest + `","size":11}`
+	var desc descriptor
+	if err := json.Unmarshal([]byte(in), &desc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if desc.Digest.String() != helloDigest {
+		t.Fatalf("Unmarshalled %s", desc.Digest)
+	}
+	out, err := json.Marshal(desc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(out) != in {
+		t.Fatalf("Marshalled %s", out)
+	}
+	if err := json.Unmarshal([]byte(`{"digest":"sha256:abc"}`), &desc); err == nil {
+		t.Fatal("Expected an invalid digest to fail to unmarshal")
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	d, _ := ParseDigest(helloDigest)
+	tests := []struct {
+		input string
+		size  int64
+		ok    bool
+	}{
+		{"hello world", 11, true},
+		{"hello world", -1, true},
+		{"hello world", 10, false},
+		{"hello world", 12, false},
+		{"hello there", 11, false},
+	}
+	for _, tt := range tests {
+		v, err := NewVerifyingReader(strings.NewReader(tt.input), d, tt.size)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		_, err = io.Copy(ioutil.Discard, v)
+		if tt.ok != (err == nil) || tt.ok != v.Verified() {
+			t.Errorf("Reading %q with size %d: err = %v, verified = %v", tt.input, tt.size, err, v.Verified())
+		}
+		if err != nil {
+			if _, ok := err.(*MismatchError); !ok {
+				t.Errorf("Expected a *MismatchError; got %T", err)
+			}
+		}
+	}
+
+	// An oversized source fails before it is read to the end.
+	v, _ := NewVerifyingReader(strings.NewReader(strings.Repeat("x", 1024)), d, 11)
+	buf := make([]byte, 16)
+	if _, err := v.Read(buf); err == nil {
+		t.Fatal("Expected reading past the expected size to fail")
+	}
+}
@@ -3,6 +3,9 @@
 package hashutil
 
 import (
+	"encoding"
+	"encoding/binary"
+	"errors"
 	"hash"
 	"io"
 )
@@ -56,3 +59,139 @@ func (m *hashReader) Close() error {
 func (m *hashReader) Length() int64 {
 	return m.length
 }
+
+// WriteTo implements io.WriterTo so that io.Copy from the reader can use
+// the source's WriteTo, such as that of a bytes.Buffer, or the
+// destination's ReadFrom, rather than an intermediate buffer. Every byte
+// still passes through the hash.
+func (m *hashReader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := m.source.(io.WriterTo); ok {
+		tee := &hashWriter{dest: w, hash: m.hash}
+		n, err := wt.WriteTo(writerOnly{tee})
+		m.length += tee.length
+		return n, err
+	}
+	return io.Copy(w, readerOnly{m})
+}
+
+// Intermediate Writer object that will calculate the checksum value of the data
+// that passes through it.
+type hashWriter struct {
+	// The io.Writer destination.
+	dest io.Writer
+
+	// The total length of the data.
+	length int64
+
+	// The intermediate hash that is created and passed to newHashWriter.
+	hash hash.Hash
+}
+
+// Returns a new hashWriter.
+func newHashWriter(h hash.Hash, w io.Writer) *hashWriter {
+	return &hashWriter{
+		dest: w,
+		hash: h,
+	}
+}
+
+// Writes to the destination, and adds the data it accepted to the hash.
+func (m *hashWriter) Write(p []byte) (n int, err error) {
+	n, err = m.dest.Write(p)
+	if n > 0 {
+		// hash.Hash assures us that this can never return an error.
+		m.hash.Write(p[0:n])
+		m.length += int64(n)
+	}
+	return
+}
+
+// ReadFrom implements io.ReaderFrom so that io.Copy to the writer can use
+// the source's WriteTo or the destination's ReadFrom, rather than an
+// intermediate buffer. Every byte still passes through the hash, so the
+// kernel cannot copy file data directly with sendfile or splice.
+func (m *hashWriter) ReadFrom(r io.Reader) (int64, error) {
+	if wt, ok := r.(io.WriterTo); ok {
+		return wt.WriteTo(writerOnly{m})
+	}
+	if rf, ok := m.dest.(io.ReaderFrom); ok {
+		src := newHashReader(m.hash, r)
+		n, err := rf.ReadFrom(readerOnly{src})
+		m.length += src.length
+		return n, err
+	}
+	return io.Copy(writerOnly{m}, readerOnly{r})
+}
+
+// Closes the destination, if it implements io.Closer.
+func (m *hashWriter) Close() error {
+	if w, ok := m.dest.(io.Closer); ok {
+		return w.Close()
+	}
+	return nil
+}
+
+// Returns the number of bytes written through this writer.
+func (m *hashWriter) Length() int64 {
+	return m.length
+}
+
+// writerOnly and readerOnly hide any ReadFrom or WriteTo methods, so that
+// io.Copy cannot recurse back into the fast paths above.
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// Prefix of the state saved by MarshalBinary, identifying its format.
+const hashReaderMagic = "hashutil.reader\x01"
+
+// ErrInvalidState is returned by UnmarshalBinary when the state was not
+// saved by MarshalBinary.
+var ErrInvalidState = errors.New("hashutil: invalid reader state")
+
+// MarshalBinary implements encoding.BinaryMarshaler, saving the hash state
+// and length so that hashing can be resumed later. The source is not part of
+// the state; a resumed reader should read from where this one stopped, so
+// the state is best saved at the same time as the data read so far.
+func (m *hashReader) MarshalBinary() ([]byte, error) {
+	h, ok := m.hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.New("hashutil: hash state cannot be saved")
+	}
+	state, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(hashReaderMagic)+8, len(hashReaderMagic)+8+len(state))
+	copy(b, hashReaderMagic)
+	binary.BigEndian.PutUint64(b[len(hashReaderMagic):], uint64(m.length))
+	return append(b, state...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, restoring the hash
+// state and length saved by MarshalBinary on a reader of the same type. The
+// source is left as it is.
+func (m *hashReader) UnmarshalBinary(b []byte) error {
+	h, ok := m.hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("hashutil: hash state cannot be restored")
+	}
+	n := len(hashReaderMagic)
+	if len(b) < n+8 || string(b[:n]) != hashReaderMagic {
+		return ErrInvalidState
+	}
+	length := int64(binary.BigEndian.Uint64(b[n:]))
+	if length < 0 {
+		return ErrInvalidState
+	}
+	// The standard hashes reject state saved by a different algorithm.
+	if err := h.UnmarshalBinary(b[n+8:]); err != nil {
+		return err
+	}
+	m.length = length
+	return nil
+}
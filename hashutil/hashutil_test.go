@@ -0,0 +1,124 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHashReaderResume(t *testing.T) {
+	data := bytes.Repeat([]byte("resumable download "), 10000)
+	want := sha256.Sum256(data)
+
+	// Hash part of the data, as if the transfer were interrupted, and save
+	// the state.
+	first := NewSha256(bytes.NewReader(data))
+	if _, err := io.CopyN(ioutil.Discard, first, 12345); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	state, err := first.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Resume from the saved offset with a new reader.
+	second := NewSha256(bytes.NewReader(data[12345:]))
+	if err := second.UnmarshalBinary(state); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if second.Length() != 12345 {
+		t.Fatalf("Length() = %d after restoring, want 12345", second.Length())
+	}
+	if _, err := io.Copy(ioutil.Discard, second); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if second.Sha256() != hex.EncodeToString(want[:]) {
+		t.Fatalf("Resumed digest %s, want %x", second.Sha256(), want)
+	}
+	if second.Length() != int64(len(data)) {
+		t.Fatalf("Length() = %d, want %d", second.Length(), len(data))
+	}
+
+	// State cannot be restored into a reader for another algorithm, or from
+	// garbage.
+	if err := NewSha1(nil).UnmarshalBinary(state); err == nil {
+		t.Fatal("Expected SHA256 state to be rejected by a SHA1 reader")
+	}
+	if err := NewSha256(nil).UnmarshalBinary(state[:10]); err != ErrInvalidState {
+		t.Fatalf("Expected ErrInvalidState; got %v", err)
+	}
+}
+
+func TestHashWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("hash while writing "), 10000)
+	want := sha256.Sum256(data)
+
+	tmp, err := ioutil.TempFile("", "hashutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// Cover the source's WriteTo, the destination's ReadFrom and plain
+	// writes.
+	tests := []struct {
+		name string
+		dest io.Writer
+		src  io.Reader
+	}{
+		{"WriteTo", &bytes.Buffer{}, bytes.NewReader(data)},
+		{"ReadFrom", &bytes.Buffer{}, readerOnly{bytes.NewReader(data)}},
+		{"file", tmp, readerOnly{bytes.NewReader(data)}},
+		{"plain", writerOnly{&bytes.Buffer{}}, iotest.HalfReader(bytes.NewReader(data))},
+	}
+	for _, tc := range tests {
+		w := NewSha256Writer(tc.dest)
+		n, err := io.Copy(w, tc.src)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", tc.name, err)
+		}
+		if n != int64(len(data)) || w.Length() != n {
+			t.Fatalf("%s: copied %d bytes, Length() = %d, want %d", tc.name, n, w.Length(), len(data))
+		}
+		if w.Sha256() != hex.EncodeToString(want[:]) {
+			t.Fatalf("%s: digest %s, want %x", tc.name, w.Sha256(), want)
+		}
+	}
+	if err := NewSha256Writer(tmp).Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got, _ := ioutil.ReadFile(tmp.Name()); !bytes.Equal(got, data) {
+		t.Fatal("File contents differ")
+	}
+
+	m := NewMd5Writer(ioutil.Discard)
+	io.WriteString(m, "test1")
+	if m.Md5() != "5a105e8b9d40e1329780d62ea2265d8a" || m.Length() != 5 {
+		t.Fatalf("Md5() = %s, Length() = %d", m.Md5(), m.Length())
+	}
+}
+
+func TestHashReaderWriteTo(t *testing.T) {
+	data := bytes.Repeat([]byte("copy out "), 10000)
+	want := sha256.Sum256(data)
+	for _, src := range []io.Reader{bytes.NewBuffer(data), iotest.HalfReader(bytes.NewReader(data))} {
+		r := NewSha256(src)
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) || r.Length() != int64(len(data)) {
+			t.Fatalf("Copied %d bytes, Length() = %d", buf.Len(), r.Length())
+		}
+		if r.Sha256() != hex.EncodeToString(want[:]) {
+			t.Fatalf("Digest %s, want %x", r.Sha256(), want)
+		}
+	}
+}
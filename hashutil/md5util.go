@@ -43,3 +43,20 @@ func NewMd5(r io.Reader) *Md5Reader {
 func (m *Md5Reader) Md5() string {
 	return hex.EncodeToString(m.hash.Sum(nil))
 }
+
+// Intermediate Writer object that will calculate the MD5 value of the data
+// written through it.
+type Md5Writer struct {
+	*hashWriter
+}
+
+// Returns a new Md5Writer writing to w.
+func NewMd5Writer(w io.Writer) *Md5Writer {
+	return &Md5Writer{hashWriter: newHashWriter(md5.New(), w)}
+}
+
+// Returns the MD5 for all data that has been written through this Writer
+// already.
+func (w *Md5Writer) Md5() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// An Algorithm names a hash function. Its string form is the prefix used
+// in "algo:hex" digests.
+type Algorithm string
+
+// The supported algorithms.
+const (
+	MD5        Algorithm = "md5"
+	SHA1       Algorithm = "sha1"
+	SHA256     Algorithm = "sha256"
+	SHA384     Algorithm = "sha384"
+	SHA512     Algorithm = "sha512"
+	BLAKE2b256 Algorithm = "blake2b-256"
+	BLAKE2b512 Algorithm = "blake2b-512"
+	CRC32C     Algorithm = "crc32c"
+	XXH64      Algorithm = "xxh64"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// algorithms maps each supported algorithm to its constructor and digest
+// size in bytes.
+var algorithms = map[Algorithm]struct {
+	new  func() hash.Hash
+	size int
+}{
+	MD5:        {md5.New, md5.Size},
+	SHA1:       {sha1.New, sha1.Size},
+	SHA256:     {sha256.New, sha256.Size},
+	SHA384:     {sha512.New384, sha512.Size384},
+	SHA512:     {sha512.New, sha512.Size},
+	BLAKE2b256: {func() hash.Hash { return newBlake2b(32) }, 32},
+	BLAKE2b512: {func() hash.Hash { return newBlake2b(64) }, 64},
+	CRC32C:     {func() hash.Hash { return crc32.New(castagnoli) }, crc32.Size},
+	XXH64:      {func() hash.Hash { return newXXH64() }, 8},
+}
+
+// Algorithms returns the supported algorithms in sorted order.
+func Algorithms() []Algorithm {
+	algs := make([]Algorithm, 0, len(algorithms))
+	for a := range algorithms {
+		algs = append(algs, a)
+	}
+	sort.Sort(byName(algs))
+	return algs
+}
+
+// Available reports whether a is a supported algorithm.
+func (a Algorithm) Available() bool {
+	_, ok := algorithms[a]
+	return ok
+}
+
+// New returns a new hash.Hash computing a. It panics if a is not
+// available.
+func (a Algorithm) New() hash.Hash {
+	alg, ok := algorithms[a]
+	if !ok {
+		panic("hashutil: unknown algorithm " + string(a))
+	}
+	return alg.new()
+}
+
+// Size returns the length of a's digest in bytes, or 0 if a is not
+// available.
+func (a Algorithm) Size() int {
+	return algorithms[a].size
+}
+
+// byName sorts algorithms by name.
+type byName []Algorithm
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Less(i, j int) bool { return a[i] < a[j] }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// A DigestSet holds the digests of the same data under several algorithms.
+type DigestSet map[Algorithm][]byte
+
+// Hex returns the hex encoded digest for a, or "" if the set does not
+// contain it.
+func (d DigestSet) Hex(a Algorithm) string {
+	sum, ok := d[a]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+// Format returns the digest for a in "algo:hex" form, or "" if the set does
+// not contain it.
+func (d DigestSet) Format(a Algorithm) string {
+	if _, ok := d[a]; !ok {
+		return ""
+	}
+	return string(a) + ":" + d.Hex(a)
+}
+
+// String returns every digest in "algo:hex" form, sorted by algorithm and
+// separated by spaces.
+func (d DigestSet) String() string {
+	algs := make([]Algorithm, 0, len(d))
+	for a := range d {
+		algs = append(algs, a)
+	}
+	sort.Sort(byName(algs))
+	parts := make([]string, len(algs))
+	for i, a := range algs {
+		parts[i] = d.Format(a)
+	}
+	return strings.Join(parts, " ")
+}
+
+// MultiHasher computes several digests of the data written to it in a
+// single pass.
+type MultiHasher struct {
+	algs   []Algorithm
+	hashes []hash.Hash
+	length int64
+}
+
+// NewMultiHasher returns a MultiHasher computing each of algs, which must
+// be available and distinct.
+func NewMultiHasher(algs ...Algorithm) (*MultiHasher, error) {
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("hashutil: no algorithms given")
+	}
+	m := &MultiHasher{}
+	seen := make(map[Algorithm]bool)
+	for _, a := range algs {
+		if !a.Available() {
+			return nil, fmt.Errorf("hashutil: unknown algorithm %q", a)
+		}
+		if seen[a] {
+			return nil, fmt.Errorf("hashutil: algorithm %q given twice", a)
+		}
+		seen[a] = true
+		m.algs = append(m.algs, a)
+		m.hashes = append(m.hashes, a.New())
+	}
+	return m, nil
+}
+
+// Write adds p to every hash. It never returns an error.
+func (m *MultiHasher) Write(p []byte) (int, error) {
+	for _, h := range m.hashes {
+		// hash.Hash assures us that this can never return an error.
+		h.Write(p)
+	}
+	m.length += int64(len(p))
+	return len(p), nil
+}
+
+// Digests returns the digests of the data written so far.
+func (m *MultiHasher) Digests() DigestSet {
+	d := make(DigestSet, len(m.hashes))
+	for i, h := range m.hashes {
+		d[m.algs[i]] = h.Sum(nil)
+	}
+	return d
+}
+
+// Length returns the number of bytes written.
+func (m *MultiHasher) Length() int64 {
+	return m.length
+}
+
+// Reset discards the data written so far.
+func (m *MultiHasher) Reset() {
+	for _, h := range m.hashes {
+		h.Reset()
+	}
+	m.length = 0
+}
+
+// MultiReader computes several digests of the data read through it.
+type MultiReader struct {
+	// The hashes of the data, kept unexported so that callers cannot add
+	// to them or reset them.
+	hasher *MultiHasher
+
+	// The io.Reader source.
+	source io.Reader
+}
+
+// NewMultiReader returns a MultiReader reading from r and computing each of
+// algs.
+func NewMultiReader(r io.Reader, algs ...Algorithm) (*MultiReader, error) {
+	m, err := NewMultiHasher(algs...)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiReader{hasher: m, source: r}, nil
+}
+
+// Reads from the source, and returns the values upstream after adding the data
+// to the hashes.
+func (m *MultiReader) Read(p []byte) (n int, err error) {
+	n, err = m.source.Read(p)
+	if n > 0 {
+		m.hasher.Write(p[:n])
+	}
+	return
+}
+
+// Digests returns the digests of the data read so far.
+func (m *MultiReader) Digests() DigestSet {
+	return m.hasher.Digests()
+}
+
+// Length returns the number of bytes read.
+func (m *MultiReader) Length() int64 {
+	return m.hasher.Length()
+}
+
+// Closes the source, if it implements io.Closer.
+func (m *MultiReader) Close() error {
+	if r, ok := m.source.(io.Closer); ok {
+		return r.Close()
+	}
+	return nil
+}
+
+// MultiWriter computes several digests of the data written through it to
+// another writer.
+type MultiWriter struct {
+	// The hashes of the data, kept unexported so that callers cannot add
+	// to them or reset them.
+	hasher *MultiHasher
+
+	// The io.Writer destination.
+	dest io.Writer
+}
+
+// NewMultiWriter returns a MultiWriter writing to w and computing each of
+// algs.
+func NewMultiWriter(w io.Writer, algs ...Algorithm) (*MultiWriter, error) {
+	m, err := NewMultiHasher(algs...)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiWriter{hasher: m, dest: w}, nil
+}
+
+// Write writes p to the destination and adds the bytes written to the
+// hashes.
+func (m *MultiWriter) Write(p []byte) (int, error) {
+	n, err := m.dest.Write(p)
+	if n > 0 {
+		m.hasher.Write(p[:n])
+	}
+	return n, err
+}
+
+// Digests returns the digests of the data written so far.
+func (m *MultiWriter) Digests() DigestSet {
+	return m.hasher.Digests()
+}
+
+// Length returns the number of bytes written.
+func (m *MultiWriter) Length() int64 {
+	return m.hasher.Length()
+}
+
+// Closes the destination, if it implements io.Closer.
+func (m *MultiWriter) Close() error {
+	if w, ok := m.dest.(io.Closer); ok {
+		return w.Close()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const quickFox = "The quick brown fox jumps over the lazy dog"
+
+var quickFoxDigests = map[Algorithm]string{
+	MD5:        "9e107d9d372bb6826bd81d3542a419d6",
+	SHA1:       "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+	SHA256:     "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+	SHA384:     "ca737f1014a48f4c0b6dd43cb177b0afd9e5169367544c494011e3317dbf9a509cb1e5dc1e85a941bbee3d7f2afbc9b1",
+	SHA512:     "07e547d9586f6a73f73fbac0435ed76951218fb7d0c8d788a309d785436bbb642e93a252a954f23912547d1e8a3b5ed6e1bfd7097821233fa0538f3db854fee6",
+	BLAKE2b256: "01718cec35cd3d796dd00020e0bfecb473ad23457d063b75eff29c0ffa2e58a9",
+	BLAKE2b512: "a8add4bdddfd93e4877d2746e62817b116364a1fa7bc148d95090bc7333b3673f82401cf7aa2e4cb1ecd90296e3f14cb5413f8ed77be73045b13914cdcd6a918",
+	CRC32C:     "22620404",
+	XXH64:      "0b242d361fda71bc",
+}
+
+func TestMultiReader(t *testing.T) {
+	// One byte reads exercise the partial block handling of every hash.
+	r, err := NewMultiReader(iotest.OneByteReader(strings.NewReader(quickFox)), Algorithms()...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Length() != int64(len(quickFox)) {
+		t.Fatalf("Length() = %d, want %d", r.Length(), len(quickFox))
+	}
+	d := r.Digests()
+	for a, want := range quickFoxDigests {
+		if got := d.Hex(a); got != want {
+			t.Errorf("%s = %s, want %s", a, got, want)
+		}
+		if got := d.Format(a); got != string(a)+":"+want {
+			t.Errorf("Format(%s) = %s", a, got)
+		}
+		if len(d[a]) != a.Size() {
+			t.Errorf("%s digest is %d bytes, want %d", a, len(d[a]), a.Size())
+		}
+	}
+	if len(d) != len(quickFoxDigests) {
+		t.Fatalf("Expected %d digests; got %d", len(quickFoxDigests), len(d))
+	}
+}
+
+func TestMultiHasherKnownVectors(t *testing.T) {
+	tests := []struct {
+		alg   Algorithm
+		input string
+		want  string
+	}{
+		{BLAKE2b512, "", "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{BLAKE2b512, "abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{BLAKE2b256, "abc", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{XXH64, "", "ef46db3751d8e999"},
+		{XXH64, "abc", "44bc2cf5ad770999"},
+	}
+	for _, tt := range tests {
+		m, err := NewMultiHasher(tt.alg)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		io.WriteString(m, tt.input)
+		if got := m.Digests().Hex(tt.alg); got != tt.want {
+			t.Errorf("%s(%q) = %s, want %s", tt.alg, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMultiHasherBlockBoundaries(t *testing.T) {
+	// Writing in uneven pieces must give the same digests as one write,
+	// including across the 32 byte XXH64 and 128 byte BLAKE2b blocks.
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 100)
+	for _, size := range []int{0, 31, 32, 33, 127, 128, 129, 256, len(data)} {
+		whole, _ := NewMultiHasher(Algorithms()...)
+		whole.Write(data[:size])
+		pieces, _ := NewMultiHasher(Algorithms()...)
+		for p, step := data[:size], 1; len(p) > 0; step = step*2 + 1 {
+			if step > len(p) {
+				step = len(p)
+			}
+			pieces.Write(p[:step])
+			p = p[step:]
+		}
+		if a, b := whole.Digests().String(), pieces.Digests().String(); a != b {
+			t.Errorf("Digests of %d bytes differ:\n%s\n%s", size, a, b)
+		}
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewMultiWriter(&buf, SHA256, MD5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	io.WriteString(w, quickFox)
+	if buf.String() != quickFox {
+		t.Fatalf("Destination got %q", buf.String())
+	}
+	want := "md5:" + quickFoxDigests[MD5] + " sha256:" + quickFoxDigests[SHA256]
+	if got := w.Digests().String(); got != want {
+		t.Fatalf("String() = %s, want %s", got, want)
+	}
+
+	if w.Length() != int64(len(quickFox)) {
+		t.Fatalf("Length() = %d, want %d", w.Length(), len(quickFox))
+	}
+
+	// Only the data written through the writer can be hashed.
+	if _, ok := interface{}(w).(interface {
+		Reset()
+	}); ok {
+		t.Fatal("MultiWriter should not allow its hashes to be reset")
+	}
+}
+
+func TestMultiReaderReadOnly(t *testing.T) {
+	r, err := NewMultiReader(strings.NewReader(quickFox), MD5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// io.Copy must not mistake the reader for a writer.
+	if _, ok := interface{}(r).(io.Writer); ok {
+		t.Fatal("MultiReader should not be an io.Writer")
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := r.Digests().Hex(MD5); got != quickFoxDigests[MD5] {
+		t.Fatalf("Digests().Hex(MD5) = %s, want %s", got, quickFoxDigests[MD5])
+	}
+}
+
+func TestMultiHasherReset(t *testing.T) {
+	m, err := NewMultiHasher(MD5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	io.WriteString(m, quickFox)
+	m.Reset()
+	if m.Length() != 0 || m.Digests().Hex(MD5) != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Fatal("Reset did not discard the data written")
+	}
+}
+
+func TestNewMultiHasherErrors(t *testing.T) {
+	for _, algs := range [][]Algorithm{nil, {"sha3"}, {SHA1, SHA1}} {
+		if _, err := NewMultiHasher(algs...); err == nil {
+			t.Errorf("Expected an error for %v", algs)
+		}
+	}
+}
+
+func BenchmarkMultiReader(b *testing.B) {
+	data := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r, _ := NewMultiReader(bytes.NewReader(data), MD5, SHA256, CRC32C, XXH64)
+		io.Copy(ioutil.Discard, r)
+	}
+}
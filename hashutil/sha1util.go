@@ -43,3 +43,20 @@ func NewSha1(r io.Reader) *Sha1Reader {
 func (s *Sha1Reader) Sha1() string {
 	return hex.EncodeToString(s.hash.Sum(nil))
 }
+
+// Intermediate Writer object that will calculate the SHA1 value of the data
+// written through it.
+type Sha1Writer struct {
+	*hashWriter
+}
+
+// Returns a new Sha1Writer writing to w.
+func NewSha1Writer(w io.Writer) *Sha1Writer {
+	return &Sha1Writer{hashWriter: newHashWriter(sha1.New(), w)}
+}
+
+// Returns the SHA1 for all data that has been written through this Writer
+// already.
+func (w *Sha1Writer) Sha1() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
@@ -43,3 +43,20 @@ func NewSha256(r io.Reader) *Sha256Reader {
 func (s *Sha256Reader) Sha256() string {
 	return hex.EncodeToString(s.hash.Sum(nil))
 }
+
+// Intermediate Writer object that will calculate the SHA256 value of the data
+// written through it.
+type Sha256Writer struct {
+	*hashWriter
+}
+
+// Returns a new Sha256Writer writing to w.
+func NewSha256Writer(w io.Writer) *Sha256Writer {
+	return &Sha256Writer{hashWriter: newHashWriter(sha256.New(), w)}
+}
+
+// Returns the SHA256 for all data that has been written through this Writer
+// already.
+func (w *Sha256Writer) Sha256() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
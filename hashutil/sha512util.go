@@ -43,3 +43,20 @@ func NewSha512(r io.Reader) *Sha512Reader {
 func (s *Sha512Reader) Sha512() string {
 	return hex.EncodeToString(s.hash.Sum(nil))
 }
+
+// Intermediate Writer object that will calculate the SHA512 value of the data
+// written through it.
+type Sha512Writer struct {
+	*hashWriter
+}
+
+// Returns a new Sha512Writer writing to w.
+func NewSha512Writer(w io.Writer) *Sha512Writer {
+	return &Sha512Writer{hashWriter: newHashWriter(sha512.New(), w)}
+}
+
+// Returns the SHA512 for all data that has been written through this Writer
+// already.
+func (w *Sha512Writer) Sha512() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
@@ -0,0 +1,305 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// TreeOptions controls HashTree and VerifyTree.
+type TreeOptions struct {
+	// Algorithm is the digest algorithm, SHA256 if empty. VerifyTree always
+	// uses the manifest's algorithm.
+	Algorithm Algorithm
+
+	// Concurrency is the number of files hashed at once, the number of CPUs
+	// if zero.
+	Concurrency int
+}
+
+// ManifestEntry describes one file, directory or symlink in a tree.
+type ManifestEntry struct {
+	// Path is slash separated and relative to the root of the tree.
+	Path string `json:"path"`
+
+	// Mode holds the type and permission bits. Symlinks always have 0777
+	// permissions, as not every system keeps them.
+	Mode os.FileMode `json:"mode"`
+
+	// Size is the length of a regular file.
+	Size int64 `json:"size,omitempty"`
+
+	// Target is the target of a symlink.
+	Target string `json:"target,omitempty"`
+
+	// Digest is the content digest of a regular file, the digest of a
+	// symlink's target, or the Merkle digest of a directory's contents.
+	Digest Digest `json:"digest"`
+}
+
+// Manifest lists every entry below the root of a tree, sorted by path,
+// with a root digest covering them all.
+type Manifest struct {
+	Algorithm Algorithm       `json:"algorithm"`
+	Root      Digest          `json:"root"`
+	Entries   []ManifestEntry `json:"entries"`
+}
+
+// ReadManifest decodes a manifest saved with Write.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if !digestAlgorithms[m.Algorithm] {
+		return nil, fmt.Errorf("hashutil: manifest has unsupported algorithm %q", m.Algorithm)
+	}
+	return m, nil
+}
+
+// Write encodes the manifest as JSON.
+func (m *Manifest) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(m)
+}
+
+// HashTree hashes every file below dir, along with the names, modes and
+// symlink targets of the tree. The root digest of two trees is the same
+// exactly when their manifests are, regardless of modification times or
+// ownership. Symlinks are not followed, and other special files are an
+// error.
+func HashTree(dir string, opts *TreeOptions) (*Manifest, error) {
+	var o TreeOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Algorithm == "" {
+		o.Algorithm = SHA256
+	}
+	if !digestAlgorithms[o.Algorithm] {
+		return nil, fmt.Errorf("hashutil: unsupported digest algorithm %q", o.Algorithm)
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = runtime.NumCPU()
+	}
+
+	entries, err := walkTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := hashFiles(dir, entries, o); err != nil {
+		return nil, err
+	}
+	m := &Manifest{Algorithm: o.Algorithm, Entries: entries}
+	m.Root = merkle(o.Algorithm, entries)
+	return m, nil
+}
+
+// walkTree lists the entries below dir, and fills in the digests of
+// symlinks.
+func walkTree(dir string) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if !info.IsDir() {
+				return fmt.Errorf("hashutil: %s is not a directory", dir)
+			}
+			return nil
+		}
+		e := ManifestEntry{
+			Path: filepath.ToSlash(rel),
+			Mode: info.Mode() & (os.ModeType | os.ModePerm),
+		}
+		switch {
+		case info.Mode().IsRegular():
+			e.Size = info.Size()
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Mode = os.ModeSymlink | 0777
+			if e.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("hashutil: %s: unsupported file type %s", p, info.Mode())
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Walk visits entries in lexical order of their native paths, which is
+	// not quite the order of their slash separated ones everywhere.
+	sort.Sort(byPath(entries))
+	return entries, nil
+}
+
+// hashFiles fills in the digests of the regular files and symlinks in
+// entries, hashing files concurrently. The first error stops further work
+// and is returned.
+func hashFiles(dir string, entries []ManifestEntry, o TreeOptions) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	work := make(chan *ManifestEntry)
+	failed := make(chan struct{})
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				if err := hashFile(dir, e, o.Algorithm); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+send:
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.Mode.IsRegular():
+			select {
+			case work <- e:
+			case <-failed:
+				break send
+			}
+		case e.Mode&os.ModeSymlink != 0:
+			e.Digest, _ = FromBytes(o.Algorithm, []byte(e.Target))
+		}
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// hashFile sets the digest of a regular file, which must still have the
+// size it was listed with.
+func hashFile(dir string, e *ManifestEntry, alg Algorithm) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(e.Path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, n, err := FromReader(alg, f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", f.Name(), err)
+	}
+	if n != e.Size {
+		return fmt.Errorf("hashutil: %s changed size while being hashed", f.Name())
+	}
+	e.Digest = d
+	return nil
+}
+
+// merkle fills in the digest of every directory in entries, which must be
+// sorted by path, and returns the digest of the root. A directory's digest
+// covers the type, permissions, name and digest of each of its children in
+// name order, so it changes whenever anything below it does.
+func merkle(alg Algorithm, entries []ManifestEntry) Digest {
+	children := make(map[string][]*ManifestEntry)
+	for i := range entries {
+		e := &entries[i]
+		parent := path.Dir(e.Path)
+		children[parent] = append(children[parent], e)
+	}
+	var node func(dir string) Digest
+	node = func(dir string) Digest {
+		h := alg.New()
+		for _, c := range children[dir] {
+			if c.Mode.IsDir() {
+				c.Digest = node(c.Path)
+			}
+			// Names cannot hold a NUL, and digests are a fixed length, so
+			// each record is unambiguous.
+			fmt.Fprintf(h, "%o %s\x00%s\n", uint32(c.Mode), path.Base(c.Path), c.Digest.Hex())
+		}
+		d, _ := NewDigest(alg, h.Sum(nil))
+		return d
+	}
+	return node(".")
+}
+
+// TreeChange is a difference between a tree and its manifest.
+type TreeChange struct {
+	// Op is "added", "removed" or "modified".
+	Op   string
+	Path string
+}
+
+// VerifyTree hashes the tree below dir and compares it to m. It returns the
+// changes needed to bring the manifest up to date, sorted by path, which is
+// empty when the tree matches. A directory is only reported as modified if
+// its mode changed; changes to its contents are reported individually.
+func VerifyTree(dir string, m *Manifest, opts *TreeOptions) ([]TreeChange, error) {
+	var o TreeOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.Algorithm = m.Algorithm
+	current, err := HashTree(dir, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []TreeChange
+	saved := append([]ManifestEntry(nil), m.Entries...)
+	sort.Sort(byPath(saved))
+	now := current.Entries
+	for len(saved) > 0 || len(now) > 0 {
+		switch {
+		case len(now) == 0 || len(saved) > 0 && saved[0].Path < now[0].Path:
+			changes = append(changes, TreeChange{Op: "removed", Path: saved[0].Path})
+			saved = saved[1:]
+		case len(saved) == 0 || now[0].Path < saved[0].Path:
+			changes = append(changes, TreeChange{Op: "added", Path: now[0].Path})
+			now = now[1:]
+		default:
+			a, b := saved[0], now[0]
+			if a.Mode != b.Mode || !a.Mode.IsDir() && a.Digest != b.Digest {
+				changes = append(changes, TreeChange{Op: "modified", Path: a.Path})
+			}
+			saved, now = saved[1:], now[1:]
+		}
+	}
+	return changes, nil
+}
+
+// byPath sorts manifest entries by path.
+type byPath []ManifestEntry
+
+func (a byPath) Len() int           { return len(a) }
+func (a byPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+func (a byPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
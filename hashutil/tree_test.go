@@ -0,0 +1,137 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeTree creates a small tree in a new temporary directory.
+func makeTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "hashutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":       "hello world",
+		"bin/run":     "#!/bin/sh\n",
+		"sub/b.txt":   "b",
+		"sub/c/d.txt": strings.Repeat("d", 100000),
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Avoid depending on the umask.
+		os.Chmod(p, 0644)
+	}
+	os.Chmod(filepath.Join(dir, "bin/run"), 0755)
+	if err := os.Symlink("../a.txt", filepath.Join(dir, "sub/link")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestHashTree(t *testing.T) {
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+
+	m, err := HashTree(dir, &TreeOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var paths []string
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"a.txt", "bin", "bin/run", "sub", "sub/b.txt", "sub/c", "sub/c/d.txt", "sub/link"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("Entries = %v, want %v", paths, want)
+	}
+	if m.Entries[0].Digest.String() != helloDigest || m.Entries[0].Size != 11 {
+		t.Fatalf("Unexpected entry %+v", m.Entries[0])
+	}
+	if e := m.Entries[7]; e.Target != "../a.txt" || e.Mode != os.ModeSymlink|0777 {
+		t.Fatalf("Unexpected symlink entry %+v", e)
+	}
+
+	// The root is stable, and covers modes and symlink targets as well as
+	// content.
+	again, _ := HashTree(dir, nil)
+	if again.Root != m.Root {
+		t.Fatalf("Root changed between runs: %s, %s", m.Root, again.Root)
+	}
+	os.Chmod(filepath.Join(dir, "bin/run"), 0644)
+	chmodded, _ := HashTree(dir, nil)
+	if chmodded.Root == m.Root {
+		t.Fatal("Root did not change with a file mode")
+	}
+	os.Remove(filepath.Join(dir, "sub/link"))
+	os.Symlink("b.txt", filepath.Join(dir, "sub/link"))
+	relinked, _ := HashTree(dir, nil)
+	if relinked.Root == chmodded.Root {
+		t.Fatal("Root did not change with a symlink target")
+	}
+
+	sha512, err := HashTree(dir, &TreeOptions{Algorithm: SHA512})
+	if err != nil || sha512.Root.Algorithm() != SHA512 {
+		t.Fatalf("HashTree with SHA512: %s, %v", sha512.Root, err)
+	}
+	if _, err := HashTree(dir, &TreeOptions{Algorithm: MD5}); err == nil {
+		t.Fatal("Expected MD5 to be rejected")
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	dir := makeTree(t)
+	defer os.RemoveAll(dir)
+
+	m, err := HashTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	saved, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(saved, m) {
+		t.Fatalf("Manifest did not round trip:\n%+v\n%+v", saved, m)
+	}
+
+	changes, err := VerifyTree(dir, saved, nil)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("Unmodified tree: %v, %v", changes, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "sub/b.txt"), []byte("B"), 0644)
+	os.Remove(filepath.Join(dir, "a.txt"))
+	ioutil.WriteFile(filepath.Join(dir, "new.txt"), nil, 0644)
+	os.Chmod(filepath.Join(dir, "sub/c"), 0700)
+	changes, err = VerifyTree(dir, saved, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := []TreeChange{
+		{Op: "removed", Path: "a.txt"},
+		{Op: "added", Path: "new.txt"},
+		{Op: "modified", Path: "sub/b.txt"},
+		{Op: "modified", Path: "sub/c"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("VerifyTree = %v, want %v", changes, want)
+	}
+}
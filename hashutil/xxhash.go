@@ -0,0 +1,128 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package hashutil
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// XXH64, the 64 bit variant of xxHash, with a seed of zero. It is not a
+// cryptographic hash but is much faster than one, which makes it suitable
+// for detecting accidental corruption.
+// Spec: https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+// newXXH64 returns an XXH64 hash with a seed of zero. Its digest is the
+// big endian encoding of the 64 bit hash, as printed by xxhsum.
+func newXXH64() hash.Hash64 {
+	d := &xxh64{}
+	d.Reset()
+	return d
+}
+
+func (d *xxh64) Size() int      { return 8 }
+func (d *xxh64) BlockSize() int { return 32 }
+
+func (d *xxh64) Reset() {
+	// The initial accumulators wrap around, so they are computed from
+	// variables rather than as constants.
+	p1, p2 := xxPrime1, xxPrime2
+	d.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	d.total = 0
+	d.n = 0
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = acc<<31 | acc>>33
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (d *xxh64) stripe(b []byte) {
+	d.v[0] = xxRound(d.v[0], binary.LittleEndian.Uint64(b[0:]))
+	d.v[1] = xxRound(d.v[1], binary.LittleEndian.Uint64(b[8:]))
+	d.v[2] = xxRound(d.v[2], binary.LittleEndian.Uint64(b[16:]))
+	d.v[3] = xxRound(d.v[3], binary.LittleEndian.Uint64(b[24:]))
+}
+
+func (d *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	d.total += uint64(n)
+	if d.n > 0 {
+		m := copy(d.buf[d.n:], p)
+		d.n += m
+		p = p[m:]
+		if d.n < len(d.buf) {
+			return n, nil
+		}
+		d.stripe(d.buf[:])
+		d.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		d.stripe(p)
+	}
+	d.n = copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *xxh64) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = (d.v[0]<<1 | d.v[0]>>63) + (d.v[1]<<7 | d.v[1]>>57) +
+			(d.v[2]<<12 | d.v[2]>>52) + (d.v[3]<<18 | d.v[3]>>46)
+		for _, v := range d.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += d.total
+
+	p := d.buf[:d.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = (h<<27|h>>37)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = (h<<23|h>>41)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, c := range p {
+		h ^= uint64(c) * xxPrime5
+		h = (h<<11 | h>>53) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (d *xxh64) Sum(b []byte) []byte {
+	var out [8]byte
+	binary.BigEndian.PutUint64(out[:], d.Sum64())
+	return append(b, out[:]...)
+}
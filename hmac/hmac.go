@@ -3,16 +3,120 @@
 package hmac
 
 import (
+	"crypto"
 	"crypto/hmac"
-	"crypto/sha1"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
 )
 
 // Compute the Hmac Sha1
 // Takes a mesasge and secret as strings.
 func ComputeHmacSha1(message string, secret string) string {
-	key := []byte(secret)
-	h := hmac.New(sha1.New, key)
-	h.Write([]byte(message))
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return SumBase64(crypto.SHA1, message, secret)
+}
+
+// ComputeHmacSha256 returns the base64 encoded HMAC-SHA256 of message.
+func ComputeHmacSha256(message string, secret string) string {
+	return SumBase64(crypto.SHA256, message, secret)
+}
+
+// ComputeHmacSha512 returns the base64 encoded HMAC-SHA512 of message.
+func ComputeHmacSha512(message string, secret string) string {
+	return SumBase64(crypto.SHA512, message, secret)
+}
+
+// Sum returns the raw HMAC of message using the given hash, which must be one
+// of crypto.SHA1, crypto.SHA256, crypto.SHA384 or crypto.SHA512.
+func Sum(h crypto.Hash, message, secret []byte) []byte {
+	s := NewSigner(h, secret)
+	s.Write(message)
+	return s.MAC()
+}
+
+// SumBase64 returns the standard base64 encoded HMAC of message.
+func SumBase64(h crypto.Hash, message, secret string) string {
+	return base64.StdEncoding.EncodeToString(Sum(h, []byte(message), []byte(secret)))
+}
+
+// SumHex returns the lower case hex encoded HMAC of message.
+func SumHex(h crypto.Hash, message, secret string) string {
+	return hex.EncodeToString(Sum(h, []byte(message), []byte(secret)))
+}
+
+// Verify reports whether mac is the correct HMAC of message. The comparison is
+// done in constant time.
+func Verify(h crypto.Hash, message, secret, mac []byte) bool {
+	return hmac.Equal(Sum(h, message, secret), mac)
+}
+
+// VerifyBase64 reports whether encoded is the correct base64 encoded HMAC of
+// message. The comparison is done in constant time.
+func VerifyBase64(h crypto.Hash, message, secret, encoded string) bool {
+	mac, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return Verify(h, []byte(message), []byte(secret), mac)
+}
+
+// VerifyHex reports whether encoded is the correct hex encoded HMAC of
+// message. The comparison is done in constant time.
+func VerifyHex(h crypto.Hash, message, secret, encoded string) bool {
+	mac, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return Verify(h, []byte(message), []byte(secret), mac)
+}
+
+// A Signer computes an HMAC over data written to it, allowing large bodies to
+// be signed without holding them in memory.
+type Signer struct {
+	mac hash.Hash
+}
+
+// NewSigner returns a Signer using the given hash and secret.
+func NewSigner(h crypto.Hash, secret []byte) *Signer {
+	return &Signer{mac: hmac.New(h.New, secret)}
+}
+
+// Write adds more data to the running HMAC. It never returns an error.
+func (s *Signer) Write(p []byte) (int, error) {
+	return s.mac.Write(p)
+}
+
+// ReadFrom adds everything read from r to the running HMAC.
+func (s *Signer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(s.mac, r)
+}
+
+// Reset discards all data written so far.
+func (s *Signer) Reset() {
+	s.mac.Reset()
+}
+
+// MAC returns the raw HMAC of the data written so far.
+func (s *Signer) MAC() []byte {
+	return s.mac.Sum(nil)
+}
+
+// Base64 returns the standard base64 encoded HMAC of the data written so far.
+func (s *Signer) Base64() string {
+	return base64.StdEncoding.EncodeToString(s.MAC())
+}
+
+// Hex returns the hex encoded HMAC of the data written so far.
+func (s *Signer) Hex() string {
+	return hex.EncodeToString(s.MAC())
+}
+
+// Verify reports, in constant time, whether mac matches the HMAC of the data
+// written so far.
+func (s *Signer) Verify(mac []byte) bool {
+	return hmac.Equal(s.MAC(), mac)
 }
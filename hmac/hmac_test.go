@@ -3,6 +3,8 @@
 package hmac
 
 import (
+	"crypto"
+	"strings"
 	"testing"
 
 	tt "github.com/apcera/util/testtool"
@@ -16,3 +18,54 @@ func TestComputeHmacSha1(t *testing.T) {
 	hmacSha1 := ComputeHmacSha1("message", "secret")
 	tt.TestEqual(t, hmacSha1, "DK9kn+7klT2Hv5A6wRdsReAo3xY=")
 }
+
+// RFC 4231 test case 2.
+var (
+	rfc4231Key  = "Jefe"
+	rfc4231Data = "what do ya want for nothing?"
+)
+
+func TestSumHex(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	tt.TestEqual(t, SumHex(crypto.SHA256, rfc4231Data, rfc4231Key),
+		"5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843")
+	tt.TestEqual(t, SumHex(crypto.SHA512, rfc4231Data, rfc4231Key),
+		"164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea250554"+
+			"9758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737")
+	tt.TestEqual(t, ComputeHmacSha256(rfc4231Data, rfc4231Key),
+		"W9zBRr9gdU5qBCQmCJV1x1oAPwidJzmDnexYuWTsOEM=")
+}
+
+func TestVerify(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	mac := ComputeHmacSha512("message", "secret")
+	tt.TestEqual(t, VerifyBase64(crypto.SHA512, "message", "secret", mac), true)
+	tt.TestEqual(t, VerifyBase64(crypto.SHA512, "message", "wrong", mac), false)
+	tt.TestEqual(t, VerifyBase64(crypto.SHA512, "message", "secret", "!!"), false)
+
+	hexMac := SumHex(crypto.SHA1, "message", "secret")
+	tt.TestEqual(t, VerifyHex(crypto.SHA1, "message", "secret", hexMac), true)
+	tt.TestEqual(t, VerifyHex(crypto.SHA1, "massage", "secret", hexMac), false)
+}
+
+func TestSigner(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	s := NewSigner(crypto.SHA256, []byte(rfc4231Key))
+	n, err := s.ReadFrom(strings.NewReader(rfc4231Data[:10]))
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, n, int64(10))
+	s.Write([]byte(rfc4231Data[10:]))
+
+	tt.TestEqual(t, s.Hex(), SumHex(crypto.SHA256, rfc4231Data, rfc4231Key))
+	tt.TestEqual(t, s.Base64(), ComputeHmacSha256(rfc4231Data, rfc4231Key))
+	tt.TestEqual(t, s.Verify(Sum(crypto.SHA256, []byte(rfc4231Data), []byte(rfc4231Key))), true)
+
+	s.Reset()
+	tt.TestEqual(t, s.Verify(Sum(crypto.SHA256, []byte(rfc4231Data), []byte(rfc4231Key))), false)
+}
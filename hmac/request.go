@@ -0,0 +1,307 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package hmac
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used by RequestSigner.
+const (
+	// SignatureHeader carries the algorithm, the list of signed headers and
+	// the signature itself.
+	SignatureHeader = "X-Signature"
+
+	// TimestampHeader carries the time of signing in Unix seconds.
+	TimestampHeader = "X-Signature-Timestamp"
+
+	// ContentSha256Header carries the hex encoded SHA256 of the body.
+	ContentSha256Header = "X-Content-Sha256"
+)
+
+// DefaultMaxSkew is how far a request timestamp may differ from the current
+// time when RequestSigner.MaxSkew is not set.
+const DefaultMaxSkew = 5 * time.Minute
+
+// DefaultMaxBodySize is the largest body Verify reads when
+// RequestSigner.MaxBodySize is not set.
+const DefaultMaxBodySize = 10 << 20
+
+// Errors returned by RequestSigner.Verify.
+var (
+	ErrMissingSignature   = errors.New("request is not signed")
+	ErrMalformedSignature = errors.New("malformed request signature")
+	ErrSignatureMismatch  = errors.New("request signature does not match")
+	ErrBodyHashMismatch   = errors.New("request body does not match its hash")
+	ErrTimestampSkew      = errors.New("request timestamp is outside the allowed window")
+	ErrBodyTooLarge       = errors.New("request body is too large to verify")
+)
+
+var algorithmNames = map[crypto.Hash]string{
+	crypto.SHA1:   "hmac-sha1",
+	crypto.SHA256: "hmac-sha256",
+	crypto.SHA384: "hmac-sha384",
+	crypto.SHA512: "hmac-sha512",
+}
+
+// A RequestSigner signs and verifies HTTP requests using a shared secret, such
+// as for authenticating webhooks. The signature covers the method, path,
+// sorted query parameters, the selected headers, a SHA256 of the body and the
+// time of signing.
+type RequestSigner struct {
+	// Hash is the HMAC hash function. It defaults to crypto.SHA256.
+	Hash crypto.Hash
+
+	// Secret is the shared key.
+	Secret []byte
+
+	// Headers lists the names of additional headers to sign. The special
+	// name "Host" refers to the request host.
+	Headers []string
+
+	// MaxSkew is the largest difference between the signing time and the
+	// time of verification that Verify accepts. It defaults to
+	// DefaultMaxSkew.
+	MaxSkew time.Duration
+
+	// MaxBodySize is the largest body, in bytes, that Verify reads in order
+	// to check its hash. Larger bodies fail with ErrBodyTooLarge. It
+	// defaults to DefaultMaxBodySize.
+	MaxBodySize int64
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+func (rs *RequestSigner) hash() crypto.Hash {
+	if rs.Hash == 0 {
+		return crypto.SHA256
+	}
+	return rs.Hash
+}
+
+// algorithm returns the name of the signing algorithm, or an error if the
+// hash is not supported.
+func (rs *RequestSigner) algorithm() (string, error) {
+	name, ok := algorithmNames[rs.hash()]
+	if !ok || !rs.hash().Available() {
+		return "", fmt.Errorf("unsupported hash for request signing: %v", rs.hash())
+	}
+	return name, nil
+}
+
+func (rs *RequestSigner) now() time.Time {
+	if rs.Now == nil {
+		return time.Now()
+	}
+	return rs.Now()
+}
+
+// Sign adds the signature headers to req. If req already carries a
+// ContentSha256Header, it is trusted as the hash of the body, which allows
+// large bodies to be hashed ahead of time while streaming. Otherwise the body
+// is read into memory to hash it and then replaced.
+func (rs *RequestSigner) Sign(req *http.Request) error {
+	name, err := rs.algorithm()
+	if err != nil {
+		return err
+	}
+
+	if req.Header.Get(ContentSha256Header) == "" {
+		bodyHash, err := hashBody(req, 0)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(ContentSha256Header, bodyHash)
+	}
+	req.Header.Set(TimestampHeader, strconv.FormatInt(rs.now().Unix(), 10))
+
+	headers := make([]string, len(rs.Headers))
+	for i, h := range rs.Headers {
+		headers[i] = strings.ToLower(h)
+	}
+	sort.Strings(headers)
+
+	mac := Sum(rs.hash(), []byte(CanonicalRequest(req, headers)), rs.Secret)
+	req.Header.Set(SignatureHeader, fmt.Sprintf("algorithm=%s,headers=%s,signature=%s",
+		name, strings.Join(headers, ";"), hex.EncodeToString(mac)))
+	return nil
+}
+
+// Verify checks the signature headers on req. The body is read in order to
+// check its hash, up to MaxBodySize bytes, and is replaced so that it can be
+// read again by the caller.
+func (rs *RequestSigner) Verify(req *http.Request) error {
+	name, err := rs.algorithm()
+	if err != nil {
+		return err
+	}
+	sig := req.Header.Get(SignatureHeader)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+	params := make(map[string]string, 3)
+	for _, part := range strings.Split(sig, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrMalformedSignature
+		}
+		params[kv[0]] = kv[1]
+	}
+	if params["algorithm"] != name {
+		return ErrMalformedSignature
+	}
+	mac, err := hex.DecodeString(params["signature"])
+	if err != nil || len(mac) == 0 {
+		return ErrMalformedSignature
+	}
+	var headers []string
+	if params["headers"] != "" {
+		headers = strings.Split(params["headers"], ";")
+	}
+	for _, required := range rs.Headers {
+		found := false
+		for _, h := range headers {
+			if h == strings.ToLower(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrMalformedSignature
+		}
+	}
+
+	ts, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return ErrMalformedSignature
+	}
+	maxSkew := rs.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	skew := rs.now().Sub(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return ErrTimestampSkew
+	}
+
+	if !Verify(rs.hash(), []byte(CanonicalRequest(req, headers)), rs.Secret, mac) {
+		return ErrSignatureMismatch
+	}
+
+	maxBody := rs.MaxBodySize
+	if maxBody == 0 {
+		maxBody = DefaultMaxBodySize
+	}
+	bodyHash, err := hashBody(req, maxBody)
+	if err != nil {
+		return err
+	}
+	if bodyHash != req.Header.Get(ContentSha256Header) {
+		return ErrBodyHashMismatch
+	}
+	return nil
+}
+
+// CanonicalRequest returns the string that is signed for req. The headers
+// must be lower case and sorted. Each element is on its own line: the method,
+// the escaped path, the sorted query string, one "name:value" line per
+// header, the list of header names, the timestamp and the body hash.
+func CanonicalRequest(req *http.Request, headers []string) string {
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToUpper(req.Method))
+	buf.WriteByte('\n')
+
+	p := req.URL.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	buf.WriteString(p)
+	buf.WriteByte('\n')
+
+	buf.WriteString(canonicalQuery(req.URL.Query()))
+	buf.WriteByte('\n')
+
+	for _, h := range headers {
+		var values []string
+		if h == "host" {
+			values = []string{req.Host}
+			if req.Host == "" {
+				values = []string{req.URL.Host}
+			}
+		} else {
+			values = req.Header[http.CanonicalHeaderKey(h)]
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		buf.WriteString(h)
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(trimmed, ","))
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(strings.Join(headers, ";"))
+	buf.WriteByte('\n')
+
+	buf.WriteString(req.Header.Get(TimestampHeader))
+	buf.WriteByte('\n')
+	buf.WriteString(req.Header.Get(ContentSha256Header))
+	return buf.String()
+}
+
+// canonicalQuery encodes the query parameters sorted by key and then value.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// hashBody returns the hex encoded SHA256 of the request body and replaces
+// the body so it can be read again. If max is positive, bodies longer than
+// max bytes fail with ErrBodyTooLarge.
+func hashBody(req *http.Request, max int64) (string, error) {
+	h := sha256.New()
+	if req.Body == nil {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	var r io.Reader = req.Body
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	b, err := ioutil.ReadAll(io.TeeReader(r, h))
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if max > 0 && int64(len(b)) > max {
+		return "", ErrBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package hmac
+
+import (
+	"crypto"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func newSignedRequest(t *testing.T, rs *RequestSigner, body string) *http.Request {
+	req, err := http.NewRequest("POST", "http://example.com/hooks/build?b=2&a=1&a=0", strings.NewReader(body))
+	tt.TestExpectSuccess(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	tt.TestExpectSuccess(t, rs.Sign(req))
+	return req
+}
+
+func TestRequestSignerRoundTrip(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	now := time.Unix(1470000000, 0)
+	rs := &RequestSigner{
+		Secret:  []byte("secret"),
+		Headers: []string{"Content-Type", "Host"},
+		Now:     func() time.Time { return now },
+	}
+	req := newSignedRequest(t, rs, `{"ok":true}`)
+
+	tt.TestEqual(t, req.Header.Get(TimestampHeader), "1470000000")
+	tt.TestEqual(t, strings.HasPrefix(req.Header.Get(SignatureHeader),
+		"algorithm=hmac-sha256,headers=content-type;host,signature="), true)
+
+	tt.TestExpectSuccess(t, rs.Verify(req))
+
+	// Query parameter order does not matter.
+	req.URL.RawQuery = "a=0&a=1&b=2"
+	tt.TestExpectSuccess(t, rs.Verify(req))
+
+	// The body is still readable after verification.
+	b, err := ioutil.ReadAll(req.Body)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, string(b), `{"ok":true}`)
+}
+
+func TestRequestSignerRejects(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	now := time.Unix(1470000000, 0)
+	rs := &RequestSigner{
+		Hash:    crypto.SHA512,
+		Secret:  []byte("secret"),
+		Headers: []string{"Content-Type"},
+		Now:     func() time.Time { return now },
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, rs.Verify(req), ErrMissingSignature)
+
+	req = newSignedRequest(t, rs, "body")
+	req.Body = ioutil.NopCloser(strings.NewReader("tampered"))
+	tt.TestEqual(t, rs.Verify(req), ErrBodyHashMismatch)
+
+	req = newSignedRequest(t, rs, "body")
+	req.Header.Set("Content-Type", "text/plain")
+	tt.TestEqual(t, rs.Verify(req), ErrSignatureMismatch)
+
+	req = newSignedRequest(t, rs, "body")
+	req.URL.Path = "/other"
+	tt.TestEqual(t, rs.Verify(req), ErrSignatureMismatch)
+
+	req = newSignedRequest(t, rs, "body")
+	other := &RequestSigner{Hash: crypto.SHA512, Secret: []byte("other"), Now: rs.Now}
+	tt.TestEqual(t, other.Verify(req), ErrSignatureMismatch)
+
+	req = newSignedRequest(t, rs, "body")
+	now = now.Add(DefaultMaxSkew + time.Second)
+	tt.TestEqual(t, rs.Verify(req), ErrTimestampSkew)
+	rs.MaxSkew = time.Hour
+	tt.TestExpectSuccess(t, rs.Verify(req))
+
+	// Requiring a header that was not signed fails.
+	strict := &RequestSigner{Hash: crypto.SHA512, Secret: []byte("secret"),
+		Headers: []string{"Content-Type", "X-Event"}, Now: rs.Now}
+	tt.TestEqual(t, strict.Verify(req), ErrMalformedSignature)
+}
+
+func TestRequestSignerPrecomputedBodyHash(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	rs := &RequestSigner{Secret: []byte("secret")}
+	req, err := http.NewRequest("PUT", "http://example.com/upload", strings.NewReader("abc"))
+	tt.TestExpectSuccess(t, err)
+	req.Header.Set(ContentSha256Header, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	tt.TestExpectSuccess(t, rs.Sign(req))
+	tt.TestExpectSuccess(t, rs.Verify(req))
+}
+
+func TestRequestSignerLimits(t *testing.T) {
+	testHelper := tt.StartTest(t)
+	defer testHelper.FinishTest()
+
+	rs := &RequestSigner{Secret: []byte("secret"), MaxBodySize: 4}
+	req := newSignedRequest(t, rs, "abcd")
+	tt.TestExpectSuccess(t, rs.Verify(req))
+	req = newSignedRequest(t, rs, "abcde")
+	tt.TestEqual(t, rs.Verify(req), ErrBodyTooLarge)
+
+	// Unsupported hashes are rejected rather than matching a missing
+	// algorithm.
+	bad := &RequestSigner{Hash: crypto.MD5, Secret: []byte("secret")}
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	tt.TestExpectSuccess(t, err)
+	tt.TestExpectError(t, bad.Sign(req))
+	req.Header.Set(SignatureHeader, "headers=,signature=00")
+	tt.TestExpectError(t, bad.Verify(req))
+}
@@ -0,0 +1,307 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+// Package sigv4 implements AWS Signature Version 4 signing and verification.
+// It is shared by s3util, which signs requests, and s3test, which checks them.
+package sigv4
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apcera/util/hmac"
+)
+
+// Constants used by AWS Signature Version 4.
+// Docs: http://docs.aws.amazon.com/general/latest/gr/signature-version-4.html
+const (
+	algorithm       = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	shortDateFormat = "20060102"
+
+	// UnsignedPayload may be used in place of the payload hash when the body
+	// is not known ahead of time.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// MaxPresignExpiry is the longest validity S3 accepts for a presigned URL.
+	MaxPresignExpiry = 7 * 24 * time.Hour
+
+	// maxRequestSkew is how far the time in a signed request may be from the
+	// current time.
+	maxRequestSkew = 15 * time.Minute
+)
+
+// A Signer signs and verifies requests using AWS Signature Version 4.
+type Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Service         string
+}
+
+// Sign adds the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers
+// to req, along with X-Amz-Security-Token when using temporary credentials.
+// Every header already set on the request, apart from User-Agent, is signed.
+func (v *Signer) Sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if v.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", v.SessionToken)
+	}
+	req.Header.Del("Authorization")
+
+	headers, signedHeaders := canonicalHeaders(req)
+	creq := canonicalRequest(req, req.URL.Query(), headers, signedHeaders, payloadHash)
+	scope := v.scope(t)
+	signature := v.signature(t, stringToSign(t, scope, creq))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, v.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Presign returns a URL for req which carries its signature in the query
+// string and stays valid for the given duration. Only the host header is
+// signed and the payload is left unsigned.
+func (v *Signer) Presign(req *http.Request, expires time.Duration, t time.Time) (*url.URL, error) {
+	if expires <= 0 || expires > MaxPresignExpiry {
+		return nil, fmt.Errorf("presigned URL expiry must be between 1s and %s", MaxPresignExpiry)
+	}
+	t = t.UTC()
+	scope := v.scope(t)
+
+	q := req.URL.Query()
+	q.Set("X-Amz-Algorithm", algorithm)
+	q.Set("X-Amz-Credential", v.AccessKeyID+"/"+scope)
+	q.Set("X-Amz-Date", t.Format(amzDateFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if v.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", v.SessionToken)
+	}
+
+	creq := canonicalRequest(req, q, headerBlock(req, []string{"host"}), "host", UnsignedPayload)
+	q.Set("X-Amz-Signature", v.signature(t, stringToSign(t, scope, creq)))
+
+	u := *req.URL
+	u.RawQuery = CanonicalQueryString(q)
+	return &u, nil
+}
+
+// scope returns the credential scope for the given time.
+func (v *Signer) scope(t time.Time) string {
+	return strings.Join([]string{t.Format(shortDateFormat), v.Region, v.Service, "aws4_request"}, "/")
+}
+
+// signature derives the scoped signing key and signs the string with it.
+func (v *Signer) signature(t time.Time, toSign string) string {
+	key := []byte("AWS4" + v.SecretAccessKey)
+	for _, part := range []string{t.Format(shortDateFormat), v.Region, v.Service, "aws4_request"} {
+		key = hmac.Sum(crypto.SHA256, []byte(part), key)
+	}
+	return hex.EncodeToString(hmac.Sum(crypto.SHA256, []byte(toSign), key))
+}
+
+// stringToSign builds the string that is signed from the canonical request.
+func stringToSign(t time.Time, scope, creq string) string {
+	h := sha256.Sum256([]byte(creq))
+	return strings.Join([]string{
+		algorithm,
+		t.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(h[:]),
+	}, "\n")
+}
+
+// canonicalRequest builds the canonical form of a request from its parts.
+func canonicalRequest(req *http.Request, query url.Values, headers, signedHeaders, payloadHash string) string {
+	p := req.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		URIEncode(p, false),
+		CanonicalQueryString(query),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalHeaders returns the canonical header block and the list of signed
+// header names for req.
+func canonicalHeaders(req *http.Request) (string, string) {
+	names := []string{"host"}
+	for k := range req.Header {
+		name := strings.ToLower(k)
+		if name == "user-agent" || name == "authorization" || name == "host" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return headerBlock(req, names), strings.Join(names, ";")
+}
+
+// headerBlock returns the canonical header block for the given sorted, lower
+// case header names.
+func headerBlock(req *http.Request, names []string) string {
+	var buf bytes.Buffer
+	for _, name := range names {
+		values := req.Header[http.CanonicalHeaderKey(name)]
+		if name == "host" {
+			values = []string{requestHost(req)}
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(trimmed, ","))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// CanonicalQueryString encodes the query sorted by key and then value.
+func CanonicalQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, URIEncode(k, true)+"="+URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// requestHost returns the host the request will be sent to.
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// URIEncode percent encodes everything except the unreserved characters, as
+// required by Signature Version 4. Slashes are left alone unless encodeSlash
+// is set.
+func URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// PayloadSha256 returns the hex encoded SHA256 of b.
+func PayloadSha256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// Verify checks that req carries a valid signature made with the signer's
+// credentials for its region and service, either in its Authorization header
+// or, for presigned URLs, in its query string. The payload hash named in
+// X-Amz-Content-Sha256 is covered by the signature but the body itself is not
+// read, so callers must compare it themselves.
+func (v *Signer) Verify(req *http.Request, now time.Time) error {
+	q := req.URL.Query()
+	presigned := q.Get("X-Amz-Signature") != ""
+
+	var credential, signedHeaders, signature, date, payloadHash string
+	if presigned {
+		if q.Get("X-Amz-Algorithm") != algorithm {
+			return fmt.Errorf("unsupported signing algorithm %q", q.Get("X-Amz-Algorithm"))
+		}
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		date = q.Get("X-Amz-Date")
+		payloadHash = UnsignedPayload
+		q.Del("X-Amz-Signature")
+	} else {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, algorithm+" ") {
+			return fmt.Errorf("request is not signed with %s", algorithm)
+		}
+		for _, part := range strings.Split(strings.TrimPrefix(auth, algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("malformed Authorization header")
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		date = req.Header.Get("X-Amz-Date")
+		payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return fmt.Errorf("missing X-Amz-Content-Sha256 header")
+		}
+	}
+
+	t, err := time.Parse(amzDateFormat, date)
+	if err != nil {
+		return fmt.Errorf("invalid request date %q", date)
+	}
+	if presigned {
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || expires <= 0 {
+			return fmt.Errorf("invalid presigned URL expiry")
+		}
+		if now.Before(t.Add(-maxRequestSkew)) || now.After(t.Add(time.Duration(expires)*time.Second)) {
+			return fmt.Errorf("presigned URL has expired")
+		}
+	} else if d := now.Sub(t); d > maxRequestSkew || d < -maxRequestSkew {
+		return fmt.Errorf("request time %s is too far from the current time", date)
+	}
+
+	if credential != v.AccessKeyID+"/"+v.scope(t) {
+		return fmt.Errorf("invalid credential %q", credential)
+	}
+	names := strings.Split(signedHeaders, ";")
+	if i := sort.SearchStrings(names, "host"); !sort.StringsAreSorted(names) || i == len(names) || names[i] != "host" {
+		return fmt.Errorf("signed headers must be sorted and include host")
+	}
+
+	creq := canonicalRequest(req, q, headerBlock(req, names), signedHeaders, payloadHash)
+	expected := v.signature(t, stringToSign(t, v.scope(t), creq))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
@@ -3,82 +3,119 @@
 package iprange
 
 import (
-	"bytes"
+	"container/list"
+	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"net"
 	"sync"
 )
 
-// a const from Go itself, used to represent IPv4 within an 16 byte slice
-var ipv6in4 = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
-
 // IPRangeAllocator can be used to allocate IP addresses from the provided
-// range.
+// range. Allocated and reserved addresses are tracked as spans in a balanced
+// tree, so each operation takes logarithmic time in the number of separate
+// spans, and memory grows with their number rather than with the size of the
+// range. This allows pools as large as an IPv4 /8 or an IPv6 /64.
 type IPRangeAllocator struct {
-	ipRange     *IPRange
-	size        int64
-	remaining   int64
-	reserved    map[int64]bool
-	startBig    *big.Int
-	startIsIPv4 bool
-	mutex       sync.Mutex
+	ipRange *IPRange
+	start   ipNum
+	end     ipNum
+	mutex   sync.Mutex
+
+	// size is the number of addresses in the range, unless carry is set,
+	// when the range is the whole address space of 2^128 addresses and size
+	// has wrapped around to zero.
+	size  ipNum
+	carry bool
+
+	// used holds every allocated, reserved or subtracted address, and
+	// excluded the subtracted ones.
+	used     spanTree
+	excluded spanTree
+
+	// journal, if set, records each change before it is made, and err holds
+	// the first error writing to it.
+	journal io.Writer
+	err     error
+
+	// the allocation strategy and its state; released queues free addresses
+	// in the order they were released, releasedAt finds their elements, and
+	// releasedSet holds them in address order
+	strategy    Strategy
+	cursor      ipNum
+	fresh       ipNum
+	stale       bool
+	released    *list.List
+	releasedAt  map[ipNum]*list.Element
+	releasedSet spanTree
+
+	// leases by address and by owner, and ordered by expiry; leased holds
+	// the leased addresses so that those in a span can be found in order
+	leases map[ipNum]*lease
+	leased spanTree
+	owners map[string]map[ipNum]bool
+	expiry leaseHeap
 }
 
 // NewAllocator creates a new IPRangeAllocator for the provided IPRange.
 func NewAllocator(ipr *IPRange) *IPRangeAllocator {
-	a := &IPRangeAllocator{
-		ipRange:     ipr,
-		reserved:    make(map[int64]bool),
-		startIsIPv4: bytes.Compare(ipr.Start.To16()[0:12], ipv6in4) == 0,
-	}
-
-	// calculate the size of the range
-	a.startBig = big.NewInt(0)
-	a.startBig.SetBytes(a.ipRange.Start)
-	endBig := big.NewInt(0)
-	endBig.SetBytes(a.ipRange.End)
-	sizeBig := endBig.Sub(endBig, a.startBig)
-
-	// 1 is added to the size because the end IP is inclusive
-	a.size = sizeBig.Int64() + 1
-	a.remaining = a.size
-
+	a := &IPRangeAllocator{}
+	a.init(ipr)
 	return a
 }
 
+// init sets the range and clears all allocations.
+func (a *IPRangeAllocator) init(ipr *IPRange) {
+	a.ipRange = ipr
+	a.start = ipToNum(ipr.Start)
+	a.end = ipToNum(ipr.End)
+	a.used = spanTree{}
+	a.excluded = spanTree{}
+	a.resetStrategy()
+	a.leases = make(map[ipNum]*lease)
+	a.leased = spanTree{}
+	a.owners = make(map[string]map[ipNum]bool)
+	a.expiry = nil
+
+	// the end IP is inclusive, so only a range of the whole address space
+	// has a size that wraps around to zero
+	a.size = span{a.start, a.end}.count()
+	a.carry = a.size == (ipNum{})
+}
+
 // Allocate can be used to allocate a new IP address within the provided
 // range. It will ensure that it is unique. If the allocator has no additional
-// IP addresses available, then it will return nil.
+// IP addresses available, then it will return nil. The address is chosen by
+// the allocator's Strategy.
 func (a *IPRangeAllocator) Allocate() net.IP {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	// ensure we have some IPs first
-	if a.remaining <= 0 {
+	ip, ok := a.allocate(nil)
+	if !ok {
 		return nil
 	}
+	return ip.IP()
+}
 
-	// get a random number within the size to start with
-	idx := rand.Int63n(a.size)
-
-	// find the next available index after the random number that is available
-	idx = a.findNextAvailbleIndex(idx)
-
-	// if idx is now -1, then it couldn't find one, which is very unlikely,
-	// however if that is, treat it as no more remaining and ensure remaining is
-	// now 0
-	if idx == -1 {
-		a.remaining = 0
-		return nil
+// allocate picks an address, records it with its lease, if any, and marks it
+// used.
+func (a *IPRangeAllocator) allocate(l *lease) (ipNum, bool) {
+	// ensure we have some IPs first
+	if n, carry := a.remaining(); n == (ipNum{}) && !carry || a.err != nil {
+		return ipNum{}, false
 	}
-
-	// reserve the idx, get the IP bytes
-	a.reserved[idx] = true
-	a.remaining--
-	newBig := big.NewInt(0).Add(a.startBig, big.NewInt(idx))
-
-	return a.bigIntToIP(newBig)
+	ip := a.pick()
+	if !a.record(journalUse, span{ip, ip}, l.journalArgs()) {
+		return ipNum{}, false
+	}
+	a.use(ip, ip)
+	a.picked(ip)
+	if l != nil {
+		a.setLease(ip, l)
+	}
+	return ip, true
 }
 
 // Reserve allows reserving a specific IP address within the specified range to
@@ -91,54 +128,90 @@ func (a *IPRangeAllocator) Reserve(ip net.IP) {
 	if !a.ipRange.Contains(ip) {
 		return
 	}
-
-	// calculate the idx from the start
-	ipBig := big.NewInt(0)
-	ipBig.SetBytes(ip)
-	idx := ipBig.Sub(ipBig, a.startBig).Int64()
-
-	// if it isn't already reserved, then mark it reserved and decrement the
-	// remaining count
-	if !a.reserved[idx] {
-		a.reserved[idx] = true
-		a.remaining--
+	n := ipToNum(ip)
+	if a.record(journalUse, span{n, n}, "") {
+		a.use(n, n)
 	}
 }
 
 // Release can be used to release an IP address that had previously been
-// allocated or reserved.
+// allocated, reserved or subtracted. Any lease on it ends.
 func (a *IPRangeAllocator) Release(ip net.IP) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	// calculate the idx from the start
-	ipBig := big.NewInt(0)
-	ipBig.SetBytes(ip)
-	idx := ipBig.Sub(ipBig, a.startBig).Int64()
+	// anything outside the range was never allocated
+	if ip.To16() == nil || !a.ipRange.Contains(ip) {
+		return
+	}
+	a.release(ipToNum(ip))
+}
 
-	// check if the idx is reserved
-	if a.reserved[idx] {
-		delete(a.reserved, idx)
-		a.remaining++
+// release records and makes the release of an address.
+func (a *IPRangeAllocator) release(n ipNum) bool {
+	if !a.record(journalRelease, span{n, n}, "") {
+		return false
+	}
+	a.unrecordedRelease(n)
+	return true
+}
+
+// unrecordedReleaseSpan releases a span of addresses without journaling it.
+func (a *IPRangeAllocator) unrecordedReleaseSpan(start, end ipNum) {
+	if start == end {
+		a.unrecordedRelease(start)
+		return
+	}
+	a.used.remove(start, end)
+	a.excluded.remove(start, end)
+	for _, sp := range a.leased.clip(start, end) {
+		for n := sp.start; ; n = n.next() {
+			a.dropLease(n)
+			if n == sp.end {
+				break
+			}
+		}
+	}
+}
+
+// unrecordedRelease releases an address without journaling it.
+func (a *IPRangeAllocator) unrecordedRelease(n ipNum) {
+	if _, ok := a.used.find(n); ok {
+		a.used.remove(n, n)
+		a.excluded.remove(n, n)
+		a.dropLease(n)
+		if a.strategy == StrategyLeastRecentlyReleased {
+			a.queueReleased(n)
+		}
 	}
 }
 
 // Subtract marks all of the IPs from another IPRange as reserved in the current
 // allocator.
 func (a *IPRangeAllocator) Subtract(iprange *IPRange) {
-	curBig := big.NewInt(0)
-	curBig.SetBytes(iprange.Start)
-	endBig := big.NewInt(0)
-	endBig.SetBytes(iprange.End)
-
-	for ; curBig.Cmp(endBig) < 1; curBig = curBig.Add(big.NewInt(1), curBig) {
-		ip := a.bigIntToIP(curBig)
-		if a.ipRange.Contains(ip) {
-			a.Reserve(ip)
-		}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// clip the range to our own
+	start, end := ipToNum(iprange.Start), ipToNum(iprange.End)
+	if start.cmp(a.start) < 0 {
+		start = a.start
+	}
+	if end.cmp(a.end) > 0 {
+		end = a.end
+	}
+	if start.cmp(end) <= 0 && a.record(journalExclude, span{start, end}, "") {
+		a.use(start, end)
+		a.excluded.add(start, end)
 	}
 }
 
+// use marks a span of addresses used.
+func (a *IPRangeAllocator) use(start, end ipNum) {
+	a.used.add(start, end)
+	a.unqueueReleased(start, end)
+}
+
 // IPRange returns a copy of the IPRange provided to the allocator.
 func (a *IPRangeAllocator) IPRange() *IPRange {
 	a.mutex.Lock()
@@ -152,63 +225,100 @@ func (a *IPRangeAllocator) IPRange() *IPRange {
 }
 
 // Size returns the size of the allowable IP addresses specified by the range.
+// It is capped at math.MaxInt64 for larger IPv6 ranges; SizeBig returns the
+// exact size.
 func (a *IPRangeAllocator) Size() int64 {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
-	return a.size
+	return saturate(a.size, a.carry)
+}
+
+// SizeBig returns the size of the range as a big.Int.
+func (a *IPRangeAllocator) SizeBig() *big.Int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return carryBigInt(a.size, a.carry)
 }
 
 // Remaining returns the number of remaining IP addresses within the provided
-// range that have not been already allocated.
+// range that have not been already allocated. It is capped at math.MaxInt64
+// for larger IPv6 ranges; RemainingBig returns the exact number.
 func (a *IPRangeAllocator) Remaining() int64 {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
-	return a.remaining
+	return saturate(a.remaining())
 }
 
-// findNextAvailableIndex finds the value of idx which is available and not in
-// the reserved list.
-func (a *IPRangeAllocator) findNextAvailbleIndex(idx int64) int64 {
-	// walk up from the index
-	for i := idx; i < a.size; i++ {
-		if !a.reserved[i] {
-			return i
-		}
+// RemainingBig returns the number of remaining IP addresses as a big.Int.
+func (a *IPRangeAllocator) RemainingBig() *big.Int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return carryBigInt(a.remaining())
+}
+
+// remaining returns the number of free addresses, with carry set if that is
+// all 2^128 addresses of the whole address space.
+func (a *IPRangeAllocator) remaining() (n ipNum, carry bool) {
+	// the total of used addresses only wraps around to zero once the whole
+	// address space is used, so the difference is right either way
+	if a.carry && a.used.spans == 0 {
+		return ipNum{}, true
 	}
+	return a.size.minus(a.used.total), false
+}
 
-	// nothing above that one... lets try to walk down to find something
-	for i := idx - 1; i >= 0; i-- {
-		if !a.reserved[i] {
-			return i
-		}
+// nextAvailable returns the first available address at or after n, wrapping
+// around to the start of the range. There must be an available address.
+func (a *IPRangeAllocator) nextAvailable(n ipNum) ipNum {
+	// spans are never adjacent, so the address after a used span is free
+	// unless it is past the end of the range
+	sp, ok := a.used.find(n)
+	if !ok {
+		return n
+	}
+	if sp.end.cmp(a.end) < 0 {
+		return sp.end.next()
 	}
+	if sp, ok := a.used.find(a.start); ok {
+		return sp.end.next()
+	}
+	return a.start
+}
 
-	// ok, everything is probably taken
-	return -1
-}
-
-func (a *IPRangeAllocator) bigIntToIP(newBig *big.Int) net.IP {
-	// Convert it back into a 16 byte slice. net.IP expects a 16 byte
-	// slice, and expects the elements to be not be the leading bytes
-	// but the trailing. So we must create a new slice and populate its
-	// tail.
-	buf := newBig.Bytes()
-	ipbytes := make([]byte, 16)
-	position := 16 - len(buf)
-
-	// If the position we need to copy to is less than 0, then this
-	// would cause an index out of range. This will only happen when
-	// we've max'd out 16 bytes, so then we'll just loop around to zero.
-	if position >= 0 {
-		if a.startIsIPv4 {
-			// copy only the last 4 bytes and ensure we set the IPv4 in v6 prefix
-			copy(ipbytes, ipv6in4)
-			copy(ipbytes[12:], buf[len(buf)-4:])
-		} else {
-			// copy into the 16 byte slice, as it is IPv6
-			copy(ipbytes[16-len(buf):], buf)
-		}
+// randomBelow returns a random number in [0, n), where an n of zero stands
+// for 2^128.
+func randomBelow(n ipNum) ipNum {
+	if n.hi == 0 && n.lo != 0 && n.lo <= math.MaxInt64 {
+		return ipNum{0, uint64(rand.Int63n(int64(n.lo)))}
+	}
+	// the bias of reducing 128 random bits is negligible for ranges this big
+	var b [16]byte
+	rand.Read(b[:])
+	if n == (ipNum{}) {
+		return ipToNum(net.IP(b[:]))
 	}
+	r := new(big.Int).SetBytes(b[:])
+	r.Mod(r, n.bigInt())
+	b = [16]byte{}
+	buf := r.Bytes()
+	copy(b[16-len(buf):], buf)
+	return ipToNum(net.IP(b[:]))
+}
 
-	return net.IP(ipbytes)
+// saturate returns n, plus 2^128 if carry is set, as an int64, capped at
+// math.MaxInt64.
+func saturate(n ipNum, carry bool) int64 {
+	if carry || n.hi != 0 || n.lo > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(n.lo)
+}
+
+// carryBigInt returns n, plus 2^128 if carry is set, as a big.Int.
+func carryBigInt(n ipNum, carry bool) *big.Int {
+	b := n.bigInt()
+	if carry {
+		b.SetBit(b, 128, 1)
+	}
+	return b
 }
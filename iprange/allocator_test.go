@@ -4,6 +4,7 @@ package iprange
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"testing"
 
@@ -15,15 +16,15 @@ func TestNewAllocator(t *testing.T) {
 	tt.TestExpectSuccess(t, err)
 
 	alloc := NewAllocator(ipr)
-	tt.TestEqual(t, alloc.size, int64(10))
-	tt.TestEqual(t, alloc.remaining, int64(10))
+	tt.TestEqual(t, alloc.Size(), int64(10))
+	tt.TestEqual(t, alloc.Remaining(), int64(10))
 }
 
 func TestAllocateSingleIPRange(t *testing.T) {
 	ipr, err := ParseIPRange("192.168.1.10")
 	tt.TestExpectSuccess(t, err)
 	alloc := NewAllocator(ipr)
-	tt.TestEqual(t, alloc.size, int64(1))
+	tt.TestEqual(t, alloc.Size(), int64(1))
 	tt.TestEqual(t, alloc.Remaining(), int64(1))
 
 	// get the first one
@@ -74,8 +75,8 @@ func TestReserve(t *testing.T) {
 	// reserve an IP
 	reservedIP := net.ParseIP("192.168.1.11")
 	alloc.Reserve(reservedIP)
-	tt.TestEqual(t, alloc.remaining, int64(9))
-	tt.TestEqual(t, len(alloc.reserved), 1)
+	tt.TestEqual(t, alloc.Remaining(), int64(9))
+	tt.TestEqual(t, alloc.used.spans, 1)
 
 	// consume everything and ensure we don't get that IP
 	for {
@@ -97,15 +98,15 @@ func TestReserveOutOfRange(t *testing.T) {
 	// reserve an IP
 	reservedIP := net.ParseIP("10.0.0.1")
 	alloc.Reserve(reservedIP)
-	tt.TestEqual(t, alloc.remaining, int64(10))
-	tt.TestEqual(t, len(alloc.reserved), 0)
+	tt.TestEqual(t, alloc.Remaining(), int64(10))
+	tt.TestEqual(t, alloc.used.spans, 0)
 }
 
 func TestSubtract(t *testing.T) {
 	ipr, err := ParseIPRange("192.168.1.10-19")
 	tt.TestExpectSuccess(t, err)
 	alloc := NewAllocator(ipr)
-	tt.TestEqual(t, alloc.remaining, int64(10))
+	tt.TestEqual(t, alloc.Remaining(), int64(10))
 
 	// create a smaller range within the same one
 	ipr2, err := ParseIPRange("192.168.1.10-14")
@@ -115,8 +116,8 @@ func TestSubtract(t *testing.T) {
 	alloc.Subtract(ipr2)
 
 	// validate it
-	tt.TestEqual(t, alloc.remaining, int64(5))
-	tt.TestEqual(t, len(alloc.reserved), 5)
+	tt.TestEqual(t, alloc.Remaining(), int64(5))
+	tt.TestEqual(t, alloc.used.spans, 1)
 
 	// consume everything and ensure we don't get an IP in the second range.
 	for {
@@ -137,7 +138,7 @@ func TestRelease(t *testing.T) {
 
 	// test releasing when empty
 	alloc.Release(net.ParseIP("192.168.1.11"))
-	tt.TestEqual(t, alloc.remaining, int64(10))
+	tt.TestEqual(t, alloc.Remaining(), int64(10))
 
 	// consume everything
 	for {
@@ -149,11 +150,98 @@ func TestRelease(t *testing.T) {
 	}
 
 	// release an IP
-	tt.TestEqual(t, alloc.remaining, int64(0))
+	tt.TestEqual(t, alloc.Remaining(), int64(0))
 	alloc.Release(net.ParseIP("192.168.1.11"))
-	tt.TestEqual(t, alloc.remaining, int64(1))
+	tt.TestEqual(t, alloc.Remaining(), int64(1))
 
 	// allocate one more and should get that one
 	tt.TestEqual(t, alloc.Allocate().String(), "192.168.1.11")
-	tt.TestEqual(t, alloc.remaining, int64(0))
+	tt.TestEqual(t, alloc.Remaining(), int64(0))
+}
+
+func TestAllocatorLargeRanges(t *testing.T) {
+	// an IPv4 /8
+	ipr, err := ParseIPRange("10.0.0.0-10.255.255.255/8")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	tt.TestEqual(t, alloc.Size(), int64(1<<24))
+
+	// subtracting most of it is a single span, not millions of reservations
+	sub, err := ParseIPRange("10.0.0.0-10.254.255.255")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(sub)
+	tt.TestEqual(t, alloc.Remaining(), int64(1<<16))
+	tt.TestEqual(t, alloc.used.spans, 1)
+	for i := 0; i < 1000; i++ {
+		ip := alloc.Allocate()
+		tt.TestEqual(t, ip.To4()[1], byte(255))
+	}
+	tt.TestEqual(t, alloc.Remaining(), int64(1<<16-1000))
+
+	// an IPv6 /64 is too large for an int64
+	ipr, err = ParseIPRange("2001:db8::-2001:db8::ffff:ffff:ffff:ffff/64")
+	tt.TestExpectSuccess(t, err)
+	alloc = NewAllocator(ipr)
+	tt.TestEqual(t, alloc.Size(), int64(math.MaxInt64))
+	tt.TestEqual(t, alloc.SizeBig().String(), "18446744073709551616")
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		ip := alloc.Allocate()
+		tt.TestEqual(t, ipr.Contains(ip), true)
+		tt.TestEqual(t, seen[ip.String()], false)
+		seen[ip.String()] = true
+	}
+	tt.TestEqual(t, alloc.RemainingBig().String(), "18446744073709550616")
+
+	// clipped to the range, and the remaining addresses are found
+	all, err := ParseIPRange("2001:db7::-2001:db9::")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(all)
+	tt.TestEqual(t, alloc.Remaining(), int64(0))
+	tt.TestEqual(t, alloc.Allocate(), nil)
+	alloc.Release(net.ParseIP("2001:db8::ffff:ffff:ffff:ffff"))
+	tt.TestEqual(t, alloc.Allocate().String(), "2001:db8::ffff:ffff:ffff:ffff")
+}
+
+func TestAllocatorWholeAddressSpace(t *testing.T) {
+	ipr, err := ParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/0")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	tt.TestEqual(t, alloc.SizeBig().String(), "340282366920938463463374607431768211456")
+	tt.TestEqual(t, alloc.RemainingBig().String(), "340282366920938463463374607431768211456")
+	tt.TestEqual(t, alloc.Remaining(), int64(math.MaxInt64))
+	tt.TestEqual(t, ipr.Contains(alloc.Allocate()), true)
+	tt.TestEqual(t, alloc.RemainingBig().String(), "340282366920938463463374607431768211455")
+
+	// the last free address can still be allocated
+	sub, err := ParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(sub)
+	tt.TestEqual(t, alloc.Remaining(), int64(1))
+	tt.TestEqual(t, alloc.Allocate().String(), "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	tt.TestEqual(t, alloc.Remaining(), int64(0))
+	tt.TestEqual(t, alloc.Allocate(), nil)
+
+	alloc.Release(net.ParseIP("::1"))
+	tt.TestEqual(t, alloc.Remaining(), int64(1))
+	tt.TestEqual(t, alloc.Allocate().String(), "::1")
+}
+
+func TestAllocatorFragmented(t *testing.T) {
+	ipr, err := ParseIPRange("192.168.0.0-192.168.3.255")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+
+	// reserve every other address, then allocate the rest
+	for i := 0; i < 1024; i += 2 {
+		alloc.Reserve(net.IPv4(192, 168, byte(i/256), byte(i%256)))
+	}
+	tt.TestEqual(t, alloc.used.spans, 512)
+	for alloc.Remaining() > 0 {
+		ip := alloc.Allocate().To4()
+		tt.TestEqual(t, ip[3]%2, byte(1))
+	}
+	// the spans have all merged
+	tt.TestEqual(t, alloc.used.spans, 1)
+	tt.TestEqual(t, alloc.Allocate(), nil)
 }
@@ -0,0 +1,95 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"net"
+)
+
+// AllocateBlock allocates the lowest free, aligned block of addresses with
+// the given mask, such as a /28 out of a /24, for delegating a subnet. The
+// mask's family must match the range's. It returns nil if no such block is
+// free.
+func (a *IPRangeAllocator) AllocateBlock(mask net.IPMask) *net.IPNet {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	k, ok := a.blockBits(mask)
+	if !ok || a.err != nil {
+		return nil
+	}
+	start, ok := a.freeBlock(k)
+	if !ok || !a.record(journalUse, span{start, blockEnd(start, k)}, "") {
+		return nil
+	}
+	a.use(start, blockEnd(start, k))
+	ip := start.IP()
+	if start.isIPv4() {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: mask}
+}
+
+// ReleaseBlock releases every address in a block, such as one returned by
+// AllocateBlock, that is within the range.
+func (a *IPRangeAllocator) ReleaseBlock(n *net.IPNet) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ipr := NewIPRangeFromIPNet(n)
+	start, end := ipToNum(ipr.Start), ipToNum(ipr.End)
+	if start.cmp(a.start) < 0 {
+		start = a.start
+	}
+	if end.cmp(a.end) > 0 {
+		end = a.end
+	}
+	if start.cmp(end) <= 0 && a.record(journalRelease, span{start, end}, "") {
+		a.unrecordedReleaseSpan(start, end)
+	}
+}
+
+// blockBits returns the number of host bits in a mask of the range's family.
+func (a *IPRangeAllocator) blockBits(mask net.IPMask) (uint, bool) {
+	ones, bits := mask.Size()
+	switch {
+	case bits == 8*net.IPv4len && a.start.isIPv4() && a.end.isIPv4():
+		return uint(bits - ones), true
+	case bits == 8*net.IPv6len && !a.start.isIPv4():
+		return uint(bits - ones), true
+	}
+	return 0, false
+}
+
+// freeBlock returns the start of the lowest free, aligned block of 2^k
+// addresses.
+func (a *IPRangeAllocator) freeBlock(k uint) (ipNum, bool) {
+	cur := a.start
+	for {
+		// skip past the used span containing cur, if any
+		if sp, ok := a.used.find(cur); ok {
+			if sp.end.cmp(a.end) >= 0 {
+				return ipNum{}, false
+			}
+			cur = sp.end.next()
+		}
+
+		// the free gap runs to the next used span or the end of the range
+		gapEnd := a.end
+		if sp, ok := a.used.ceil(cur); ok {
+			gapEnd = sp.start.prev()
+		}
+		start := blockStart(cur, k)
+		if start != cur {
+			start = blockEnd(cur, k).next()
+		}
+		// the aligned start may wrap past the highest address
+		if start.cmp(cur) >= 0 && start.cmp(gapEnd) <= 0 && blockEnd(start, k).cmp(gapEnd) <= 0 {
+			return start, true
+		}
+		if gapEnd.cmp(a.end) >= 0 {
+			return ipNum{}, false
+		}
+		cur = gapEnd.next()
+	}
+}
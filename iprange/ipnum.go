@@ -0,0 +1,115 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"encoding/binary"
+	"math/big"
+	"net"
+)
+
+// ipNum is an IP address as a 128 bit number, with IPv4 addresses in their
+// IPv4-mapped IPv6 form. It allows cheap arithmetic on addresses of either
+// family without allocating.
+type ipNum struct {
+	hi, lo uint64
+}
+
+// maxIPNum is the highest IPv6 address.
+var maxIPNum = ipNum{^uint64(0), ^uint64(0)}
+
+// ipToNum converts ip, which must be a valid 4 or 16 byte IP, to an ipNum.
+func ipToNum(ip net.IP) ipNum {
+	ip = ip.To16()
+	return ipNum{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+// IP returns n as a 16 byte net.IP.
+func (n ipNum) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], n.hi)
+	binary.BigEndian.PutUint64(ip[8:], n.lo)
+	return ip
+}
+
+// cmp returns -1, 0 or 1 as n is less than, equal to or greater than o.
+func (n ipNum) cmp(o ipNum) int {
+	switch {
+	case n.hi < o.hi || n.hi == o.hi && n.lo < o.lo:
+		return -1
+	case n == o:
+		return 0
+	}
+	return 1
+}
+
+// add returns n+d, wrapping around past the highest address.
+func (n ipNum) add(d uint64) ipNum {
+	lo := n.lo + d
+	hi := n.hi
+	if lo < n.lo {
+		hi++
+	}
+	return ipNum{hi, lo}
+}
+
+// plus returns n+o, wrapping around past the highest address.
+func (n ipNum) plus(o ipNum) ipNum {
+	lo := n.lo + o.lo
+	hi := n.hi + o.hi
+	if lo < n.lo {
+		hi++
+	}
+	return ipNum{hi, lo}
+}
+
+// minus returns n-o, wrapping around below zero.
+func (n ipNum) minus(o ipNum) ipNum {
+	hi := n.hi - o.hi
+	if n.lo < o.lo {
+		hi--
+	}
+	return ipNum{hi, n.lo - o.lo}
+}
+
+// next returns the address after n.
+func (n ipNum) next() ipNum {
+	return n.add(1)
+}
+
+// prev returns the address before n, wrapping around below zero.
+func (n ipNum) prev() ipNum {
+	hi := n.hi
+	if n.lo == 0 {
+		hi--
+	}
+	return ipNum{hi, n.lo - 1}
+}
+
+// trailingZeros returns the number of trailing zero bits in n, which is 128
+// for zero.
+func (n ipNum) trailingZeros() uint {
+	var z uint
+	for v := n.lo; z < 64 && v&1 == 0; v >>= 1 {
+		z++
+	}
+	if z < 64 {
+		return z
+	}
+	for v := n.hi; z < 128 && v&1 == 0; v >>= 1 {
+		z++
+	}
+	return z
+}
+
+// isIPv4 returns whether n is an IPv4-mapped address.
+func (n ipNum) isIPv4() bool {
+	return n.hi == 0 && n.lo>>32 == 0xffff
+}
+
+// bigInt returns n as a big.Int.
+func (n ipNum) bigInt() *big.Int {
+	b := new(big.Int).SetUint64(n.hi)
+	b.Lsh(b, 64)
+	return b.Or(b, new(big.Int).SetUint64(n.lo))
+}
@@ -25,7 +25,9 @@ type IPRange struct {
 // "192.168.1.1-100", to specify a range of IPs from 192.168.1.1 to
 // 192.168.1.100. The string can also contain a network mask, such as
 // "192.168.1.1-100/24". Strings can span over multiple octets, such as
-// "192.168.1.1-2.1", and a range can also be just a single IP. An error will be
+// "192.168.1.1-2.1", and a range can also be just a single IP. IPv6 ranges work
+// the same way, with the end spliced onto the start by hextets, such as
+// "2001:db8::10-ff/64" for 2001:db8::10 to 2001:db8::ff. An error will be
 // returned if it fails to parse the IPs, if the end IP isn't after the start
 // IP, and if a network mask is given, it will error if the mask is in valid, or
 // the range does not fall within the bounds of the provided mask.
@@ -33,17 +35,18 @@ func ParseIPRange(s string) (*IPRange, error) {
 	ipr := &IPRange{}
 
 	// check if the string contains a network mask
+	maskBits := -1
 	if strings.Contains(s, "/") {
 		p := strings.Split(s, "/")
 		if len(p) != 2 {
 			return nil, fmt.Errorf("expected only one '/' within the provided string")
 		}
 		s = p[0]
-		maskBits, err := strconv.Atoi(p[1])
+		var err error
+		maskBits, err = strconv.Atoi(p[1])
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse the network mask: %v", err)
 		}
-		ipr.Mask = net.CIDRMask(maskBits, 32)
 	}
 
 	// parse out the dash between the start-end IP portions
@@ -52,14 +55,32 @@ func ParseIPRange(s string) (*IPRange, error) {
 		return nil, fmt.Errorf("unexpected number of IPs specified in the provided string")
 	}
 	ipr.Start = net.ParseIP(ips[0])
+	if ipr.Start == nil {
+		return nil, fmt.Errorf("failed to parse the IP address %q", ips[0])
+	}
 	if len(ips) > 1 {
 		ipr.End = net.ParseIP(spliceIP(ips[0], ips[1]))
+		if ipr.End == nil {
+			return nil, fmt.Errorf("failed to parse the IP address %q", ips[1])
+		}
 	} else {
 		ipr.End = ipr.Start
 	}
 
+	// the mask is sized for the family the start was written in
+	if maskBits >= 0 {
+		bits := 8 * net.IPv4len
+		if isIPv6String(ips[0]) {
+			bits = 8 * net.IPv6len
+		}
+		ipr.Mask = net.CIDRMask(maskBits, bits)
+		if ipr.Mask == nil {
+			return nil, fmt.Errorf("the network mask /%d is not valid for the provided IPs", maskBits)
+		}
+	}
+
 	// ensure the end is after the start
-	if bytes.Compare([]byte(ipr.End), []byte(ipr.Start)) < 0 {
+	if compareIP(ipr.End, ipr.Start) < 0 {
 		return nil, fmt.Errorf("the end of the range cannot be less than the start of the range")
 	}
 
@@ -77,15 +98,46 @@ func ParseIPRange(s string) (*IPRange, error) {
 	return ipr, nil
 }
 
+// NewIPRangeFromIPNet returns the IPRange covering every address in the
+// network, with the network's mask.
+func NewIPRangeFromIPNet(n *net.IPNet) *IPRange {
+	start := n.IP.Mask(n.Mask)
+	end := make(net.IP, len(start))
+	for i := range start {
+		end[i] = start[i] | ^n.Mask[len(n.Mask)-len(start)+i]
+	}
+	return &IPRange{Start: start, End: end, Mask: n.Mask}
+}
+
+// String returns the range in the form accepted by ParseIPRange, with the end
+// written in full, such as "192.168.1.1-192.168.1.100/24".
+func (ipr *IPRange) String() string {
+	s := ipr.Start.String()
+	if !ipr.End.Equal(ipr.Start) {
+		s += "-" + ipr.End.String()
+	}
+	if len(ipr.Mask) > 0 {
+		ones, _ := ipr.Mask.Size()
+		s += "/" + strconv.Itoa(ones)
+	}
+	return s
+}
+
+// CIDRs returns the minimal list of CIDR blocks covering exactly the range, in
+// order. IPv4 ranges give IPv4 blocks.
+func (ipr *IPRange) CIDRs() []*net.IPNet {
+	return span{ipToNum(ipr.Start), ipToNum(ipr.End)}.cidrs()
+}
+
 // Contains returns whether or not the given IP address is within the specified
-// IPRange.
+// IPRange. IPv4 addresses match whether they are given in 4 or 16 byte form.
 func (ipr *IPRange) Contains(ip net.IP) bool {
 	// if ip is less than start, return false
-	if bytes.Compare([]byte(ip), []byte(ipr.Start)) < 0 {
+	if compareIP(ip, ipr.Start) < 0 {
 		return false
 	}
 	// return true if ip is less than or equal to end
-	return bytes.Compare([]byte(ip), []byte(ipr.End)) <= 0
+	return compareIP(ip, ipr.End) <= 0
 }
 
 // Overlaps checks whether another IPRange instance has an overlap in IPs with
@@ -94,83 +146,83 @@ func (ipr *IPRange) Contains(ip net.IP) bool {
 func (ipr *IPRange) Overlaps(o *IPRange) bool {
 	// if the start of o is less than our start, we need to make sure the end of o
 	// is less than our start
-	if bytes.Compare([]byte(o.Start), []byte(ipr.Start)) < 0 {
-		return bytes.Compare([]byte(o.End), []byte(ipr.Start)) >= 0
+	if compareIP(o.Start, ipr.Start) < 0 {
+		return compareIP(o.End, ipr.Start) >= 0
 	}
 	// if the start of o is greater than our end, then no overlap
-	if bytes.Compare([]byte(o.Start), []byte(ipr.End)) > 0 {
+	if compareIP(o.Start, ipr.End) > 0 {
 		return false
 	}
 	// otherwise, their start is within our range, and thus there is overlap
 	return true
 }
 
-// FIXME this only handles IPv4 at the moment
+// compareIP compares two IPs in their 16 byte form, so that an IPv4 address
+// given in 4 byte form is equal to its IPv4-mapped IPv6 form.
+func compareIP(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// isIPv6String returns whether an address is written in IPv6 notation, which
+// includes IPv4-mapped addresses such as "::ffff:10.0.0.1".
+func isIPv6String(s string) bool {
+	return strings.Contains(s, ":")
+}
+
+// spliceIP replaces the trailing parts of baseIP with partialIP, splitting on
+// octets for IPv4 and on hextets for IPv6, where a trailing dotted IPv4 part
+// counts as two hextets. It returns an empty string if the partial IP has more
+// parts than an address. A partial IPv6 address that uses "::" is taken to be
+// a full address.
 func spliceIP(baseIP, partialIP string) string {
-	baseParts := strings.Split(baseIP, ".")
-	partialParts := strings.Split(partialIP, ".")
-	finalParts := append(baseParts[:(len(baseParts)-len(partialParts))], partialParts...)
-	return strings.Join(finalParts, ".")
+	if !isIPv6String(baseIP) {
+		baseParts := strings.Split(baseIP, ".")
+		partialParts := strings.Split(partialIP, ".")
+		if len(partialParts) > len(baseParts) {
+			return ""
+		}
+		finalParts := append(baseParts[:(len(baseParts)-len(partialParts))], partialParts...)
+		return strings.Join(finalParts, ".")
+	}
+
+	if strings.Contains(partialIP, "::") {
+		return partialIP
+	}
+	base := net.ParseIP(baseIP)
+	partialParts := strings.Split(partialIP, ":")
+	hextets := len(partialParts)
+	if strings.Contains(partialIP, ".") {
+		hextets++
+	}
+	if base == nil || hextets > net.IPv6len/2 {
+		return ""
+	}
+	// expand the start, which may itself use "::", into all eight hextets
+	baseParts := make([]string, net.IPv6len/2)
+	for i := range baseParts {
+		baseParts[i] = strconv.FormatUint(uint64(base[2*i])<<8|uint64(base[2*i+1]), 16)
+	}
+	finalParts := append(baseParts[:(len(baseParts)-hextets)], partialParts...)
+	return strings.Join(finalParts, ":")
 }
 
 // function takes two subnets (CIDR blocks)as input and determines if they overlap.
 // this differs from the above Overlaps() in that we only specify subnets
 // and not ranges; for example: 10.0.0.0/16 and 10.0.0.0/8 are subnets and they
-// overlap. See TestIPRangeOverlappingSubnets for more examples.
-// NOTE/TODO: only supports IPv4
+// overlap. See TestIPRangeOverlappingSubnets for more examples. Either subnet
+// may be IPv4 or IPv6, and an IPv4 subnet overlaps the IPv4-mapped IPv6 subnet
+// covering the same addresses.
 func OverlappingSubnets(snet1, snet2 string) (bool, error) {
-	net1r := &IPRange{}
-	net2r := &IPRange{}
-
 	_, net1, err := net.ParseCIDR(snet1)
 	if err != nil {
 		return true, fmt.Errorf("failed to parse the subnet %v: %v", snet1, err)
 	}
-	net1r.Mask = net1.Mask
-	net1r.Start = net1.IP
-
 	_, net2, err := net.ParseCIDR(snet2)
 	if err != nil {
 		return true, fmt.Errorf("failed to parse the subnet %v: %v", snet2, err)
 	}
-	net2r.Mask = net2.Mask
-	net2r.Start = net2.IP
-
-	// determine net1.End
-	var tMaskInt uint32
-	onebits, _ := net1r.Mask.Size()
-	if (32 - onebits) == 0 {
-		tMaskInt = 0xFFFFFFFF
-	} else {
-		tMaskInt = (1 << uint32(32-onebits)) - 1
-	}
-	net1r.End = make([]byte, 4)
-	// var tMaskByte [4]byte
-	net1r.End[3] = byte(tMaskInt) | net1r.Start[3]
-	net1r.End[2] = byte(tMaskInt>>8) | net1r.Start[2]
-	net1r.End[1] = byte(tMaskInt>>16) | net1r.Start[1]
-	net1r.End[0] = byte(tMaskInt>>24) | net1r.Start[0]
-	// fmt.Printf("subnet1: start:%v mask: %v end: %v \n", net1r.Start, net1r.Mask, net1r.End)
-
-	// determine net2.End
-	onebits, _ = net2r.Mask.Size()
-	if (32 - onebits) == 0 {
-		tMaskInt = 0
-	} else {
-		tMaskInt = (1 << uint32(32-onebits)) - 1
-	}
-	net2r.End = make([]byte, 4)
-	net2r.End[3] = byte(tMaskInt) | net2r.Start[3]
-	net2r.End[2] = byte(tMaskInt>>8) | net2r.Start[2]
-	net2r.End[1] = byte(tMaskInt>>16) | net2r.Start[1]
-	net2r.End[0] = byte(tMaskInt>>24) | net2r.Start[0]
-	// fmt.Printf("subnet2: start:%v mask: %v end: %v \n", net2r.Start, net2r.Mask, net2r.End)
 
-	if net1.Contains(net2r.End) || net1.Contains(net2r.Start) {
-		return true, nil
-	}
-	if net2.Contains(net1r.End) || net2.Contains(net1r.Start) {
-		return true, nil
-	}
-	return false, nil
+	// two CIDR blocks are either disjoint or one is within the other, so they
+	// overlap exactly when one contains the other's network address
+	return net1.Contains(net2.IP) || net2.Contains(net1.IP), nil
 }
@@ -239,3 +239,118 @@ func TestIPRangeOverlappingSubnetsInvalids(t *testing.T) {
 	tt.TestEqual(t, err.Error(), "failed to parse the subnet 256.0.1.0/6: invalid CIDR address: 256.0.1.0/6")
 
 }
+
+func TestIPRangeParseBasicStringIPv6(t *testing.T) {
+	// 2001:db8::10-2001:db8::ff
+	ipr, err := ParseIPRange("2001:db8::10-2001:db8::ff")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.Start.String(), "2001:db8::10")
+	tt.TestEqual(t, ipr.End.String(), "2001:db8::ff")
+
+	// 2001:db8::10-ff/64
+	ipr, err = ParseIPRange("2001:db8::10-ff/64")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.End.String(), "2001:db8::ff")
+	oneBits, bits := ipr.Mask.Size()
+	tt.TestEqual(t, oneBits, 64)
+	tt.TestEqual(t, bits, 128)
+
+	// 2001:db8::1:10-2:0 splices across hextets
+	ipr, err = ParseIPRange("2001:db8::1:10-2:0")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.End.String(), "2001:db8::2:0")
+
+	// an end using "::" is a full address
+	ipr, err = ParseIPRange("2001:db8:0:1::-2001:db8:0:1::ffff/63")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.End.String(), "2001:db8:0:1::ffff")
+	_, err = ParseIPRange("2001:db8:0:1::-2001:db8:0:2::/63")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), "the provided IP ranges are not within the provided network mask")
+
+	// a mapped IPv4 range takes an IPv6 mask
+	ipr, err = ParseIPRange("::ffff:10.0.0.1-ff/120")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.End.String(), "10.0.0.255")
+	ipr, err = ParseIPRange("::ffff:10.0.0.1-10.0.1.5")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr.End.String(), "10.0.1.5")
+
+	//
+	// errors
+	//
+
+	_, err = ParseIPRange("2001:db8::ff-10")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), "the end of the range cannot be less than the start of the range")
+
+	_, err = ParseIPRange("2001:db8::1/129")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), "the network mask /129 is not valid for the provided IPs")
+
+	_, err = ParseIPRange("10.0.0.1/33")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), "the network mask /33 is not valid for the provided IPs")
+
+	_, err = ParseIPRange("10.0.0.1-2001:db8::1")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), `failed to parse the IP address "2001:db8::1"`)
+
+	_, err = ParseIPRange("10.0.0.1-::5")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), `failed to parse the IP address "::5"`)
+
+	_, err = ParseIPRange("2001:db8::1-1:2:3:4:5:6:7:8:9")
+	tt.TestExpectError(t, err)
+
+	_, err = ParseIPRange("192.168.1.1-1.2.3.4.5")
+	tt.TestExpectError(t, err)
+
+	_, err = ParseIPRange("bogus")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), `failed to parse the IP address "bogus"`)
+}
+
+func TestIPRangeContainsMixed(t *testing.T) {
+	ipr, err := ParseIPRange("192.168.1.10-50")
+	tt.TestExpectSuccess(t, err)
+
+	// 4 byte and IPv4-mapped 16 byte forms are the same address
+	tt.TestEqual(t, ipr.Contains(net.ParseIP("192.168.1.20").To4()), true)
+	tt.TestEqual(t, ipr.Contains(net.ParseIP("::ffff:192.168.1.20")), true)
+	tt.TestEqual(t, ipr.Contains(net.ParseIP("192.168.1.51").To4()), false)
+	tt.TestEqual(t, ipr.Contains(net.ParseIP("2001:db8::1")), false)
+	tt.TestEqual(t, ipr.Contains(net.ParseIP("::c0a8:114")), false)
+
+	ipr6, err := ParseIPRange("2001:db8::10-ff")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, ipr6.Contains(net.ParseIP("2001:db8::80")), true)
+	tt.TestEqual(t, ipr6.Contains(net.ParseIP("2001:db8::100")), false)
+	tt.TestEqual(t, ipr6.Contains(net.ParseIP("192.168.1.20")), false)
+
+	// a range written with 4 byte IPs overlaps its mapped form
+	mapped, err := ParseIPRange("::ffff:192.168.1.40-ffff:c0a8:0164")
+	tt.TestExpectSuccess(t, err)
+	short := &IPRange{Start: net.ParseIP("192.168.1.1").To4(), End: net.ParseIP("192.168.1.45").To4()}
+	tt.TestEqual(t, short.Overlaps(mapped), true)
+	tt.TestEqual(t, mapped.Overlaps(short), true)
+	tt.TestEqual(t, ipr6.Overlaps(short), false)
+}
+
+func TestIPRangeOverlappingSubnetsIPv6(t *testing.T) {
+	val, err := OverlappingSubnets("2001:db8::/32", "2001:db8:1::/48")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, val, true)
+
+	val, err = OverlappingSubnets("2001:db8::/48", "2001:db8:1::/48")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, val, false)
+
+	val, err = OverlappingSubnets("10.0.0.0/8", "::ffff:10.1.0.0/112")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, val, true)
+
+	val, err = OverlappingSubnets("10.0.0.0/8", "2001:db8::/32")
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, val, false)
+}
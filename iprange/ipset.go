@@ -0,0 +1,281 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// IPSet is a set of IP addresses, held as a sorted list of disjoint ranges.
+// IPv4 and IPv6 addresses may be mixed; an IPv4 address is the same member
+// as its IPv4-mapped IPv6 form. Sets are immutable, so the algebra methods
+// return new sets and a set may be shared between goroutines.
+type IPSet struct {
+	spans []span
+}
+
+// span is an inclusive range of addresses.
+type span struct {
+	start, end ipNum
+}
+
+// bySpanStart sorts spans by their start.
+type bySpanStart []span
+
+func (a bySpanStart) Len() int           { return len(a) }
+func (a bySpanStart) Less(i, j int) bool { return a[i].start.cmp(a[j].start) < 0 }
+func (a bySpanStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// NewIPSet returns the set of addresses in any of the given ranges. The
+// ranges' masks are ignored.
+func NewIPSet(ranges ...*IPRange) *IPSet {
+	spans := make([]span, 0, len(ranges))
+	for _, ipr := range ranges {
+		spans = append(spans, span{ipToNum(ipr.Start), ipToNum(ipr.End)})
+	}
+	return newIPSet(spans)
+}
+
+// newIPSet sorts spans and merges those that overlap or touch.
+func newIPSet(spans []span) *IPSet {
+	sort.Sort(bySpanStart(spans))
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.end == maxIPNum || s.start.cmp(last.end.next()) <= 0 {
+				if s.end.cmp(last.end) > 0 {
+					last.end = s.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return &IPSet{spans: merged}
+}
+
+// ParseIPRanges parses a comma separated list of ranges, each in the form
+// accepted by ParseIPRange, such as "10.0.0.1-50, 10.0.1.0-255/24". Empty
+// entries are skipped.
+func ParseIPRanges(s string) ([]*IPRange, error) {
+	var ranges []*IPRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ipr, err := ParseIPRange(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the range %q: %v", part, err)
+		}
+		ranges = append(ranges, ipr)
+	}
+	return ranges, nil
+}
+
+// ParseIPSet returns the set of addresses in a comma separated list of
+// ranges, as parsed by ParseIPRanges.
+func ParseIPSet(s string) (*IPSet, error) {
+	ranges, err := ParseIPRanges(s)
+	if err != nil {
+		return nil, err
+	}
+	return NewIPSet(ranges...), nil
+}
+
+// Ranges returns the set as a sorted list of disjoint ranges, none of which
+// are adjacent. The ranges have no mask.
+func (s *IPSet) Ranges() []*IPRange {
+	ranges := make([]*IPRange, len(s.spans))
+	for i, sp := range s.spans {
+		ranges[i] = sp.ipRange()
+	}
+	return ranges
+}
+
+// IsEmpty returns whether the set has no addresses.
+func (s *IPSet) IsEmpty() bool {
+	return len(s.spans) == 0
+}
+
+// Size returns the number of addresses in the set.
+func (s *IPSet) Size() *big.Int {
+	size := big.NewInt(0)
+	for _, sp := range s.spans {
+		size.Add(size, sp.size())
+	}
+	return size
+}
+
+// Contains returns whether ip is in the set.
+func (s *IPSet) Contains(ip net.IP) bool {
+	if ip.To16() == nil {
+		return false
+	}
+	n := ipToNum(ip)
+	// find the first span ending at or after ip
+	i := sort.Search(len(s.spans), func(i int) bool { return s.spans[i].end.cmp(n) >= 0 })
+	return i < len(s.spans) && s.spans[i].start.cmp(n) <= 0
+}
+
+// Equal returns whether the two sets have the same addresses.
+func (s *IPSet) Equal(o *IPSet) bool {
+	if len(s.spans) != len(o.spans) {
+		return false
+	}
+	for i := range s.spans {
+		if s.spans[i] != o.spans[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns the addresses in either set.
+func (s *IPSet) Union(o *IPSet) *IPSet {
+	spans := make([]span, 0, len(s.spans)+len(o.spans))
+	spans = append(spans, s.spans...)
+	return newIPSet(append(spans, o.spans...))
+}
+
+// Intersect returns the addresses in both sets.
+func (s *IPSet) Intersect(o *IPSet) *IPSet {
+	var spans []span
+	a, b := s.spans, o.spans
+	for len(a) > 0 && len(b) > 0 {
+		start, end := a[0].start, a[0].end
+		if b[0].start.cmp(start) > 0 {
+			start = b[0].start
+		}
+		if b[0].end.cmp(end) < 0 {
+			end = b[0].end
+		}
+		if start.cmp(end) <= 0 {
+			spans = append(spans, span{start, end})
+		}
+		// drop whichever span ends first, as it cannot meet anything later
+		if a[0].end.cmp(b[0].end) < 0 {
+			a = a[1:]
+		} else {
+			b = b[1:]
+		}
+	}
+	return &IPSet{spans: spans}
+}
+
+// Difference returns the addresses in s that are not in o.
+func (s *IPSet) Difference(o *IPSet) *IPSet {
+	var spans []span
+	b := o.spans
+	for _, sp := range s.spans {
+		start := sp.start
+		// skip the spans of o that end before this one starts
+		for len(b) > 0 && b[0].end.cmp(start) < 0 {
+			b = b[1:]
+		}
+		done := false
+		for _, cut := range b {
+			if cut.start.cmp(sp.end) > 0 {
+				break
+			}
+			if cut.start.cmp(start) > 0 {
+				spans = append(spans, span{start, cut.start.prev()})
+			}
+			if cut.end.cmp(sp.end) >= 0 {
+				done = true
+				break
+			}
+			start = cut.end.next()
+		}
+		if !done {
+			spans = append(spans, span{start, sp.end})
+		}
+	}
+	return &IPSet{spans: spans}
+}
+
+// Complement returns the addresses within the supernet that are not in the
+// set, such as the free space left in a network by a set of allocations.
+func (s *IPSet) Complement(within *IPRange) *IPSet {
+	return NewIPSet(within).Difference(s)
+}
+
+// CIDRs returns the minimal list of CIDR blocks covering exactly the
+// addresses in the set, in order.
+func (s *IPSet) CIDRs() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, sp := range s.spans {
+		nets = append(nets, sp.cidrs()...)
+	}
+	return nets
+}
+
+// String returns the set as a comma separated list of ranges, which
+// ParseIPSet accepts.
+func (s *IPSet) String() string {
+	parts := make([]string, len(s.spans))
+	for i, sp := range s.spans {
+		parts[i] = sp.ipRange().String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (sp span) ipRange() *IPRange {
+	return &IPRange{Start: sp.start.IP(), End: sp.end.IP()}
+}
+
+// size returns the number of addresses in the span.
+func (sp span) size() *big.Int {
+	size := sp.end.bigInt()
+	size.Sub(size, sp.start.bigInt())
+	return size.Add(size, big.NewInt(1))
+}
+
+// cidrs splits the span into the largest aligned blocks that fit. IPv4 spans
+// give IPv4 blocks.
+func (sp span) cidrs() []*net.IPNet {
+	var nets []*net.IPNet
+	ipv4 := sp.start.isIPv4() && sp.end.isIPv4()
+	start := sp.start
+	for {
+		// the block is limited by the alignment of its start and by the end
+		k := start.trailingZeros()
+		for k > 0 && blockEnd(start, k).cmp(sp.end) > 0 {
+			k--
+		}
+		if ipv4 {
+			nets = append(nets, &net.IPNet{IP: start.IP().To4(), Mask: net.CIDRMask(32-int(k), 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: start.IP(), Mask: net.CIDRMask(128-int(k), 128)})
+		}
+		end := blockEnd(start, k)
+		if end.cmp(sp.end) >= 0 {
+			return nets
+		}
+		start = end.next()
+	}
+}
+
+// blockStart returns the first address of the block of 2^k addresses
+// containing n.
+func blockStart(n ipNum, k uint) ipNum {
+	low := blockEnd(ipNum{}, k)
+	return ipNum{n.hi &^ low.hi, n.lo &^ low.lo}
+}
+
+// blockEnd returns the last address of the block of 2^k addresses starting at
+// start, which must be aligned to it.
+func blockEnd(start ipNum, k uint) ipNum {
+	switch {
+	case k >= 128:
+		return maxIPNum
+	case k >= 64:
+		return ipNum{start.hi | (1<<(k-64) - 1), ^uint64(0)}
+	}
+	return ipNum{start.hi, start.lo | (1<<k - 1)}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"net"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func mustParseIPSet(t *testing.T, s string) *IPSet {
+	set, err := ParseIPSet(s)
+	tt.TestExpectSuccess(t, err)
+	return set
+}
+
+func cidrStrings(nets []*net.IPNet) []string {
+	s := make([]string, len(nets))
+	for i, n := range nets {
+		s[i] = n.String()
+	}
+	return s
+}
+
+func TestParseIPSet(t *testing.T) {
+	// overlapping and adjacent ranges are merged, whatever their order
+	set := mustParseIPSet(t, "10.0.0.50-60, 10.0.0.1-10,10.0.0.11-20 , 10.0.0.55-70,")
+	tt.TestEqual(t, set.String(), "10.0.0.1-10.0.0.20,10.0.0.50-10.0.0.70")
+	tt.TestEqual(t, set.Size().Int64(), int64(41))
+	tt.TestEqual(t, len(set.Ranges()), 2)
+
+	tt.TestEqual(t, set.Contains(net.ParseIP("10.0.0.1")), true)
+	tt.TestEqual(t, set.Contains(net.ParseIP("10.0.0.20").To4()), true)
+	tt.TestEqual(t, set.Contains(net.ParseIP("10.0.0.21")), false)
+	tt.TestEqual(t, set.Contains(net.ParseIP("10.0.0.70")), true)
+	tt.TestEqual(t, set.Contains(net.ParseIP("10.0.0.71")), false)
+	tt.TestEqual(t, set.Contains(net.ParseIP("::1")), false)
+
+	// the String form parses back to the same set
+	tt.TestEqual(t, mustParseIPSet(t, set.String()).Equal(set), true)
+
+	_, err := ParseIPSet("10.0.0.1-10,10.0.0.x")
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, err.Error(), `failed to parse the range "10.0.0.x": failed to parse the IP address "10.0.0.x"`)
+
+	tt.TestEqual(t, mustParseIPSet(t, "").IsEmpty(), true)
+}
+
+func TestIPSetAlgebra(t *testing.T) {
+	a := mustParseIPSet(t, "10.0.0.0-10.0.0.255")
+	b := mustParseIPSet(t, "10.0.0.100-10.0.1.50, 10.0.0.10-20")
+
+	tt.TestEqual(t, a.Union(b).String(), "10.0.0.0-10.0.1.50")
+	tt.TestEqual(t, a.Intersect(b).String(), "10.0.0.10-10.0.0.20,10.0.0.100-10.0.0.255")
+	tt.TestEqual(t, b.Intersect(a).String(), a.Intersect(b).String())
+	tt.TestEqual(t, a.Difference(b).String(), "10.0.0.0-10.0.0.9,10.0.0.21-10.0.0.99")
+	tt.TestEqual(t, b.Difference(a).String(), "10.0.1.0-10.0.1.50")
+	tt.TestEqual(t, a.Difference(a).IsEmpty(), true)
+	tt.TestEqual(t, a.Intersect(mustParseIPSet(t, "10.0.1.0-255")).IsEmpty(), true)
+
+	// cutting several holes out of one range
+	holes := mustParseIPSet(t, "10.0.0.0, 10.0.0.5-6, 10.0.0.255")
+	tt.TestEqual(t, a.Difference(holes).String(), "10.0.0.1-10.0.0.4,10.0.0.7-10.0.0.254")
+
+	// the complement within a supernet is the free space
+	supernet := NewIPRangeFromIPNet(&net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(23, 32)})
+	tt.TestEqual(t, supernet.String(), "10.0.0.0-10.0.1.255/23")
+	tt.TestEqual(t, b.Complement(supernet).String(), "10.0.0.0-10.0.0.9,10.0.0.21-10.0.0.99,10.0.1.51-10.0.1.255")
+	tt.TestEqual(t, b.Complement(supernet).Union(b).Equal(NewIPSet(supernet)), true)
+}
+
+func TestIPSetIPv6(t *testing.T) {
+	// IPv4 and IPv4-mapped addresses are the same members
+	mixed := mustParseIPSet(t, "10.0.0.1-10, ::ffff:10.0.0.5-10.0.0.20, 2001:db8::1-ff")
+	tt.TestEqual(t, mixed.String(), "10.0.0.1-10.0.0.20,2001:db8::1-2001:db8::ff")
+	tt.TestEqual(t, mixed.Contains(net.ParseIP("2001:db8::80")), true)
+
+	// the whole address space, with no overflow at either end
+	all := mustParseIPSet(t, "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	tt.TestEqual(t, all.Size().String(), "340282366920938463463374607431768211456")
+	tt.TestEqual(t, cidrStrings(all.CIDRs()), []string{"::/0"})
+	rest := all.Difference(mustParseIPSet(t, "::"))
+	tt.TestEqual(t, rest.String(), "::1-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	tt.TestEqual(t, rest.Union(mustParseIPSet(t, "::")).Equal(all), true)
+	top := mustParseIPSet(t, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	tt.TestEqual(t, all.Difference(top).Union(top).Equal(all), true)
+}
+
+func TestCIDRs(t *testing.T) {
+	tests := []struct {
+		rng   string
+		cidrs []string
+	}{
+		{"10.0.0.0-10.0.0.255", []string{"10.0.0.0/24"}},
+		{"10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.1-10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"10.0.0.0-10.0.2.127", []string{"10.0.0.0/23", "10.0.2.0/25"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"2001:db8::-2001:db8::1:ffff", []string{"2001:db8::/111"}},
+		{"2001:db8::1-2001:db8::4", []string{"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/128"}},
+	}
+	for _, test := range tests {
+		ipr, err := ParseIPRange(test.rng)
+		tt.TestExpectSuccess(t, err)
+		tt.TestEqual(t, cidrStrings(ipr.CIDRs()), test.cidrs, test.rng)
+	}
+
+	set := mustParseIPSet(t, "10.0.0.0-10.0.0.127, 10.0.0.128-10.0.0.255, 10.0.1.7")
+	tt.TestEqual(t, cidrStrings(set.CIDRs()), []string{"10.0.0.0/24", "10.0.1.7/32"})
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// lease records who holds an allocated address, and until when. A zero
+// expiry never expires.
+type lease struct {
+	ip      ipNum
+	owner   string
+	expires time.Time
+	index   int // in the expiry heap, or -1
+}
+
+// newLease returns a lease for owner lasting ttl, or forever if ttl is zero.
+func newLease(owner string, ttl time.Duration) *lease {
+	l := &lease{owner: owner, index: -1}
+	if ttl > 0 {
+		l.expires = time.Now().Add(ttl)
+	}
+	return l
+}
+
+// journalArgs returns the lease as it is written after a journal record.
+func (l *lease) journalArgs() string {
+	if l == nil {
+		return ""
+	}
+	var nanos int64
+	if !l.expires.IsZero() {
+		nanos = l.expires.UnixNano()
+	}
+	return fmt.Sprintf("%q %d", l.owner, nanos)
+}
+
+// parseLease parses the lease written by journalArgs.
+func parseLease(s string) (*lease, error) {
+	l := &lease{index: -1}
+	var nanos int64
+	if _, err := fmt.Sscanf(s, "%q %d", &l.owner, &nanos); err != nil {
+		return nil, err
+	}
+	if nanos != 0 {
+		l.expires = time.Unix(0, nanos)
+	}
+	return l, nil
+}
+
+// leaseHeap orders the leases that expire by their expiry.
+type leaseHeap []*lease
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x interface{}) {
+	l := x.(*lease)
+	l.index = len(*h)
+	*h = append(*h, l)
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	l := old[len(old)-1]
+	l.index = -1
+	*h = old[:len(old)-1]
+	return l
+}
+
+// AllocateFor allocates an address, as Allocate does, and leases it to owner.
+// If ttl is positive the lease expires after it, and Sweep releases the
+// address; otherwise it lasts until the address is released.
+func (a *IPRangeAllocator) AllocateFor(owner string, ttl time.Duration) net.IP {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ip, ok := a.allocate(newLease(owner, ttl))
+	if !ok {
+		return nil
+	}
+	return ip.IP()
+}
+
+// Lease returns the owner of an address allocated with AllocateFor, and when
+// its lease expires, which is the zero time if it never does.
+func (a *IPRangeAllocator) Lease(ip net.IP) (owner string, expires time.Time, ok bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if ip.To16() == nil {
+		return "", time.Time{}, false
+	}
+	l, ok := a.leases[ipToNum(ip)]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	return l.owner, l.expires, true
+}
+
+// ByOwner returns the addresses leased to owner, in order.
+func (a *IPRangeAllocator) ByOwner(owner string) []net.IP {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var nums []ipNum
+	for n := range a.owners[owner] {
+		nums = append(nums, n)
+	}
+	sort.Sort(byIPNum(nums))
+	ips := make([]net.IP, len(nums))
+	for i, n := range nums {
+		ips[i] = n.IP()
+	}
+	return ips
+}
+
+// Renew extends the lease on an address to ttl from now, or makes it last
+// until the address is released if ttl is not positive. It returns false if
+// the address is not leased.
+func (a *IPRangeAllocator) Renew(ip net.IP, ttl time.Duration) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if ip.To16() == nil {
+		return false
+	}
+	n := ipToNum(ip)
+	old, ok := a.leases[n]
+	if !ok {
+		return false
+	}
+	l := newLease(old.owner, ttl)
+	if !a.record(journalUse, span{n, n}, l.journalArgs()) {
+		return false
+	}
+	a.setLease(n, l)
+	return true
+}
+
+// ReleaseOwner releases every address leased to owner, and returns them in
+// order.
+func (a *IPRangeAllocator) ReleaseOwner(owner string) []net.IP {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var nums []ipNum
+	for n := range a.owners[owner] {
+		nums = append(nums, n)
+	}
+	sort.Sort(byIPNum(nums))
+	var ips []net.IP
+	for _, n := range nums {
+		if !a.release(n) {
+			break
+		}
+		ips = append(ips, n.IP())
+	}
+	return ips
+}
+
+// Sweep releases every address whose lease expired at or before now, and
+// returns them in the order they expired.
+func (a *IPRangeAllocator) Sweep(now time.Time) []net.IP {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var ips []net.IP
+	for len(a.expiry) > 0 && !a.expiry[0].expires.After(now) {
+		n := a.expiry[0].ip
+		if !a.release(n) {
+			break
+		}
+		ips = append(ips, n.IP())
+	}
+	return ips
+}
+
+// setLease leases ip, replacing any earlier lease.
+func (a *IPRangeAllocator) setLease(ip ipNum, l *lease) {
+	a.dropLease(ip)
+	l.ip = ip
+	a.leases[ip] = l
+	a.leased.add(ip, ip)
+	if a.owners[l.owner] == nil {
+		a.owners[l.owner] = make(map[ipNum]bool)
+	}
+	a.owners[l.owner][ip] = true
+	if !l.expires.IsZero() {
+		heap.Push(&a.expiry, l)
+	}
+}
+
+// dropLease removes any lease on ip.
+func (a *IPRangeAllocator) dropLease(ip ipNum) {
+	l, ok := a.leases[ip]
+	if !ok {
+		return
+	}
+	delete(a.leases, ip)
+	a.leased.remove(ip, ip)
+	delete(a.owners[l.owner], ip)
+	if len(a.owners[l.owner]) == 0 {
+		delete(a.owners, l.owner)
+	}
+	if l.index >= 0 {
+		heap.Remove(&a.expiry, l.index)
+	}
+}
+
+// byIPNum sorts addresses in order.
+type byIPNum []ipNum
+
+func (a byIPNum) Len() int           { return len(a) }
+func (a byIPNum) Less(i, j int) bool { return a[i].cmp(a[j]) < 0 }
+func (a byIPNum) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
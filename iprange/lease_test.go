@@ -0,0 +1,160 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
+
+func TestAllocateFor(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	tt.TestEqual(t, alloc.AllocateFor("web", time.Hour).String(), "10.0.0.1")
+	tt.TestEqual(t, alloc.AllocateFor("db", 0).String(), "10.0.0.2")
+	tt.TestEqual(t, alloc.AllocateFor("web", 2*time.Hour).String(), "10.0.0.3")
+	tt.TestEqual(t, alloc.Allocate().String(), "10.0.0.4")
+
+	owner, expires, ok := alloc.Lease(net.ParseIP("10.0.0.1"))
+	tt.TestEqual(t, ok, true)
+	tt.TestEqual(t, owner, "web")
+	tt.TestEqual(t, expires.After(time.Now()), true)
+	owner, expires, ok = alloc.Lease(net.ParseIP("10.0.0.2"))
+	tt.TestEqual(t, ok, true)
+	tt.TestEqual(t, owner, "db")
+	tt.TestEqual(t, expires.IsZero(), true)
+	_, _, ok = alloc.Lease(net.ParseIP("10.0.0.4"))
+	tt.TestEqual(t, ok, false)
+
+	tt.TestEqual(t, ipStrings(alloc.ByOwner("web")), []string{"10.0.0.1", "10.0.0.3"})
+	tt.TestEqual(t, len(alloc.ByOwner("nobody")), 0)
+
+	// releasing an address ends its lease
+	alloc.Release(net.ParseIP("10.0.0.3"))
+	tt.TestEqual(t, ipStrings(alloc.ByOwner("web")), []string{"10.0.0.1"})
+	tt.TestEqual(t, ipStrings(alloc.ReleaseOwner("db")), []string{"10.0.0.2"})
+	tt.TestEqual(t, alloc.Remaining(), int64(6))
+	tt.TestEqual(t, len(alloc.ByOwner("db")), 0)
+}
+
+func TestReleaseBlockEndsLeases(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	for i := 0; i < 6; i++ {
+		alloc.AllocateFor("web", 0)
+	}
+	// 10.0.0.4/30 covers 10.0.0.4-7, of which 10.0.0.4-6 are leased
+	_, block, err := net.ParseCIDR("10.0.0.4/30")
+	tt.TestExpectSuccess(t, err)
+	alloc.ReleaseBlock(block)
+	tt.TestEqual(t, ipStrings(alloc.ByOwner("web")), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	tt.TestEqual(t, alloc.leased.total, ipNum{0, 3})
+}
+
+func TestLeaseSweep(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	a := alloc.AllocateFor("a", time.Hour)
+	b := alloc.AllocateFor("b", 3*time.Hour)
+	c := alloc.AllocateFor("c", 2*time.Hour)
+	alloc.AllocateFor("d", 0)
+
+	tt.TestEqual(t, len(alloc.Sweep(time.Now())), 0)
+	tt.TestEqual(t, ipStrings(alloc.Sweep(time.Now().Add(150*time.Minute))), ipStrings([]net.IP{a, c}))
+	tt.TestEqual(t, alloc.Remaining(), int64(6))
+
+	// renewing pushes the expiry back, and a lease without one never expires
+	tt.TestEqual(t, alloc.Renew(b, 5*time.Hour), true)
+	tt.TestEqual(t, alloc.Renew(a, time.Hour), false)
+	tt.TestEqual(t, len(alloc.Sweep(time.Now().Add(4*time.Hour))), 0)
+	tt.TestEqual(t, ipStrings(alloc.Sweep(time.Now().Add(100*time.Hour))), ipStrings([]net.IP{b}))
+	tt.TestEqual(t, alloc.Remaining(), int64(7))
+	tt.TestEqual(t, len(alloc.expiry), 0)
+}
+
+func TestLeaseState(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	alloc.AllocateFor("web", time.Hour)
+	alloc.AllocateFor("db", 0)
+	alloc.Allocate()
+	_, expires, _ := alloc.Lease(net.ParseIP("10.0.0.1"))
+
+	check := func(restored *IPRangeAllocator) {
+		owner, exp, ok := restored.Lease(net.ParseIP("10.0.0.1"))
+		tt.TestEqual(t, ok, true)
+		tt.TestEqual(t, owner, "web")
+		tt.TestEqual(t, exp.Equal(expires), true)
+		tt.TestEqual(t, ipStrings(restored.ByOwner("db")), []string{"10.0.0.2"})
+		_, _, ok = restored.Lease(net.ParseIP("10.0.0.3"))
+		tt.TestEqual(t, ok, false)
+		tt.TestEqual(t, restored.Remaining(), int64(5))
+		tt.TestEqual(t, ipStrings(restored.Sweep(expires)), []string{"10.0.0.1"})
+	}
+
+	data, err := json.Marshal(alloc)
+	tt.TestExpectSuccess(t, err)
+	restored := new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, json.Unmarshal(data, restored))
+	check(restored)
+
+	data, err = alloc.MarshalBinary()
+	tt.TestExpectSuccess(t, err)
+	restored = new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, restored.UnmarshalBinary(data))
+	check(restored)
+
+	// the first binary version, without leases, is still read
+	restored = new(IPRangeAllocator)
+	v1 := append([]byte(binaryVersionV1), data[len(binaryVersion):]...)
+	tt.TestExpectError(t, restored.UnmarshalBinary(v1))
+	ipr, err := ParseIPRange("10.0.0.1-8")
+	tt.TestExpectSuccess(t, err)
+	old := NewAllocator(ipr)
+	old.Allocate()
+	data, err = old.MarshalBinary()
+	tt.TestExpectSuccess(t, err)
+	v1 = append([]byte(binaryVersionV1), data[len(binaryVersion):len(data)-1]...)
+	tt.TestExpectSuccess(t, restored.UnmarshalBinary(v1))
+	tt.TestEqual(t, restored.Remaining(), int64(7))
+
+	// a lease on a free address is refused
+	bad := `{"range": "10.0.0.1-8", "leases": [{"ip": "10.0.0.1", "owner": "web"}]}`
+	tt.TestExpectError(t, json.Unmarshal([]byte(bad), new(IPRangeAllocator)))
+}
+
+func TestLeaseJournal(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	var journal bytes.Buffer
+	alloc.SetJournal(&journal)
+	alloc.AllocateFor("web", time.Hour)
+	alloc.AllocateFor("a \"quoted\" owner", 0)
+	alloc.AllocateFor("web", time.Hour)
+	alloc.Renew(net.ParseIP("10.0.0.1"), 2*time.Hour)
+	alloc.Release(net.ParseIP("10.0.0.3"))
+	_, expires, _ := alloc.Lease(net.ParseIP("10.0.0.1"))
+
+	restored := newStrategyAllocator(t, StrategyLowestFree)
+	_, err := restored.Replay(bytes.NewReader(journal.Bytes()))
+	tt.TestExpectSuccess(t, err)
+	owner, exp, ok := restored.Lease(net.ParseIP("10.0.0.1"))
+	tt.TestEqual(t, ok, true)
+	tt.TestEqual(t, owner, "web")
+	tt.TestEqual(t, exp.Equal(expires), true)
+	tt.TestEqual(t, ipStrings(restored.ByOwner("a \"quoted\" owner")), []string{"10.0.0.2"})
+	tt.TestEqual(t, ipStrings(restored.ByOwner("web")), []string{"10.0.0.1"})
+	tt.TestEqual(t, len(restored.expiry), 1)
+	tt.TestEqual(t, restored.Remaining(), int64(6))
+
+	_, err = restored.Replay(bytes.NewBufferString("+ 10.0.0.5 web\n"))
+	tt.TestExpectError(t, err)
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+)
+
+// MaxReservedSubnets is the largest number of subnets a range added to a
+// Pool may span when PoolOptions.ReserveSubnetAddresses is set, as their
+// addresses are reserved one subnet at a time.
+const MaxReservedSubnets = 1 << 16
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	// Strategy is used by the allocator of each range.
+	Strategy Strategy
+
+	// ReserveSubnetAddresses reserves, in each subnet of a range's mask, the
+	// network address, the first host address for a gateway, and for IPv4 the
+	// broadcast address. Subnets of fewer than four addresses, such as /31
+	// point to point links, are left alone. Ranges spanning more than
+	// MaxReservedSubnets subnets cannot be added.
+	ReserveSubnetAddresses bool
+}
+
+// Pool allocates IP addresses from several ranges, which may mix IPv4 and
+// IPv6. Addresses come from the range with the lowest priority number that
+// has any free, and ranges of equal priority are used in the order they were
+// added.
+type Pool struct {
+	opts    PoolOptions
+	mutex   sync.Mutex
+	members []*poolMember
+}
+
+type poolMember struct {
+	alloc    *IPRangeAllocator
+	priority int
+}
+
+// byPriority sorts pool members by priority, and must be sorted stably.
+type byPriority []*poolMember
+
+func (a byPriority) Len() int           { return len(a) }
+func (a byPriority) Less(i, j int) bool { return a[i].priority < a[j].priority }
+func (a byPriority) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// NewPool creates an empty Pool. The options may be nil for the defaults.
+func NewPool(opts *PoolOptions) *Pool {
+	p := &Pool{}
+	if opts != nil {
+		p.opts = *opts
+	}
+	return p
+}
+
+// Add adds a range to the pool with the given priority, and returns its
+// allocator. Ranges may not overlap.
+func (p *Pool) Add(ipr *IPRange, priority int) (*IPRangeAllocator, error) {
+	if compareIP(ipr.End, ipr.Start) < 0 {
+		return nil, fmt.Errorf("the end of the range cannot be less than the start of the range")
+	}
+	if p.opts.ReserveSubnetAddresses {
+		if n := subnetCount(ipr); n.Cmp(big.NewInt(MaxReservedSubnets)) > 0 {
+			return nil, fmt.Errorf("the range %s spans %s subnets, more than the %d whose addresses can be reserved",
+				ipr, n, MaxReservedSubnets)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		if other := m.alloc.IPRange(); ipr.Overlaps(other) {
+			return nil, fmt.Errorf("the range %s overlaps %s", ipr, other)
+		}
+	}
+	a := NewAllocator(ipr)
+	a.SetStrategy(p.opts.Strategy)
+	if p.opts.ReserveSubnetAddresses {
+		a.subtractSubnetAddresses()
+	}
+	p.members = append(p.members, &poolMember{alloc: a, priority: priority})
+	sort.Stable(byPriority(p.members))
+	return a, nil
+}
+
+// Ranges returns the pool's ranges in priority order.
+func (p *Pool) Ranges() []*IPRange {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ranges := make([]*IPRange, len(p.members))
+	for i, m := range p.members {
+		ranges[i] = m.alloc.IPRange()
+	}
+	return ranges
+}
+
+// Allocator returns the allocator of the range containing ip, or nil.
+func (p *Pool) Allocator(ip net.IP) *IPRangeAllocator {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.find(ip)
+}
+
+// Allocate allocates an address from the first range, in priority order,
+// that has one free. It returns nil if the pool is exhausted.
+func (p *Pool) Allocate() net.IP {
+	return p.allocate(func(*IPRangeAllocator) bool { return true })
+}
+
+// AllocateIPv4 allocates an address as Allocate does, but only from IPv4
+// ranges. The address is returned in its 4 byte form.
+func (p *Pool) AllocateIPv4() net.IP {
+	ip := p.allocate(func(a *IPRangeAllocator) bool { return a.start.isIPv4() })
+	if ip == nil {
+		return nil
+	}
+	return ip.To4()
+}
+
+// AllocateIPv6 allocates an address as Allocate does, but only from IPv6
+// ranges.
+func (p *Pool) AllocateIPv6() net.IP {
+	return p.allocate(func(a *IPRangeAllocator) bool { return !a.start.isIPv4() })
+}
+
+func (p *Pool) allocate(match func(*IPRangeAllocator) bool) net.IP {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		if !match(m.alloc) {
+			continue
+		}
+		if ip := m.alloc.Allocate(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// AllocateBlock allocates an aligned block with the given mask from the first
+// range, in priority order, of the mask's family that has one free, such as a
+// /28 to delegate as a subnet. It returns nil if no range has such a block.
+func (p *Pool) AllocateBlock(mask net.IPMask) *net.IPNet {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		if n := m.alloc.AllocateBlock(mask); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// Reserve reserves an address so that it is not allocated. Addresses outside
+// the pool are ignored.
+func (p *Pool) Reserve(ip net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if a := p.find(ip); a != nil {
+		a.Reserve(ip)
+	}
+}
+
+// Release releases an address that had been allocated or reserved.
+// Addresses outside the pool are ignored.
+func (p *Pool) Release(ip net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if a := p.find(ip); a != nil {
+		a.Release(ip)
+	}
+}
+
+// ReleaseBlock releases every address in a block, such as one returned by
+// AllocateBlock.
+func (p *Pool) ReleaseBlock(n *net.IPNet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, m := range p.members {
+		m.alloc.ReleaseBlock(n)
+	}
+}
+
+// Size returns the number of addresses in all of the pool's ranges.
+func (p *Pool) Size() *big.Int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	size := big.NewInt(0)
+	for _, m := range p.members {
+		size.Add(size, m.alloc.SizeBig())
+	}
+	return size
+}
+
+// Remaining returns the number of addresses in the pool that are free.
+func (p *Pool) Remaining() *big.Int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	remaining := big.NewInt(0)
+	for _, m := range p.members {
+		remaining.Add(remaining, m.alloc.RemainingBig())
+	}
+	return remaining
+}
+
+// find returns the allocator of the range containing ip, or nil.
+func (p *Pool) find(ip net.IP) *IPRangeAllocator {
+	if ip.To16() == nil {
+		return nil
+	}
+	for _, m := range p.members {
+		if m.alloc.ipRange.Contains(ip) {
+			return m.alloc
+		}
+	}
+	return nil
+}
+
+// subnetBits returns the number of host bits in the subnets of the range's
+// mask that have addresses reserved, or false if none do.
+func subnetBits(ipr *IPRange) (uint, bool) {
+	if ipr.Mask == nil {
+		return 0, false
+	}
+	ones, bits := ipr.Mask.Size()
+	k := uint(bits - ones)
+	return k, k >= 2
+}
+
+// subnetCount returns the number of subnets of the range's mask that the
+// range overlaps and that have addresses reserved.
+func subnetCount(ipr *IPRange) *big.Int {
+	k, ok := subnetBits(ipr)
+	if !ok {
+		return big.NewInt(0)
+	}
+	first, last := blockStart(ipToNum(ipr.Start), k), blockStart(ipToNum(ipr.End), k)
+	n := last.minus(first).bigInt()
+	return n.Rsh(n, k).Add(n, big.NewInt(1))
+}
+
+// subtractSubnetAddresses subtracts the network, gateway and broadcast
+// addresses of each subnet of the range's mask that the range overlaps.
+func (a *IPRangeAllocator) subtractSubnetAddresses() {
+	k, ok := subnetBits(a.ipRange)
+	if !ok {
+		return
+	}
+	ipv4 := a.start.isIPv4()
+	for network := blockStart(a.start, k); network.cmp(a.end) <= 0; {
+		a.Subtract(&IPRange{Start: network.IP(), End: network.next().IP()})
+		broadcast := blockEnd(network, k)
+		if ipv4 {
+			a.Subtract(&IPRange{Start: broadcast.IP(), End: broadcast.IP()})
+		}
+		if broadcast == maxIPNum {
+			return
+		}
+		network = broadcast.next()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"net"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+func mustAddRange(t *testing.T, p *Pool, s string, priority int) *IPRangeAllocator {
+	ipr, err := ParseIPRange(s)
+	tt.TestExpectSuccess(t, err)
+	a, err := p.Add(ipr, priority)
+	tt.TestExpectSuccess(t, err)
+	return a
+}
+
+func TestPoolPriority(t *testing.T) {
+	p := NewPool(&PoolOptions{Strategy: StrategyLowestFree})
+	mustAddRange(t, p, "10.0.1.1-2", 2)
+	mustAddRange(t, p, "2001:db8::1-2", 1)
+	mustAddRange(t, p, "10.0.0.1-2", 1)
+	tt.TestEqual(t, p.Size().Int64(), int64(6))
+
+	// equal priorities keep the order they were added in
+	var ranges []string
+	for _, ipr := range p.Ranges() {
+		ranges = append(ranges, ipr.String())
+	}
+	tt.TestEqual(t, ranges, []string{"2001:db8::1-2001:db8::2", "10.0.0.1-10.0.0.2", "10.0.1.1-10.0.1.2"})
+
+	tt.TestEqual(t, p.AllocateIPv4().String(), "10.0.0.1")
+	tt.TestEqual(t, len(p.AllocateIPv4()), net.IPv4len)
+	tt.TestEqual(t, p.Allocate().String(), "2001:db8::1")
+	tt.TestEqual(t, p.Allocate().String(), "2001:db8::2")
+	tt.TestEqual(t, p.AllocateIPv6(), nil)
+	tt.TestEqual(t, p.Allocate().String(), "10.0.1.1")
+	p.Reserve(net.ParseIP("10.0.1.2"))
+	tt.TestEqual(t, p.Allocate(), nil)
+	tt.TestEqual(t, p.Remaining().Int64(), int64(0))
+
+	p.Release(net.ParseIP("2001:db8::2"))
+	p.Release(net.ParseIP("192.168.0.1"))
+	tt.TestEqual(t, p.Remaining().Int64(), int64(1))
+	tt.TestEqual(t, p.AllocateIPv4(), nil)
+	tt.TestEqual(t, p.Allocator(net.ParseIP("2001:db8::2")).IPRange().String(), "2001:db8::1-2001:db8::2")
+	tt.TestEqual(t, p.Allocator(net.ParseIP("10.0.2.1")), nil)
+
+	ipr, err := ParseIPRange("10.0.0.2-10.0.1.0")
+	tt.TestExpectSuccess(t, err)
+	_, err = p.Add(ipr, 0)
+	tt.TestExpectError(t, err)
+	tt.TestEqual(t, len(p.Ranges()), 3)
+}
+
+func TestPoolSubnetAddresses(t *testing.T) {
+	p := NewPool(&PoolOptions{Strategy: StrategyLowestFree, ReserveSubnetAddresses: true})
+	a := mustAddRange(t, p, "10.0.0.0-255/24", 0)
+	used, excluded := allocatorSpans(a)
+	tt.TestEqual(t, used, excluded)
+	tt.TestEqual(t, (&IPSet{spans: excluded}).String(), "10.0.0.0-10.0.0.1,10.0.0.255")
+	tt.TestEqual(t, p.Allocate().String(), "10.0.0.2")
+
+	// only the parts of a subnet within the range are reserved, and IPv6
+	// has no broadcast address
+	b := mustAddRange(t, p, "2001:db8::-ff/120", 1)
+	tt.TestEqual(t, b.Remaining(), int64(254))
+	c := mustAddRange(t, p, "10.1.0.10-20/24", 2)
+	tt.TestEqual(t, c.Remaining(), int64(11))
+
+	// tiny subnets and ranges without a mask are left alone
+	d := mustAddRange(t, p, "10.2.0.0-1/31", 3)
+	tt.TestEqual(t, d.Remaining(), int64(2))
+	e := mustAddRange(t, p, "10.3.0.0-255", 3)
+	tt.TestEqual(t, e.Remaining(), int64(256))
+
+	// ranges spanning too many subnets of their mask are refused rather
+	// than walked
+	_, err := p.Add(&IPRange{
+		Start: net.ParseIP("2001:db9::"),
+		End:   net.ParseIP("2001:db9:ffff:ffff:ffff:ffff:ffff:ffff"),
+		Mask:  net.CIDRMask(64, 128),
+	}, 4)
+	tt.TestExpectError(t, err)
+	f, err := p.Add(&IPRange{
+		Start: net.ParseIP("10.4.0.0"),
+		End:   net.ParseIP("10.4.255.255"),
+		Mask:  net.CIDRMask(30, 32),
+	}, 4)
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, f.Remaining(), int64(1<<14))
+}
+
+func TestPoolBlocks(t *testing.T) {
+	p := NewPool(&PoolOptions{ReserveSubnetAddresses: true})
+	mustAddRange(t, p, "10.0.0.0-10.0.0.255/24", 0)
+	mustAddRange(t, p, "2001:db8::-2001:db8::ffff/112", 0)
+
+	// the first /28 holds the network and gateway addresses
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(28, 32)).String(), "10.0.0.16/28")
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(28, 32)).String(), "10.0.0.32/28")
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(26, 32)).String(), "10.0.0.64/26")
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(25, 32)), nil)
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(120, 128)).String(), "2001:db8::100/120")
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(64, 128)), nil)
+
+	_, block, err := net.ParseCIDR("10.0.0.16/28")
+	tt.TestExpectSuccess(t, err)
+	p.ReleaseBlock(block)
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(29, 32)).String(), "10.0.0.8/29")
+	tt.TestEqual(t, p.AllocateBlock(net.CIDRMask(29, 32)).String(), "10.0.0.16/29")
+}
+
+func TestAllocateBlockEdges(t *testing.T) {
+	// a block may cover the whole range, even the whole address space
+	ipr, err := ParseIPRange("::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")
+	tt.TestExpectSuccess(t, err)
+	a := NewAllocator(ipr)
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(1, 128)).String(), "::/1")
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(1, 128)).String(), "8000::/1")
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(128, 128)), nil)
+
+	// unaligned ranges only give blocks wholly within them
+	ipr, err = ParseIPRange("10.0.0.3-10.0.0.20")
+	tt.TestExpectSuccess(t, err)
+	a = NewAllocator(ipr)
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(29, 32)).String(), "10.0.0.8/29")
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(29, 32)), nil)
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(30, 32)).String(), "10.0.0.4/30")
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(30, 32)).String(), "10.0.0.16/30")
+	tt.TestEqual(t, a.AllocateBlock(net.CIDRMask(64, 128)), nil)
+	tt.TestEqual(t, a.Remaining(), int64(2))
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"math/rand"
+)
+
+// spanTree is a set of addresses held as disjoint, non-adjacent spans in a
+// treap ordered by start. Lookups and updates take O(log n) expected time in
+// the number of spans, so memory and time scale with how fragmented the set
+// is rather than with how many addresses it covers.
+type spanTree struct {
+	root  *treapNode
+	spans int
+	total ipNum
+}
+
+type treapNode struct {
+	span
+	prio        uint32
+	left, right *treapNode
+}
+
+// count returns the number of addresses in the span.
+func (sp span) count() ipNum {
+	return sp.end.minus(sp.start).next()
+}
+
+// split divides t into the nodes starting before key and the rest.
+func split(t *treapNode, key ipNum) (l, r *treapNode) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.start.cmp(key) < 0 {
+		t.right, r = split(t.right, key)
+		return t, r
+	}
+	l, t.left = split(t.left, key)
+	return l, t
+}
+
+// merge joins two treaps, all of whose keys in l are less than those in r.
+func merge(l, r *treapNode) *treapNode {
+	switch {
+	case l == nil:
+		return r
+	case r == nil:
+		return l
+	case l.prio > r.prio:
+		l.right = merge(l.right, r)
+		return l
+	}
+	r.left = merge(l, r.left)
+	return r
+}
+
+// deleteMin removes the first node of t.
+func deleteMin(t *treapNode) *treapNode {
+	if t.left == nil {
+		return t.right
+	}
+	t.left = deleteMin(t.left)
+	return t
+}
+
+func (s *spanTree) insert(sp span) {
+	l, r := split(s.root, sp.start)
+	n := &treapNode{span: sp, prio: rand.Uint32()}
+	s.root = merge(merge(l, n), r)
+	s.spans++
+	s.total = s.total.plus(sp.count())
+}
+
+// delete removes the span starting at start, which must be in the tree.
+func (s *spanTree) delete(sp span) {
+	l, r := split(s.root, sp.start)
+	s.root = merge(l, deleteMin(r))
+	s.spans--
+	s.total = s.total.minus(sp.count())
+}
+
+// floor returns the span with the greatest start at or before x.
+func (s *spanTree) floor(x ipNum) (span, bool) {
+	var best *treapNode
+	for t := s.root; t != nil; {
+		if t.start.cmp(x) <= 0 {
+			best, t = t, t.right
+		} else {
+			t = t.left
+		}
+	}
+	if best == nil {
+		return span{}, false
+	}
+	return best.span, true
+}
+
+// ceil returns the span with the least start at or after x.
+func (s *spanTree) ceil(x ipNum) (span, bool) {
+	var best *treapNode
+	for t := s.root; t != nil; {
+		if t.start.cmp(x) >= 0 {
+			best, t = t, t.left
+		} else {
+			t = t.right
+		}
+	}
+	if best == nil {
+		return span{}, false
+	}
+	return best.span, true
+}
+
+// find returns the span containing x.
+func (s *spanTree) find(x ipNum) (span, bool) {
+	sp, ok := s.floor(x)
+	if !ok || sp.end.cmp(x) < 0 {
+		return span{}, false
+	}
+	return sp, true
+}
+
+// add adds the addresses from start to end, merging with any spans they
+// overlap or touch, and returns the number that were not already present.
+func (s *spanTree) add(start, end ipNum) ipNum {
+	before := s.total
+	// absorb a span that starts before and reaches the new one
+	if sp, ok := s.floor(start); ok && (sp.end.cmp(start) >= 0 || sp.end.next() == start) {
+		s.delete(sp)
+		start = sp.start
+		if sp.end.cmp(end) > 0 {
+			end = sp.end
+		}
+	}
+	// absorb the spans that start within or just after the new one
+	for {
+		sp, ok := s.ceil(start)
+		if !ok || sp.start.cmp(end) > 0 && (end == maxIPNum || sp.start != end.next()) {
+			break
+		}
+		s.delete(sp)
+		if sp.end.cmp(end) > 0 {
+			end = sp.end
+		}
+	}
+	s.insert(span{start, end})
+	return s.total.minus(before)
+}
+
+// remove removes the addresses from start to end, splitting any spans they
+// cut, and returns the number that were present.
+func (s *spanTree) remove(start, end ipNum) ipNum {
+	before := s.total
+	if sp, ok := s.floor(start); ok && sp.end.cmp(start) >= 0 && sp.start.cmp(start) < 0 {
+		s.delete(sp)
+		s.insert(span{sp.start, start.prev()})
+		if sp.end.cmp(end) > 0 {
+			s.insert(span{end.next(), sp.end})
+			return before.minus(s.total)
+		}
+	}
+	for {
+		sp, ok := s.ceil(start)
+		if !ok || sp.start.cmp(end) > 0 {
+			break
+		}
+		s.delete(sp)
+		if sp.end.cmp(end) > 0 {
+			s.insert(span{end.next(), sp.end})
+			break
+		}
+	}
+	return before.minus(s.total)
+}
+
+// clip returns the parts of the spans that lie from start to end, in order.
+// It takes O(log n) time for each span returned.
+func (s *spanTree) clip(start, end ipNum) []span {
+	var spans []span
+	next := start
+	if sp, ok := s.find(start); ok {
+		next = sp.start
+	}
+	for {
+		sp, ok := s.ceil(next)
+		if !ok || sp.start.cmp(end) > 0 {
+			return spans
+		}
+		if sp.start.cmp(start) < 0 {
+			sp.start = start
+		}
+		last := sp.end
+		if sp.end.cmp(end) > 0 {
+			sp.end = end
+		}
+		spans = append(spans, sp)
+		if last.cmp(end) >= 0 || last == maxIPNum {
+			return spans
+		}
+		next = last.next()
+	}
+}
+
+// each calls fn with every span in order.
+func (s *spanTree) each(fn func(span)) {
+	var walk func(*treapNode)
+	walk = func(t *treapNode) {
+		if t == nil {
+			return
+		}
+		walk(t.left)
+		fn(t.span)
+		walk(t.right)
+	}
+	walk(s.root)
+}
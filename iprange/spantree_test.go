@@ -0,0 +1,104 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"math/rand"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+// checkSpanTree walks the tree and compares it with the expected members of
+// [0, n).
+func checkSpanTree(t *testing.T, s *spanTree, want map[uint64]bool, n uint64) {
+	var spans []span
+	s.each(func(sp span) { spans = append(spans, sp) })
+	tt.TestEqual(t, len(spans), s.spans)
+
+	// spans are sorted, disjoint and never adjacent
+	for i := 1; i < len(spans); i++ {
+		if spans[i-1].end.next().cmp(spans[i].start) >= 0 {
+			t.Fatalf("spans %v and %v overlap or touch", spans[i-1], spans[i])
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		_, ok := s.find(ipNum{0, i})
+		if ok != want[i] {
+			t.Fatalf("membership of %d is %v, want %v", i, ok, want[i])
+		}
+	}
+	tt.TestEqual(t, s.total, ipNum{0, uint64(len(want))})
+}
+
+func TestSpanTreeRandom(t *testing.T) {
+	const n = 200
+	r := rand.New(rand.NewSource(1))
+	s := &spanTree{}
+	want := make(map[uint64]bool)
+	for i := 0; i < 2000; i++ {
+		a, b := uint64(r.Intn(n)), uint64(r.Intn(n))
+		if a > b {
+			a, b = b, a
+		}
+		if b-a > 20 {
+			b = a + uint64(r.Intn(20))
+		}
+		var changed uint64
+		add := r.Intn(2) == 0
+		for j := a; j <= b; j++ {
+			if want[j] != add {
+				changed++
+			}
+			if add {
+				want[j] = true
+			} else {
+				delete(want, j)
+			}
+		}
+		var got ipNum
+		if add {
+			got = s.add(ipNum{0, a}, ipNum{0, b})
+		} else {
+			got = s.remove(ipNum{0, a}, ipNum{0, b})
+		}
+		tt.TestEqual(t, got, ipNum{0, changed})
+		if i%100 == 0 {
+			checkSpanTree(t, s, want, n)
+		}
+	}
+	checkSpanTree(t, s, want, n)
+}
+
+func TestSpanTreeEdges(t *testing.T) {
+	// spans touching the ends of the address space do not wrap around
+	s := &spanTree{}
+	s.add(maxIPNum.prev(), maxIPNum)
+	s.add(ipNum{}, ipNum{0, 1})
+	tt.TestEqual(t, s.spans, 2)
+	s.remove(maxIPNum, maxIPNum)
+	_, ok := s.find(maxIPNum)
+	tt.TestEqual(t, ok, false)
+	_, ok = s.find(maxIPNum.prev())
+	tt.TestEqual(t, ok, true)
+	s.remove(ipNum{}, ipNum{})
+	tt.TestEqual(t, s.total, ipNum{0, 2})
+}
+
+func TestSpanTreeClip(t *testing.T) {
+	s := &spanTree{}
+	s.add(ipNum{0, 2}, ipNum{0, 4})
+	s.add(ipNum{0, 8}, ipNum{0, 8})
+	s.add(ipNum{0, 10}, ipNum{0, 20})
+	tt.TestEqual(t, s.clip(ipNum{0, 3}, ipNum{0, 12}), []span{
+		{ipNum{0, 3}, ipNum{0, 4}},
+		{ipNum{0, 8}, ipNum{0, 8}},
+		{ipNum{0, 10}, ipNum{0, 12}},
+	})
+	tt.TestEqual(t, s.clip(ipNum{0, 5}, ipNum{0, 7}), []span(nil))
+	tt.TestEqual(t, s.clip(ipNum{0, 12}, ipNum{0, 14}), []span{{ipNum{0, 12}, ipNum{0, 14}}})
+
+	// the last span may end at the top of the address space
+	s.add(maxIPNum.prev(), maxIPNum)
+	tt.TestEqual(t, s.clip(ipNum{0, 21}, maxIPNum), []span{{maxIPNum.prev(), maxIPNum}})
+}
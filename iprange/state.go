@@ -0,0 +1,438 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An allocator's state can be saved with json.Marshal or MarshalBinary, and
+// restored into a new IPRangeAllocator with json.Unmarshal or
+// UnmarshalBinary. To keep allocations across crashes without saving the whole
+// state after every change, set a journal: every change is appended to it
+// before it is made. A restart then restores the last snapshot and replays
+// the journal written since. To checkpoint, save a snapshot and then start a
+// new, empty journal.
+//
+//	a := new(iprange.IPRangeAllocator)
+//	json.Unmarshal(snapshot, a)
+//	n, err := a.Replay(journal)
+//	journal.Truncate(n)
+//	a.SetJournal(journal)
+
+// allocatorJSON is the JSON form of an allocator. Excluded holds the
+// subtracted ranges, and Reserved the allocated or reserved ones, each as
+// few ranges as possible. Leases holds the owners of leased addresses.
+type allocatorJSON struct {
+	Range    string      `json:"range"`
+	Excluded []string    `json:"excluded,omitempty"`
+	Reserved []string    `json:"reserved,omitempty"`
+	Leases   []leaseJSON `json:"leases,omitempty"`
+}
+
+type leaseJSON struct {
+	IP      string     `json:"ip"`
+	Owner   string     `json:"owner"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a *IPRangeAllocator) MarshalJSON() ([]byte, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.ipRange == nil {
+		return nil, errors.New("the allocator has no range")
+	}
+	excluded, reserved := a.stateSpans()
+	state := allocatorJSON{Range: a.ipRange.String()}
+	for _, sp := range excluded {
+		state.Excluded = append(state.Excluded, sp.ipRange().String())
+	}
+	for _, sp := range reserved {
+		state.Reserved = append(state.Reserved, sp.ipRange().String())
+	}
+	for _, l := range a.stateLeases() {
+		lj := leaseJSON{IP: l.ip.IP().String(), Owner: l.owner}
+		if !l.expires.IsZero() {
+			expires := l.expires
+			lj.Expires = &expires
+		}
+		state.Leases = append(state.Leases, lj)
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, replacing the allocator's range
+// and allocations with the saved ones.
+func (a *IPRangeAllocator) UnmarshalJSON(data []byte) error {
+	var state allocatorJSON
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	ipr, err := ParseIPRange(state.Range)
+	if err != nil {
+		return err
+	}
+	parse := func(list []string) ([]span, error) {
+		spans := make([]span, 0, len(list))
+		for _, s := range list {
+			r, err := ParseIPRange(s)
+			if err != nil {
+				return nil, err
+			}
+			spans = append(spans, span{ipToNum(r.Start), ipToNum(r.End)})
+		}
+		return spans, nil
+	}
+	excluded, err := parse(state.Excluded)
+	if err != nil {
+		return err
+	}
+	reserved, err := parse(state.Reserved)
+	if err != nil {
+		return err
+	}
+	leases := make([]*lease, 0, len(state.Leases))
+	for _, lj := range state.Leases {
+		ip := net.ParseIP(lj.IP)
+		if ip == nil {
+			return fmt.Errorf("failed to parse the IP address %q", lj.IP)
+		}
+		l := &lease{ip: ipToNum(ip), owner: lj.Owner, index: -1}
+		if lj.Expires != nil {
+			l.expires = *lj.Expires
+		}
+		leases = append(leases, l)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.restore(ipr, excluded, reserved, leases)
+}
+
+// binaryVersion prefixes the binary form of an allocator. The first version
+// had no leases, and is still accepted.
+const (
+	binaryVersion   = "ipra\x02"
+	binaryVersionV1 = "ipra\x01"
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler. The binary form holds
+// the range, its mask, the excluded and reserved spans as 16 byte addresses,
+// and the leases.
+func (a *IPRangeAllocator) MarshalBinary() ([]byte, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.ipRange == nil {
+		return nil, errors.New("the allocator has no range")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(binaryVersion)
+	buf.Write(a.start.IP())
+	buf.Write(a.end.IP())
+	ones, bits := a.ipRange.Mask.Size()
+	buf.Write([]byte{byte(ones), byte(bits)})
+
+	excluded, reserved := a.stateSpans()
+	var n [binary.MaxVarintLen64]byte
+	for _, spans := range [][]span{excluded, reserved} {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(spans)))])
+		for _, sp := range spans {
+			buf.Write(sp.start.IP())
+			buf.Write(sp.end.IP())
+		}
+	}
+
+	// each lease is its address, the length and bytes of its owner, and its
+	// expiry in Unix nanoseconds, or zero
+	leases := a.stateLeases()
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(leases)))])
+	for _, l := range leases {
+		buf.Write(l.ip.IP())
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(l.owner)))])
+		buf.WriteString(l.owner)
+		var nanos int64
+		if !l.expires.IsZero() {
+			nanos = l.expires.UnixNano()
+		}
+		buf.Write(n[:binary.PutVarint(n[:], nanos)])
+	}
+	return buf.Bytes(), nil
+}
+
+// errInvalidState is returned when restoring from malformed binary state.
+var errInvalidState = errors.New("invalid allocator state")
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, replacing the
+// allocator's range and allocations with the saved ones.
+func (a *IPRangeAllocator) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	version := make([]byte, len(binaryVersion))
+	if _, err := io.ReadFull(r, version); err != nil {
+		return errInvalidState
+	}
+	if string(version) != binaryVersion && string(version) != binaryVersionV1 {
+		return errInvalidState
+	}
+	readIP := func() (net.IP, error) {
+		ip := make(net.IP, net.IPv6len)
+		_, err := io.ReadFull(r, ip)
+		return ip, err
+	}
+	start, err := readIP()
+	if err != nil {
+		return errInvalidState
+	}
+	end, err := readIP()
+	if err != nil {
+		return errInvalidState
+	}
+	ipr := &IPRange{Start: start, End: end}
+	var mask [2]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return errInvalidState
+	}
+	if mask[1] != 0 {
+		if ipr.Mask = net.CIDRMask(int(mask[0]), int(mask[1])); ipr.Mask == nil {
+			return errInvalidState
+		}
+	}
+
+	var lists [2][]span
+	for i := range lists {
+		n, err := binary.ReadUvarint(r)
+		// each span takes 32 bytes, which bounds a valid count
+		if err != nil || n > uint64(r.Len()/32) {
+			return errInvalidState
+		}
+		for j := uint64(0); j < n; j++ {
+			s, _ := readIP()
+			e, _ := readIP()
+			lists[i] = append(lists[i], span{ipToNum(s), ipToNum(e)})
+		}
+	}
+
+	var leases []*lease
+	if string(version) == binaryVersion {
+		n, err := binary.ReadUvarint(r)
+		// each lease takes at least 18 bytes
+		if err != nil || n > uint64(r.Len()/18) {
+			return errInvalidState
+		}
+		for i := uint64(0); i < n; i++ {
+			ip, err := readIP()
+			if err != nil {
+				return errInvalidState
+			}
+			size, err := binary.ReadUvarint(r)
+			if err != nil || size > uint64(r.Len()) {
+				return errInvalidState
+			}
+			owner := make([]byte, size)
+			io.ReadFull(r, owner)
+			nanos, err := binary.ReadVarint(r)
+			if err != nil {
+				return errInvalidState
+			}
+			l := &lease{ip: ipToNum(ip), owner: string(owner), index: -1}
+			if nanos != 0 {
+				l.expires = time.Unix(0, nanos)
+			}
+			leases = append(leases, l)
+		}
+	}
+	if r.Len() != 0 {
+		return errInvalidState
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.restore(ipr, lists[0], lists[1], leases)
+}
+
+// stateSpans returns the excluded spans, and the used spans less the
+// excluded ones.
+func (a *IPRangeAllocator) stateSpans() (excluded, reserved []span) {
+	a.excluded.each(func(sp span) { excluded = append(excluded, sp) })
+	all := &IPSet{}
+	a.used.each(func(sp span) { all.spans = append(all.spans, sp) })
+	return excluded, all.Difference(&IPSet{spans: excluded}).spans
+}
+
+// stateLeases returns the leases in address order.
+func (a *IPRangeAllocator) stateLeases() []*lease {
+	nums := make([]ipNum, 0, len(a.leases))
+	for n := range a.leases {
+		nums = append(nums, n)
+	}
+	sort.Sort(byIPNum(nums))
+	leases := make([]*lease, len(nums))
+	for i, n := range nums {
+		leases[i] = a.leases[n]
+	}
+	return leases
+}
+
+// restore replaces the allocator's state, checking that every span is
+// within the range and that every leased address is in use.
+func (a *IPRangeAllocator) restore(ipr *IPRange, excluded, reserved []span, leases []*lease) error {
+	start, end := ipToNum(ipr.Start), ipToNum(ipr.End)
+	if end.cmp(start) < 0 {
+		return fmt.Errorf("the end of the range cannot be less than the start of the range")
+	}
+	for _, spans := range [][]span{excluded, reserved} {
+		for _, sp := range spans {
+			if sp.start.cmp(sp.end) > 0 || sp.start.cmp(start) < 0 || sp.end.cmp(end) > 0 {
+				return fmt.Errorf("the range %s is not within %s", sp.ipRange(), ipr)
+			}
+		}
+	}
+	used := newIPSet(append(append([]span(nil), excluded...), reserved...))
+	for _, l := range leases {
+		if !used.Contains(l.ip.IP()) {
+			return fmt.Errorf("the leased address %s is not in use", l.ip.IP())
+		}
+	}
+	a.init(ipr)
+	for _, sp := range excluded {
+		a.use(sp.start, sp.end)
+		a.excluded.add(sp.start, sp.end)
+	}
+	for _, sp := range reserved {
+		a.use(sp.start, sp.end)
+	}
+	for _, l := range leases {
+		a.setLease(l.ip, l)
+	}
+	return nil
+}
+
+// Journal record types. Each record is a line holding the type, a space and
+// the affected range. A use record for an address allocated with a lease is
+// followed by a space, the quoted owner and the expiry in Unix nanoseconds,
+// or zero if it has none.
+const (
+	journalUse     = '+'
+	journalRelease = '-'
+	journalExclude = 'x'
+)
+
+// SetJournal sets a writer, usually a file opened for appending, to which
+// every later change is written before it is made. If the writer has a Sync
+// method, such as *os.File, it is called after each record so that the
+// record is durable. A nil writer stops journaling. Setting a journal clears
+// any earlier journal error.
+func (a *IPRangeAllocator) SetJournal(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.journal = w
+	a.err = nil
+}
+
+// Err returns the first error writing to the journal. Once writing fails,
+// the allocator refuses further changes, as they could not be recovered;
+// Allocate returns nil, and Reserve, Release and Subtract do nothing.
+func (a *IPRangeAllocator) Err() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.err
+}
+
+// record writes a change, with any extra arguments, to the journal, and
+// returns whether it may be made.
+func (a *IPRangeAllocator) record(op byte, sp span, args string) bool {
+	if a.err != nil {
+		return false
+	}
+	if a.journal == nil {
+		return true
+	}
+	line := string(op) + " " + sp.ipRange().String()
+	if args != "" {
+		line += " " + args
+	}
+	line += "\n"
+	if _, err := io.WriteString(a.journal, line); err != nil {
+		a.err = err
+		return false
+	}
+	if s, ok := a.journal.(interface {
+		Sync() error
+	}); ok {
+		if err := s.Sync(); err != nil {
+			a.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// Replay applies the changes recorded in a journal, in order, and returns the
+// length of the complete records read. A final line without a newline is the
+// sign of a crash part way through writing a record, so that change was never
+// made and is skipped; the journal should be truncated to the returned length
+// before more records are appended to it. Replayed changes are not written to
+// the allocator's own journal.
+func (a *IPRangeAllocator) Replay(r io.Reader) (int64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var n int64
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) < 3 || line[1] != ' ' {
+			return n, fmt.Errorf("journal line %d is malformed: %q", lineNo, line)
+		}
+		rng, args := line[2:], ""
+		if i := strings.IndexByte(rng, ' '); i >= 0 {
+			rng, args = rng[:i], rng[i+1:]
+		}
+		ipr, err := ParseIPRange(rng)
+		if err != nil {
+			return n, fmt.Errorf("journal line %d: %v", lineNo, err)
+		}
+		start, end := ipToNum(ipr.Start), ipToNum(ipr.End)
+		if start.cmp(a.start) < 0 || end.cmp(a.end) > 0 {
+			return n, fmt.Errorf("journal line %d: %s is not within %s", lineNo, ipr, a.ipRange)
+		}
+		switch line[0] {
+		case journalUse:
+			a.use(start, end)
+			if args != "" {
+				l, err := parseLease(args)
+				if err != nil || start != end {
+					return n, fmt.Errorf("journal line %d has a malformed lease: %q", lineNo, line)
+				}
+				a.setLease(start, l)
+			}
+		case journalRelease:
+			a.unrecordedReleaseSpan(start, end)
+		case journalExclude:
+			a.use(start, end)
+			a.excluded.add(start, end)
+		default:
+			return n, fmt.Errorf("journal line %d has unknown type %q", lineNo, line[0])
+		}
+		n += int64(len(line)) + 1
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+// newTestAllocator returns an allocator with a mix of subtracted, reserved
+// and allocated addresses.
+func newTestAllocator(t *testing.T) *IPRangeAllocator {
+	ipr, err := ParseIPRange("10.0.0.0-10.0.0.255/24")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	excluded, err := ParseIPRange("10.0.0.0-15")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(excluded)
+	alloc.Reserve(net.ParseIP("10.0.0.16"))
+	alloc.Reserve(net.ParseIP("10.0.0.200"))
+	for i := 0; i < 20; i++ {
+		tt.TestNotEqual(t, alloc.Allocate(), nil)
+	}
+	return alloc
+}
+
+// allocatorSpans returns the used and excluded spans of an allocator.
+func allocatorSpans(a *IPRangeAllocator) (used, excluded []span) {
+	a.used.each(func(sp span) { used = append(used, sp) })
+	a.excluded.each(func(sp span) { excluded = append(excluded, sp) })
+	return
+}
+
+func TestAllocatorJSON(t *testing.T) {
+	alloc := newTestAllocator(t)
+	data, err := json.Marshal(alloc)
+	tt.TestExpectSuccess(t, err)
+
+	restored := new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, json.Unmarshal(data, restored))
+	tt.TestEqual(t, restored.IPRange().String(), "10.0.0.0-10.0.0.255/24")
+	tt.TestEqual(t, restored.Remaining(), alloc.Remaining())
+	used, excluded := allocatorSpans(alloc)
+	rused, rexcluded := allocatorSpans(restored)
+	tt.TestEqual(t, rused, used)
+	tt.TestEqual(t, rexcluded, excluded)
+
+	// the JSON form lists the excluded range apart from the reservations
+	var state allocatorJSON
+	tt.TestExpectSuccess(t, json.Unmarshal(data, &state))
+	tt.TestEqual(t, state.Excluded, []string{"10.0.0.0-10.0.0.15"})
+
+	bad := []string{
+		`{"range": "10.0.0.0-255", "reserved": ["10.0.1.1"]}`,
+		`{"range": "10.0.0.0-255", "excluded": ["10.0.0.x"]}`,
+		`{"range": "bogus"}`,
+	}
+	for _, b := range bad {
+		tt.TestExpectError(t, json.Unmarshal([]byte(b), new(IPRangeAllocator)))
+	}
+}
+
+func TestAllocatorBinary(t *testing.T) {
+	alloc := newTestAllocator(t)
+	data, err := alloc.MarshalBinary()
+	tt.TestExpectSuccess(t, err)
+
+	restored := new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, restored.UnmarshalBinary(data))
+	tt.TestEqual(t, restored.IPRange().String(), "10.0.0.0-10.0.0.255/24")
+	used, excluded := allocatorSpans(alloc)
+	rused, rexcluded := allocatorSpans(restored)
+	tt.TestEqual(t, rused, used)
+	tt.TestEqual(t, rexcluded, excluded)
+
+	// IPv6 ranges without a mask work too
+	ipr, err := ParseIPRange("2001:db8::-ffff")
+	tt.TestExpectSuccess(t, err)
+	v6 := NewAllocator(ipr)
+	v6.Allocate()
+	data6, err := v6.MarshalBinary()
+	tt.TestExpectSuccess(t, err)
+	tt.TestExpectSuccess(t, restored.UnmarshalBinary(data6))
+	tt.TestEqual(t, restored.IPRange().String(), "2001:db8::-2001:db8::ffff")
+	tt.TestEqual(t, restored.Remaining(), int64(0xffff))
+
+	for _, n := range []int{0, 10, len(data) - 1} {
+		tt.TestExpectError(t, restored.UnmarshalBinary(data[:n]))
+	}
+}
+
+func TestAllocatorJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iprange")
+	tt.TestExpectSuccess(t, err)
+	defer os.RemoveAll(dir)
+
+	ipr, err := ParseIPRange("10.0.0.0-10.0.0.255/24")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	snapshot, err := json.Marshal(alloc)
+	tt.TestExpectSuccess(t, err)
+
+	journal, err := os.OpenFile(dir+"/journal", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	tt.TestExpectSuccess(t, err)
+	alloc.SetJournal(journal)
+	excluded, err := ParseIPRange("10.0.0.0-9")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(excluded)
+	var ips []net.IP
+	for i := 0; i < 5; i++ {
+		ips = append(ips, alloc.Allocate())
+	}
+	alloc.Release(ips[0])
+	alloc.Release(net.ParseIP("10.0.0.5"))
+	alloc.Release(net.ParseIP("192.168.0.1"))
+	journal.Close()
+
+	// simulate a crash part way through writing a record
+	journal, err = os.OpenFile(dir+"/journal", os.O_RDWR|os.O_APPEND, 0644)
+	tt.TestExpectSuccess(t, err)
+	_, err = journal.WriteString("+ 10.0.")
+	tt.TestExpectSuccess(t, err)
+	_, err = journal.Seek(0, 0)
+	tt.TestExpectSuccess(t, err)
+
+	restored := new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, json.Unmarshal(snapshot, restored))
+	n, err := restored.Replay(journal)
+	tt.TestExpectSuccess(t, err)
+	used, excl := allocatorSpans(alloc)
+	rused, rexcl := allocatorSpans(restored)
+	tt.TestEqual(t, rused, used)
+	tt.TestEqual(t, rexcl, excl)
+
+	// after truncating the torn record, the journal can be appended to
+	tt.TestExpectSuccess(t, journal.Truncate(n))
+	restored.SetJournal(journal)
+	ip := restored.Allocate()
+	journal.Close()
+	again := new(IPRangeAllocator)
+	tt.TestExpectSuccess(t, json.Unmarshal(snapshot, again))
+	data, err := ioutil.ReadFile(dir + "/journal")
+	tt.TestExpectSuccess(t, err)
+	_, err = again.Replay(bytes.NewReader(data))
+	tt.TestExpectSuccess(t, err)
+	tt.TestEqual(t, again.Remaining(), restored.Remaining())
+	_, ok := again.used.find(ipToNum(ip))
+	tt.TestEqual(t, ok, true)
+
+	_, err = again.Replay(bytes.NewBufferString("? 10.0.0.1\n"))
+	tt.TestExpectError(t, err)
+	_, err = again.Replay(bytes.NewBufferString("+ 10.0.1.1\n"))
+	tt.TestExpectError(t, err)
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAllocatorJournalFailure(t *testing.T) {
+	ipr, err := ParseIPRange("10.0.0.0-255")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	alloc.SetJournal(failingWriter{})
+
+	// changes that cannot be journaled are not made
+	tt.TestEqual(t, alloc.Allocate(), nil)
+	tt.TestEqual(t, alloc.Err().Error(), "disk full")
+	alloc.Reserve(net.ParseIP("10.0.0.1"))
+	tt.TestEqual(t, alloc.Remaining(), int64(256))
+
+	alloc.SetJournal(nil)
+	tt.TestEqual(t, alloc.Err(), nil)
+	tt.TestNotEqual(t, alloc.Allocate(), nil)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"container/list"
+)
+
+// Strategy determines which free address an IPRangeAllocator hands out next.
+type Strategy int
+
+const (
+	// StrategyRandom picks a random address, taking the next free one if it
+	// is in use. It is the default.
+	StrategyRandom Strategy = iota
+
+	// StrategySequential picks the first free address after the one last
+	// allocated, wrapping around to the start of the range.
+	StrategySequential
+
+	// StrategyLowestFree picks the lowest free address.
+	StrategyLowestFree
+
+	// StrategyLeastRecentlyReleased hands out every address that has never
+	// been allocated first, in order, and then the addresses that were
+	// released longest ago, so that a released address is reused as late as
+	// possible.
+	StrategyLeastRecentlyReleased
+)
+
+// String returns the name of the strategy.
+func (s Strategy) String() string {
+	switch s {
+	case StrategyRandom:
+		return "random"
+	case StrategySequential:
+		return "sequential"
+	case StrategyLowestFree:
+		return "lowest-free"
+	case StrategyLeastRecentlyReleased:
+		return "least-recently-released"
+	}
+	return "unknown"
+}
+
+// SetStrategy sets how the allocator picks addresses, starting afresh from
+// the start of the range. The strategy is not part of the allocator's saved
+// state, and is kept when state is restored or replayed into it.
+func (a *IPRangeAllocator) SetStrategy(s Strategy) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.strategy = s
+	a.resetStrategy()
+}
+
+// resetStrategy clears the strategy's state.
+func (a *IPRangeAllocator) resetStrategy() {
+	a.cursor = a.start
+	a.fresh = a.start
+	a.stale = false
+	a.released = list.New()
+	a.releasedAt = make(map[ipNum]*list.Element)
+	a.releasedSet = spanTree{}
+}
+
+// queueReleased adds a free address to the end of the queue of released
+// addresses.
+func (a *IPRangeAllocator) queueReleased(n ipNum) {
+	if e, ok := a.releasedAt[n]; ok {
+		a.released.MoveToBack(e)
+		return
+	}
+	a.releasedAt[n] = a.released.PushBack(n)
+	a.releasedSet.add(n, n)
+}
+
+// unqueueReleased removes the addresses from start to end from the queue of
+// released addresses, as they are no longer free.
+func (a *IPRangeAllocator) unqueueReleased(start, end ipNum) {
+	for _, sp := range a.releasedSet.clip(start, end) {
+		for n := sp.start; ; n = n.next() {
+			a.released.Remove(a.releasedAt[n])
+			delete(a.releasedAt, n)
+			if n == sp.end {
+				break
+			}
+		}
+	}
+	a.releasedSet.remove(start, end)
+}
+
+// pick returns the next address to allocate. There must be a free address.
+func (a *IPRangeAllocator) pick() ipNum {
+	switch a.strategy {
+	case StrategySequential:
+		return a.nextAvailable(a.cursor)
+	case StrategyLowestFree:
+		return a.nextAvailable(a.start)
+	case StrategyLeastRecentlyReleased:
+		// never allocated addresses come first, and they run out once the
+		// search for one wraps around
+		if !a.stale {
+			if ip := a.nextAvailable(a.fresh); ip.cmp(a.fresh) >= 0 {
+				return ip
+			}
+			a.stale = true
+		}
+		if e := a.released.Front(); e != nil {
+			return e.Value.(ipNum)
+		}
+		return a.nextAvailable(a.start)
+	}
+	// get a random address within the range to start with, and take the next
+	// available one
+	return a.nextAvailable(a.start.plus(randomBelow(a.size)))
+}
+
+// picked updates the strategy's state once ip is allocated.
+func (a *IPRangeAllocator) picked(ip ipNum) {
+	switch a.strategy {
+	case StrategySequential:
+		a.cursor = ip.next()
+		if ip == a.end {
+			a.cursor = a.start
+		}
+	case StrategyLeastRecentlyReleased:
+		if !a.stale && ip.cmp(a.fresh) >= 0 {
+			a.fresh = ip.next()
+			a.stale = ip == a.end
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package iprange
+
+import (
+	"net"
+	"testing"
+
+	tt "github.com/apcera/util/testtool"
+)
+
+// newStrategyAllocator returns an allocator for 10.0.0.1-10.0.0.8 using s.
+func newStrategyAllocator(t *testing.T, s Strategy) *IPRangeAllocator {
+	ipr, err := ParseIPRange("10.0.0.1-8")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	alloc.SetStrategy(s)
+	return alloc
+}
+
+// allocateN allocates n addresses and returns them as strings.
+func allocateN(t *testing.T, alloc *IPRangeAllocator, n int) []string {
+	ips := make([]string, n)
+	for i := range ips {
+		ip := alloc.Allocate()
+		tt.TestNotEqual(t, ip, nil)
+		ips[i] = ip.String()
+	}
+	return ips
+}
+
+func TestStrategySequential(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategySequential)
+	alloc.Reserve(net.ParseIP("10.0.0.2"))
+	tt.TestEqual(t, allocateN(t, alloc, 3), []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"})
+
+	// released addresses are not reused until the cursor wraps around
+	alloc.Release(net.ParseIP("10.0.0.1"))
+	tt.TestEqual(t, allocateN(t, alloc, 5), []string{"10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.1"})
+	tt.TestEqual(t, alloc.Allocate(), nil)
+}
+
+func TestStrategyLowestFree(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLowestFree)
+	tt.TestEqual(t, allocateN(t, alloc, 3), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	alloc.Release(net.ParseIP("10.0.0.2"))
+	tt.TestEqual(t, allocateN(t, alloc, 2), []string{"10.0.0.2", "10.0.0.4"})
+}
+
+func TestStrategyLeastRecentlyReleased(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyLeastRecentlyReleased)
+	tt.TestEqual(t, allocateN(t, alloc, 4), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"})
+
+	// addresses never used come before released ones
+	alloc.Release(net.ParseIP("10.0.0.3"))
+	alloc.Release(net.ParseIP("10.0.0.1"))
+	tt.TestEqual(t, allocateN(t, alloc, 4), []string{"10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8"})
+
+	// then released ones, oldest first, skipping any reserved since
+	alloc.Release(net.ParseIP("10.0.0.2"))
+	alloc.Reserve(net.ParseIP("10.0.0.1"))
+	alloc.Release(net.ParseIP("10.0.0.7"))
+	tt.TestEqual(t, allocateN(t, alloc, 3), []string{"10.0.0.3", "10.0.0.2", "10.0.0.7"})
+	tt.TestEqual(t, alloc.Allocate(), nil)
+	tt.TestEqual(t, alloc.released.Len(), 0)
+
+	// an address released again is queued only once, at its latest release
+	alloc.Release(net.ParseIP("10.0.0.2"))
+	alloc.Release(net.ParseIP("10.0.0.4"))
+	alloc.Reserve(net.ParseIP("10.0.0.2"))
+	alloc.Release(net.ParseIP("10.0.0.2"))
+	tt.TestEqual(t, len(alloc.releasedAt), 2)
+	tt.TestEqual(t, allocateN(t, alloc, 2), []string{"10.0.0.4", "10.0.0.2"})
+}
+
+func TestStrategyLeastRecentlyReleasedBounded(t *testing.T) {
+	ipr, err := ParseIPRange("fd00::/64")
+	tt.TestExpectSuccess(t, err)
+	alloc := NewAllocator(ipr)
+	alloc.SetStrategy(StrategyLeastRecentlyReleased)
+
+	// reserving addresses takes them out of the queue, so churn while fresh
+	// addresses remain does not grow it
+	for i := 0; i < 1000; i++ {
+		ip := alloc.Allocate()
+		alloc.Release(ip)
+		alloc.Reserve(ip)
+	}
+	tt.TestEqual(t, alloc.released.Len(), 0)
+	tt.TestEqual(t, len(alloc.releasedAt), 0)
+
+	// subtracting a range unqueues every address in it
+	for _, s := range []string{"fd00::1", "fd00::2", "fd00::3"} {
+		alloc.Release(net.ParseIP(s))
+	}
+	sub, err := ParseIPRange("fd00::/126")
+	tt.TestExpectSuccess(t, err)
+	alloc.Subtract(sub)
+	tt.TestEqual(t, alloc.released.Len(), 0)
+}
+
+func TestStrategyRandom(t *testing.T) {
+	alloc := newStrategyAllocator(t, StrategyRandom)
+	seen := make(map[string]bool)
+	for _, ip := range allocateN(t, alloc, 8) {
+		seen[ip] = true
+	}
+	tt.TestEqual(t, len(seen), 8)
+	tt.TestEqual(t, alloc.Allocate(), nil)
+	tt.TestEqual(t, StrategyLeastRecentlyReleased.String(), "least-recently-released")
+}
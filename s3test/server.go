@@ -0,0 +1,949 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+// Package s3test provides an in-process fake of the S3 API for testing code
+// that uses s3util without network access or real credentials.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apcera/util/internal/sigv4"
+	"github.com/apcera/util/s3util"
+)
+
+// Credentials accepted by a Server when none are given in its Options.
+var DefaultCredentials = s3util.Credentials{
+	AccessKeyID:     "AKIDS3TEST",
+	SecretAccessKey: "s3test-secret-key",
+}
+
+// Options configures a Server. The zero value is usable.
+type Options struct {
+	// Region is the region requests must be signed for. It defaults to
+	// s3util.DefaultRegion.
+	Region string
+
+	// Credentials are the only credentials the server accepts. They default
+	// to DefaultCredentials.
+	Credentials *s3util.Credentials
+
+	// Dir, when set, is where object contents are stored instead of in
+	// memory. The directory must exist and is not removed by Close.
+	Dir string
+
+	// Verbose logs every request to stdout.
+	Verbose bool
+}
+
+// A Server is a fake S3 service backed by an httptest.Server. Buckets are
+// addressed path style, so clients should be configured with the Config
+// method. It verifies request signatures and content hashes and supports
+// object PUT, GET, HEAD, DELETE, copy, batch delete, ListObjectsV2 and
+// multipart uploads.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	region  string
+	creds   s3util.Credentials
+	dir     string
+	verbose bool
+	srv     *httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*object
+	uploads  map[string]*upload
+	nextID   int
+	failures []failure
+}
+
+type object struct {
+	size         int64
+	etag         string
+	contentType  string
+	lastModified time.Time
+	header       http.Header
+
+	// data holds the contents when the server keeps them in memory;
+	// otherwise they are in the file named by path.
+	data []byte
+	path string
+}
+
+type upload struct {
+	bucket string
+	key    string
+	header http.Header
+	parts  map[int]*object
+}
+
+type failure struct {
+	method string
+	code   int
+}
+
+// NewServer starts a new fake S3 server. It must be closed with Close.
+func NewServer(opts *Options) *Server {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	s := &Server{
+		region:  o.Region,
+		creds:   DefaultCredentials,
+		dir:     o.Dir,
+		verbose: o.Verbose,
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+	if s.region == "" {
+		s.region = s3util.DefaultRegion
+	}
+	if o.Credentials != nil {
+		s.creds = *o.Credentials
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// CreateBucket adds an empty bucket. Requests to buckets that do not exist
+// fail with NoSuchBucket.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[name] == nil {
+		s.buckets[name] = make(map[string]*object)
+	}
+}
+
+// Config returns an s3util.Config for a bucket on this server, creating the
+// bucket if necessary.
+func (s *Server) Config(bucket string) *s3util.Config {
+	s.CreateBucket(bucket)
+	creds := s3util.StaticCredentials(s.creds)
+	return &s3util.Config{
+		Bucket:      bucket,
+		Permission:  "private",
+		Quiet:       true,
+		Region:      s.region,
+		Endpoint:    s.URL,
+		PathStyle:   true,
+		Credentials: &creds,
+	}
+}
+
+// PutObject stores an object directly, bypassing the HTTP API. The bucket
+// is created if necessary.
+func (s *Server) PutObject(bucket, key string, data []byte) error {
+	s.CreateBucket(bucket)
+	obj, err := s.newObject(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = obj
+	return nil
+}
+
+// Object returns the contents of a stored object.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return nil, false
+	}
+	data, err := s.read(obj)
+	return data, err == nil
+}
+
+// Header returns the headers stored with an object, such as Content-Type,
+// Cache-Control and X-Amz-Meta-*.
+func (s *Server) Header(bucket, key string) (http.Header, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.buckets[bucket][key]
+	if obj == nil {
+		return nil, false
+	}
+	return cloneHeader(obj.header), true
+}
+
+// Keys returns the sorted keys of the objects in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of multipart uploads that have been started
+// but neither completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// FailNext makes the next request with the given method, or any method if
+// it is empty, fail with the given status code. Calls queue up, which allows
+// testing retries.
+func (s *Server) FailNext(method string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{method: method, code: code})
+}
+
+// s3Error is the XML error document returned by S3.
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	b, _ := xml.Marshal(s3Error{Code: code, Message: message, Resource: r.URL.Path, RequestID: "s3test"})
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.verbose {
+		fmt.Printf("%s \"%s %s\"\n", r.RemoteAddr, r.Method, r.URL)
+	}
+
+	if code := s.injectedFailure(r.Method); code != 0 {
+		writeError(w, r, code, "InjectedFailure", "failure injected by s3test")
+		return
+	}
+
+	signer := &sigv4.Signer{
+		AccessKeyID:     s.creds.AccessKeyID,
+		SecretAccessKey: s.creds.SecretAccessKey,
+		Region:          s.region,
+		Service:         "s3",
+	}
+	if err := signer.Verify(r, time.Now()); err != nil {
+		writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if ph := r.Header.Get("X-Amz-Content-Sha256"); ph != "" && ph != s3util.UnsignedPayload {
+		h := sha256.Sum256(body)
+		if ph != hex.EncodeToString(h[:]) {
+			writeError(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+				"the provided x-amz-content-sha256 does not match the body")
+			return
+		}
+	}
+	if cm := r.Header.Get("Content-Md5"); cm != "" {
+		h := md5.Sum(body)
+		if cm != base64.StdEncoding.EncodeToString(h[:]) {
+			writeError(w, r, http.StatusBadRequest, "BadDigest", "the Content-MD5 does not match the body")
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	s.mu.Lock()
+	exists := s.buckets[bucket] != nil
+	s.mu.Unlock()
+	if !exists {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+		return
+	}
+
+	q := r.URL.Query()
+	_, hasUploads := q["uploads"]
+	_, hasDelete := q["delete"]
+	switch {
+	case key == "" && r.Method == "GET":
+		s.listObjects(w, r, bucket, q)
+	case key == "" && r.Method == "POST" && hasDelete:
+		s.deleteObjects(w, r, bucket, body)
+	case key == "":
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported bucket operation")
+	case r.Method == "POST" && hasUploads:
+		s.initiateUpload(w, r, bucket, key)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		s.uploadPart(w, r, q, body)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		s.completeUpload(w, r, q, body)
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		s.abortUpload(w, r, q)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == "PUT":
+		s.putObject(w, r, bucket, key, body)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s.getObject(w, r, bucket, key)
+	case r.Method == "DELETE":
+		s.mu.Lock()
+		s.remove(s.buckets[bucket][key])
+		delete(s.buckets[bucket], key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported object operation")
+	}
+}
+
+// injectedFailure returns the status code of a failure queued by FailNext
+// for the method, or zero.
+func (s *Server) injectedFailure(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.failures {
+		if f.method == "" || f.method == method {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			return f.code
+		}
+	}
+	return 0
+}
+
+// storedHeaders are the request headers kept with an object and returned
+// when it is read.
+var storedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Type",
+	"X-Amz-Storage-Class",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+}
+
+// objectHeader extracts the headers stored with an object from a request.
+func objectHeader(r *http.Request) http.Header {
+	h := make(http.Header)
+	for _, name := range storedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	for name, v := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			h[name] = v
+		}
+	}
+	return h
+}
+
+// Prefixes of the headers that carry an SSE-C customer key.
+const (
+	customerKeyPrefix     = "X-Amz-Server-Side-Encryption-Customer-"
+	copyCustomerKeyPrefix = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-"
+)
+
+// checkCustomerKey checks that the customer key headers with the given
+// prefix are consistent, and that they match the key an object was stored
+// with, if any. It writes an error and returns false if they do not.
+func checkCustomerKey(w http.ResponseWriter, r *http.Request, prefix string, stored http.Header) bool {
+	key := r.Header.Get(prefix + "Key")
+	sum := r.Header.Get(prefix + "Key-Md5")
+	if key != "" {
+		b, err := base64.StdEncoding.DecodeString(key)
+		h := md5.Sum(b)
+		if err != nil || len(b) != 32 || r.Header.Get(prefix+"Algorithm") != "AES256" ||
+			sum != base64.StdEncoding.EncodeToString(h[:]) {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid customer key")
+			return false
+		}
+	}
+	if stored == nil {
+		return true
+	}
+	if want := stored.Get(customerKeyPrefix + "Key-Md5"); want != sum {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest",
+			"the customer key does not match the one the object was stored with")
+		return false
+	}
+	return true
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// newObject stores data and returns an object describing it.
+func (s *Server) newObject(data []byte) (*object, error) {
+	h := md5.Sum(data)
+	obj := &object{
+		size:         int64(len(data)),
+		etag:         `"` + hex.EncodeToString(h[:]) + `"`,
+		lastModified: time.Now().UTC().Truncate(time.Second),
+		header:       make(http.Header),
+	}
+	if s.dir == "" {
+		obj.data = data
+		return obj, nil
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	obj.path = filepath.Join(s.dir, fmt.Sprintf("object-%d", s.nextID))
+	s.mu.Unlock()
+	if err := ioutil.WriteFile(obj.path, data, 0600); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// read returns the contents of an object. s.mu must be held, since
+// overwriting or deleting the object removes its file.
+func (s *Server) read(obj *object) ([]byte, error) {
+	if obj.path == "" {
+		return obj.data, nil
+	}
+	return ioutil.ReadFile(obj.path)
+}
+
+// remove releases the storage used by an object, which may be nil.
+func (s *Server) remove(obj *object) {
+	if obj != nil && obj.path != "" {
+		os.Remove(obj.path)
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string, body []byte) {
+	if !checkCustomerKey(w, r, customerKeyPrefix, nil) {
+		return
+	}
+	obj, err := s.newObject(body)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	obj.header = objectHeader(r)
+
+	s.mu.Lock()
+	s.remove(s.buckets[bucket][key])
+	s.buckets[bucket][key] = obj
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	// Read the contents along with the object, before a concurrent PUT or
+	// DELETE can remove its file.
+	s.mu.Lock()
+	obj := s.buckets[bucket][key]
+	var data []byte
+	var err error
+	if obj != nil {
+		data, err = s.read(obj)
+	}
+	s.mu.Unlock()
+	if obj == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+		return
+	}
+	if !checkCustomerKey(w, r, customerKeyPrefix, obj.header) {
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "" && m != obj.etag {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "If-Match does not match the ETag")
+		return
+	}
+	if m := r.Header.Get("If-None-Match"); m != "" && m == obj.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	for k, v := range obj.header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "binary/octet-stream")
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseRange(rng, int64(len(data)))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+		data = data[start:end]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+// parseRange parses a single "bytes=" range into a half open interval.
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	var start, end int64
+	var err error
+	switch {
+	case parts[0] == "":
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size
+	default:
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, false
+		}
+		end = size
+		if parts[1] != "" {
+			if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return 0, 0, false
+			}
+			end++
+			if end > size {
+				end = size
+			}
+		}
+	}
+	if start >= size || start >= end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := url.QueryUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		return
+	}
+
+	s.mu.Lock()
+	src := s.buckets[parts[0]][parts[1]]
+	var data []byte
+	if src != nil {
+		data, err = s.read(src)
+	}
+	s.mu.Unlock()
+	if src == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "the copy source does not exist")
+		return
+	}
+	if !checkCustomerKey(w, r, copyCustomerKeyPrefix, src.header) ||
+		!checkCustomerKey(w, r, customerKeyPrefix, nil) {
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	obj, err := s.newObject(data)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	obj.header = cloneHeader(src.header)
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		obj.header = objectHeader(r)
+	} else {
+		// Copies are encrypted as the request asks, not like the source.
+		requested := objectHeader(r)
+		for _, name := range storedHeaders {
+			if strings.HasPrefix(name, "X-Amz-Server-Side-Encryption") {
+				obj.header.Del(name)
+				if v := requested.Get(name); v != "" {
+					obj.header.Set(name, v)
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.remove(s.buckets[bucket][key])
+	s.buckets[bucket][key] = obj
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: obj.etag, LastModified: obj.lastModified.Format(time.RFC3339)})
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []listEntry
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+	if q.Get("list-type") != "2" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is supported")
+		return
+	}
+	res := listResult{
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		MaxKeys:           1000,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+	}
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		res.MaxKeys = n
+	}
+
+	// Continuation tokens are simply the last key or prefix returned.
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		b, err := base64.URLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+			return
+		}
+		after = string(b)
+	}
+
+	s.mu.Lock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		if strings.HasPrefix(k, res.Prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	last := ""
+	for _, k := range keys {
+		entry := k
+		isPrefix := false
+		if res.Delimiter != "" {
+			rest := strings.TrimPrefix(k, res.Prefix)
+			if i := strings.Index(rest, res.Delimiter); i >= 0 {
+				entry = res.Prefix + rest[:i+len(res.Delimiter)]
+				isPrefix = true
+			}
+		}
+		if entry == last || (isPrefix && entry <= after) {
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = entry
+		res.KeyCount++
+		if isPrefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{entry})
+			continue
+		}
+		obj := s.buckets[bucket][k]
+		class := obj.header.Get("X-Amz-Storage-Class")
+		if class == "" {
+			class = "STANDARD"
+		}
+		res.Contents = append(res.Contents, listEntry{
+			Key:          k,
+			LastModified: obj.lastModified.Format(time.RFC3339),
+			ETag:         obj.etag,
+			Size:         obj.size,
+			StorageClass: class,
+		})
+	}
+	s.mu.Unlock()
+
+	writeXML(w, res)
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string, body []byte) {
+	var req struct {
+		Quiet   bool
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if r.Header.Get("Content-Md5") == "" {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "missing Content-MD5 header")
+		return
+	}
+
+	type deleted struct{ Key string }
+	var res struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}
+	s.mu.Lock()
+	for _, o := range req.Objects {
+		s.remove(s.buckets[bucket][o.Key])
+		delete(s.buckets[bucket], o.Key)
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deleted{o.Key})
+		}
+	}
+	s.mu.Unlock()
+	writeXML(w, res)
+}
+
+func (s *Server) initiateUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !checkCustomerKey(w, r, customerKeyPrefix, nil) {
+		return
+	}
+	s.mu.Lock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{
+		bucket: bucket,
+		key:    key,
+		header: objectHeader(r),
+		parts:  make(map[int]*object),
+	}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: id})
+}
+
+// findUpload returns the upload named in the query, writing an error if it
+// does not exist.
+func (s *Server) findUpload(w http.ResponseWriter, r *http.Request, q url.Values) (string, *upload) {
+	id := q.Get("uploadId")
+	s.mu.Lock()
+	u := s.uploads[id]
+	s.mu.Unlock()
+	if u == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+	}
+	return id, u
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, q url.Values, body []byte) {
+	_, u := s.findUpload(w, r, q)
+	if u == nil {
+		return
+	}
+	if !checkCustomerKey(w, r, customerKeyPrefix, u.header) {
+		return
+	}
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > s3util.MaxParts {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	part, err := s.newObject(body)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.remove(u.parts[n])
+	u.parts[n] = part
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, q url.Values, body []byte) {
+	id, u := s.findUpload(w, r, q)
+	if u == nil {
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "invalid part list")
+		return
+	}
+
+	var data bytes.Buffer
+	var sums []byte
+	s.mu.Lock()
+	for i, p := range req.Parts {
+		part := u.parts[p.PartNumber]
+		if part == nil || part.etag != p.ETag {
+			s.mu.Unlock()
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded", p.PartNumber))
+			return
+		}
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			s.mu.Unlock()
+			writeError(w, r, http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order")
+			return
+		}
+		if i < len(req.Parts)-1 && part.size < s3util.MinPartSize {
+			s.mu.Unlock()
+			writeError(w, r, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("part %d is too small", p.PartNumber))
+			return
+		}
+		b, err := s.read(part)
+		if err != nil {
+			s.mu.Unlock()
+			writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		data.Write(b)
+		sum, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		sums = append(sums, sum...)
+	}
+	for _, part := range u.parts {
+		s.remove(part)
+	}
+	delete(s.uploads, id)
+	s.mu.Unlock()
+
+	obj, err := s.newObject(data.Bytes())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	h := md5.Sum(sums)
+	obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(h[:]), len(req.Parts))
+	obj.header = u.header
+
+	s.mu.Lock()
+	s.remove(s.buckets[u.bucket][u.key])
+	s.buckets[u.bucket][u.key] = obj
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: u.bucket, Key: u.key, ETag: obj.etag})
+}
+
+func (s *Server) abortUpload(w http.ResponseWriter, r *http.Request, q url.Values) {
+	id, u := s.findUpload(w, r, q)
+	if u == nil {
+		return
+	}
+	s.mu.Lock()
+	for _, part := range u.parts {
+		s.remove(part)
+	}
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,355 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package s3test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apcera/util/s3util"
+)
+
+func newUploader(t *testing.T, s *Server, bucket string) *s3util.S3Uploader {
+	u, err := s3util.NewS3UploaderFromConfig(s.Config(bucket))
+	if err != nil {
+		t.Fatalf("NewS3UploaderFromConfig: %s", err)
+	}
+	return u
+}
+
+func TestPutAndGet(t *testing.T) {
+	for _, dir := range []bool{false, true} {
+		var opts Options
+		if dir {
+			tmp, err := ioutil.TempDir("", "s3test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			opts.Dir = tmp
+		}
+		s := NewServer(&opts)
+		defer s.Close()
+		u := newUploader(t, s, "bucket")
+
+		if err := u.UploadToS3("/tmp/release.tar.gz", bytes.NewBufferString("hello world")); err != nil {
+			t.Fatalf("UploadToS3: %s", err)
+		}
+		if data, ok := s.Object("bucket", "release.tar.gz"); !ok || string(data) != "hello world" {
+			t.Fatalf("stored object = %q, %v", data, ok)
+		}
+
+		r, info, err := u.GetObject("release.tar.gz", &s3util.GetOptions{Offset: 6})
+		if err != nil {
+			t.Fatalf("GetObject: %s", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != "world" {
+			t.Fatalf("ranged read = %q, %v", b, err)
+		}
+		if info.Size != 11 || info.ContentType != "application/x-gzip" {
+			t.Fatalf("unexpected info %+v", info)
+		}
+
+		if _, err := u.HeadObject("missing"); !s3util.IsNotFound(err) {
+			t.Fatalf("HeadObject of missing key: %v", err)
+		}
+	}
+}
+
+func TestGetDuringOverwrite(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "s3test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	s := NewServer(&Options{Dir: tmp})
+	defer s.Close()
+	u := newUploader(t, s, "bucket")
+
+	versions := []string{strings.Repeat("a", 4096), strings.Repeat("b", 4096)}
+	if err := u.UploadToS3("/tmp/obj", bytes.NewBufferString(versions[0])); err != nil {
+		t.Fatalf("UploadToS3: %s", err)
+	}
+
+	// Reads racing with overwrites see one version or the other, never an
+	// error from the old version's file being removed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			u.UploadToS3("/tmp/obj", bytes.NewBufferString(versions[i%2]))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		b, ok := s.Object("bucket", "obj")
+		if !ok || (string(b) != versions[0] && string(b) != versions[1]) {
+			t.Fatalf("read %d bytes during overwrite: %v", len(b), ok)
+		}
+		r, _, err := u.GetObject("obj", nil)
+		if err != nil {
+			t.Fatalf("GetObject during overwrite: %s", err)
+		}
+		b, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || (string(b) != versions[0] && string(b) != versions[1]) {
+			t.Fatalf("read %d bytes during overwrite: %v", len(b), err)
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	u := newUploader(t, s, "bucket")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (s3util.MinPartSize*2+100)/16)
+	opts := &s3util.MultipartOptions{PartSize: s3util.MinPartSize, Concurrency: 2}
+	if err := u.UploadMultipart("big", bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("UploadMultipart: %s", err)
+	}
+	got, ok := s.Object("bucket", "big")
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("assembled object differs: %d bytes, want %d", len(got), len(data))
+	}
+	info, err := u.HeadObject("big")
+	if err != nil {
+		t.Fatalf("HeadObject: %s", err)
+	}
+	if !strings.HasSuffix(info.ETag, `-3"`) {
+		t.Fatalf("multipart ETag = %s, want a -3 suffix", info.ETag)
+	}
+	if n := s.Uploads(); n != 0 {
+		t.Fatalf("%d uploads left open", n)
+	}
+}
+
+func TestMultipartAbort(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	u := newUploader(t, s, "bucket")
+
+	// Every part fails with a permanent error, so the upload is aborted.
+	for i := 0; i < 4; i++ {
+		s.FailNext("PUT", http.StatusForbidden)
+	}
+	data := make([]byte, s3util.MinPartSize+1)
+	opts := &s3util.MultipartOptions{PartSize: s3util.MinPartSize, Concurrency: 1}
+	if err := u.UploadMultipart("big", bytes.NewReader(data), opts); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if n := s.Uploads(); n != 0 {
+		t.Fatalf("%d uploads left open after abort", n)
+	}
+	if keys := s.Keys("bucket"); len(keys) != 0 {
+		t.Fatalf("unexpected objects %v", keys)
+	}
+}
+
+func TestListDeleteCopy(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	u := newUploader(t, s, "bucket")
+
+	for _, k := range []string{"a/1", "a/2", "a/b/3", "c", "d"} {
+		if err := s.PutObject("bucket", k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := u.ListObjectsPage(&s3util.ListOptions{MaxKeys: 2}, "")
+	if err != nil {
+		t.Fatalf("ListObjectsPage: %s", err)
+	}
+	if len(page.Objects) != 2 || page.NextToken == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+
+	objects, prefixes, err := u.ListObjects(&s3util.ListOptions{Delimiter: "/", MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("ListObjects: %s", err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"c", "d"}) || !reflect.DeepEqual(prefixes, []string{"a/"}) {
+		t.Fatalf("ListObjects = %v, %v", keys, prefixes)
+	}
+
+	if _, err := u.CopyObject("bucket", "c", "copies/c"); err != nil {
+		t.Fatalf("CopyObject: %s", err)
+	}
+	if data, _ := s.Object("bucket", "copies/c"); string(data) != "c" {
+		t.Fatalf("copied object = %q", data)
+	}
+
+	if err := u.DeleteObject("d"); err != nil {
+		t.Fatalf("DeleteObject: %s", err)
+	}
+	if err := u.DeleteObjects([]string{"a/1", "a/2", "a/b/3"}); err != nil {
+		t.Fatalf("DeleteObjects: %s", err)
+	}
+	if keys := s.Keys("bucket"); !reflect.DeepEqual(keys, []string{"c", "copies/c"}) {
+		t.Fatalf("remaining keys = %v", keys)
+	}
+}
+
+func TestSignatureChecks(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	s.CreateBucket("bucket")
+
+	c := s.Config("bucket")
+	c.Credentials = &s3util.StaticCredentials{AccessKeyID: "AKIDS3TEST", SecretAccessKey: "wrong"}
+	bad, err := s3util.NewS3UploaderFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.UploadToS3("x", bytes.NewBufferString("x")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected a 403 for bad credentials, got %v", err)
+	}
+
+	// Unsigned requests are rejected too.
+	resp, err := http.Get(s.URL + "/bucket/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unsigned request got %d", resp.StatusCode)
+	}
+
+	// Presigned URLs work without credentials.
+	s.PutObject("bucket", "x", []byte("presigned"))
+	u := newUploader(t, s, "bucket")
+	signed, err := u.PresignURL("GET", "x", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "presigned" {
+		t.Fatalf("presigned GET = %d %q", resp.StatusCode, b)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		rng        string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-4", 0, 5, true},
+		{"bytes=5-", 5, 10, true},
+		{"bytes=-3", 7, 10, true},
+		{"bytes=8-100", 8, 10, true},
+		{"bytes=10-", 0, 0, false},
+		{"bytes=0-1,3-4", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseRange(tt.rng, 10)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("parseRange(%q) = %d, %d, %v", tt.rng, start, end, ok)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	key := bytes.Repeat([]byte{3}, 32)
+	c := s.Config("bucket")
+	c.Encryption = s3util.NewSSEC(key)
+	c.ClientEncryption = &s3util.EnvelopeEncryption{KeyID: "k1", Key: bytes.Repeat([]byte{9}, 32)}
+	u, err := s3util.NewS3UploaderFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := bytes.Repeat([]byte("secret "), 20000)
+	if err := u.UploadToS3("secret.txt", bytes.NewBuffer(plain)); err != nil {
+		t.Fatalf("UploadToS3: %s", err)
+	}
+	stored, _ := s.Object("bucket", "secret.txt")
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Fatal("object was stored unencrypted")
+	}
+	h, _ := s.Header("bucket", "secret.txt")
+	if h.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == "" || h.Get("X-Amz-Meta-S3util-Key") == "" {
+		t.Fatalf("missing encryption headers: %v", h)
+	}
+
+	r, info, err := u.GetObject("secret.txt", nil)
+	if err != nil {
+		t.Fatalf("GetObject: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted object differs: %v", err)
+	}
+	if info.Size != int64(len(plain)) {
+		t.Fatalf("Size = %d, want the plaintext size %d", info.Size, len(plain))
+	}
+	if _, _, err := u.GetObject("secret.txt", &s3util.GetOptions{Offset: 1}); err == nil {
+		t.Fatal("expected ranged reads of encrypted objects to fail")
+	}
+
+	// Multipart uploads are encrypted as they stream.
+	big := bytes.Repeat([]byte("0123456789"), s3util.MinPartSize/10+1000)
+	opts := &s3util.MultipartOptions{PartSize: s3util.MinPartSize}
+	if err := u.UploadMultipart("big", bytes.NewReader(big), opts); err != nil {
+		t.Fatalf("UploadMultipart: %s", err)
+	}
+	tmp, err := ioutil.TempDir("", "s3test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := u.DownloadFile("big", tmp+"/big"); err != nil {
+		t.Fatalf("DownloadFile: %s", err)
+	}
+	if got, _ := ioutil.ReadFile(tmp + "/big"); !bytes.Equal(got, big) {
+		t.Fatal("downloaded multipart object differs")
+	}
+
+	// Without the customer key, S3 refuses to serve the object.
+	c.Encryption = nil
+	nokey, err := s3util.NewS3UploaderFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nokey.HeadObject("secret.txt"); err == nil {
+		t.Fatal("expected reading an SSE-C object without its key to fail")
+	}
+
+	// Without the master key, the object cannot be decrypted.
+	c.Encryption = s3util.NewSSEC(key)
+	c.ClientEncryption = nil
+	nomaster, err := s3util.NewS3UploaderFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := nomaster.GetObject("secret.txt", nil); err == nil {
+		t.Fatal("expected reading a client-side encrypted object without the master key to fail")
+	}
+}
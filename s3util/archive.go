@@ -0,0 +1,389 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An ArchiveFormat selects how WriteArchive packages a directory.
+type ArchiveFormat int
+
+const (
+	// FormatTarGz is a gzip compressed tar archive.
+	FormatTarGz ArchiveFormat = iota
+
+	// FormatZip is a zip archive with deflated entries.
+	FormatZip
+
+	// FormatTarZstd is a zstd compressed tar archive.
+	FormatTarZstd
+)
+
+// Extension returns the usual file name extension for the format.
+func (f ArchiveFormat) Extension() string {
+	switch f {
+	case FormatZip:
+		return ".zip"
+	case FormatTarZstd:
+		return ".tar.zst"
+	}
+	return ".tar.gz"
+}
+
+// ContentType returns the content type archives of the format are uploaded
+// with.
+func (f ArchiveFormat) ContentType() string {
+	switch f {
+	case FormatZip:
+		return "application/zip"
+	case FormatTarZstd:
+		return "application/zstd"
+	}
+	return "application/x-gzip"
+}
+
+// DefaultArchiveTime is the timestamp given to archive entries when none is
+// configured. It is the earliest time a zip archive can represent.
+var DefaultArchiveTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NewZstdWriter returns a writer that compresses to w in the zstd format. The
+// default writer has no dependencies and emits valid zstd frames made of
+// uncompressed blocks. Programs that want real compression can replace it,
+// for example with a wrapper around github.com/klauspost/compress/zstd.
+var NewZstdWriter = func(w io.Writer) (io.WriteCloser, error) {
+	return newStoredZstdWriter(w), nil
+}
+
+// ArchiveOptions controls WriteArchive. The zero value writes a
+// reproducible tar.gz archive.
+type ArchiveOptions struct {
+	// Format is the archive format.
+	Format ArchiveFormat
+
+	// Prefix is a directory prepended to the name of every entry, such as
+	// "release-1.0".
+	Prefix string
+
+	// ModTime is the modification time of every entry. It defaults to
+	// DefaultArchiveTime so that archiving the same files always produces
+	// the same bytes.
+	ModTime time.Time
+
+	// PreserveModes keeps the permission bits of each file. Otherwise files
+	// are stored as 0644, or 0755 if executable by their owner, and
+	// directories as 0755.
+	PreserveModes bool
+}
+
+// archiveEntry is a file, directory or symlink to be archived.
+type archiveEntry struct {
+	name   string
+	path   string
+	mode   os.FileMode
+	size   int64
+	target string
+}
+
+// archiveWriter writes entries in one archive format.
+type archiveWriter interface {
+	add(e *archiveEntry, modTime time.Time) error
+	Close() error
+}
+
+// WriteArchive writes the contents of dir to w as an archive. Entries are
+// written in lexical order with fixed timestamps, owners and, unless
+// configured otherwise, modes, so the output depends only on the names and
+// contents of the files. Symlinks are stored as links rather than followed.
+// Nothing is buffered beyond the compressor's window, so w may be the write
+// end of a pipe feeding an upload.
+func WriteArchive(w io.Writer, dir string, opts *ArchiveOptions) error {
+	var o ArchiveOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.ModTime.IsZero() {
+		o.ModTime = DefaultArchiveTime
+	}
+	// Archive formats store whole seconds at best.
+	o.ModTime = o.ModTime.UTC().Truncate(time.Second)
+	prefix := strings.Trim(filepath.ToSlash(o.Prefix), "/")
+
+	var aw archiveWriter
+	switch o.Format {
+	case FormatTarGz:
+		gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		gw.Header.ModTime = o.ModTime
+		aw = &tarArchive{tw: tar.NewWriter(gw), compressor: gw}
+	case FormatTarZstd:
+		zw, err := NewZstdWriter(w)
+		if err != nil {
+			return err
+		}
+		aw = &tarArchive{tw: tar.NewWriter(zw), compressor: zw}
+	case FormatZip:
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %d", o.Format)
+	}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == "." {
+			if prefix == "" {
+				return nil
+			}
+			name = ""
+		}
+		if prefix != "" {
+			name = strings.TrimSuffix(prefix+"/"+name, "/")
+		}
+
+		e := &archiveEntry{name: name, path: p, mode: archiveMode(info.Mode(), o.PreserveModes)}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if e.target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.IsDir():
+		case info.Mode().IsRegular():
+			e.size = info.Size()
+		default:
+			// Devices, sockets and pipes have no place in an artifact.
+			return nil
+		}
+		return aw.add(e, o.ModTime)
+	})
+	if err != nil {
+		aw.Close()
+		return err
+	}
+	return aw.Close()
+}
+
+// archiveMode returns the mode an entry is stored with.
+func archiveMode(m os.FileMode, preserve bool) os.FileMode {
+	switch {
+	case m&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case preserve:
+		return m & (os.ModeType | os.ModePerm)
+	case m.IsDir():
+		return os.ModeDir | 0755
+	case m&0100 != 0:
+		return 0755
+	}
+	return 0644
+}
+
+// copyFile copies the contents of the named file to w, checking that it did
+// not change size while being archived.
+func copyFile(w io.Writer, e *archiveEntry) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(w, io.LimitReader(f, e.size))
+	if err == nil && n != e.size {
+		err = fmt.Errorf("%s: file shrank while being archived", e.path)
+	}
+	return err
+}
+
+// tarArchive writes a tar stream through a compressor.
+type tarArchive struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (a *tarArchive) add(e *archiveEntry, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    e.name,
+		Mode:    int64(e.mode.Perm()),
+		ModTime: modTime,
+	}
+	switch {
+	case e.mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.target
+	case e.mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.size
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	return copyFile(a.tw, e)
+}
+
+func (a *tarArchive) Close() error {
+	err := a.tw.Close()
+	if cerr := a.compressor.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// zipArchive writes a zip stream.
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(e *archiveEntry, modTime time.Time) error {
+	hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+	hdr.SetModTime(modTime)
+	hdr.SetMode(e.mode)
+	if e.mode.IsDir() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.mode&os.ModeSymlink != 0:
+		// Zip tools store the link target as the entry's contents.
+		_, err = io.WriteString(w, e.target)
+		return err
+	case e.mode.IsDir():
+		return nil
+	}
+	return copyFile(w, e)
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// UploadArchive archives dir and streams the archive to the named object
+// with a multipart upload. The archive is never held in memory or written to
+// disk. The content type defaults to the one for the archive format.
+func (s *S3Uploader) UploadArchive(key, dir string, opts *ArchiveOptions, mopts *MultipartOptions) error {
+	var mo MultipartOptions
+	if mopts != nil {
+		mo = *mopts
+	}
+	if mo.ContentType == "" {
+		var format ArchiveFormat
+		if opts != nil {
+			format = opts.Format
+		}
+		mo.ContentType = format.ContentType()
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := WriteArchive(pw, dir, opts)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err := s.UploadMultipart(key, pr, &mo)
+	// Unblock the archiver if the upload stopped reading early.
+	pr.CloseWithError(fmt.Errorf("upload of %q stopped", key))
+	if aerr := <-done; aerr != nil && err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// zstdMaxBlockSize is the largest block allowed in a zstd frame.
+const zstdMaxBlockSize = 128 << 10
+
+// storedZstdWriter writes a single zstd frame made of raw, uncompressed
+// blocks, as described in RFC 8478. It costs almost nothing to produce and
+// can be read by any zstd decoder.
+type storedZstdWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+	closed  bool
+	err     error
+}
+
+func newStoredZstdWriter(w io.Writer) *storedZstdWriter {
+	return &storedZstdWriter{w: w, buf: make([]byte, 0, zstdMaxBlockSize)}
+}
+
+// writeBlock writes the buffered data as one raw block.
+func (z *storedZstdWriter) writeBlock(last bool) {
+	if z.err != nil {
+		return
+	}
+	if !z.started {
+		// The magic number, a frame header descriptor with no optional
+		// fields, and a window descriptor for a 128KiB window.
+		_, z.err = z.w.Write([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x38})
+		z.started = true
+		if z.err != nil {
+			return
+		}
+	}
+	hdr := uint32(len(z.buf)) << 3 // Block_Type 0 is a raw block.
+	if last {
+		hdr |= 1
+	}
+	if _, z.err = z.w.Write([]byte{byte(hdr), byte(hdr >> 8), byte(hdr >> 16)}); z.err != nil {
+		return
+	}
+	_, z.err = z.w.Write(z.buf)
+	z.buf = z.buf[:0]
+}
+
+func (z *storedZstdWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && z.err == nil {
+		// Only write a full block once more data arrives, since the final
+		// block must be marked as the last one.
+		if len(z.buf) == zstdMaxBlockSize {
+			z.writeBlock(false)
+		}
+		m := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, z.err
+}
+
+// Close writes the last block. It does not close the underlying writer, and
+// closing the writer again does nothing.
+func (z *storedZstdWriter) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	z.writeBlock(true)
+	if z.err == nil {
+		z.err = io.ErrClosedPipe
+		return nil
+	}
+	return z.err
+}
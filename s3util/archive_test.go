@@ -0,0 +1,265 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// makeArchiveDir creates a small tree with an executable, a nested file and
+// a symlink.
+func makeArchiveDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "s3archive")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	files := map[string]os.FileMode{"bin/run": 0750, "etc/conf": 0600, "README": 0664}
+	for name, mode := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := ioutil.WriteFile(p, []byte("contents of "+name), mode); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		// Sidestep the umask.
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := os.Symlink("bin/run", filepath.Join(dir, "run")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return dir
+}
+
+// decodeStoredZstd decodes a frame written by storedZstdWriter.
+func decodeStoredZstd(t *testing.T, b []byte) []byte {
+	if len(b) < 6 || !bytes.Equal(b[:6], []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x38}) {
+		t.Fatalf("Unexpected zstd frame header % x", b[:6])
+	}
+	b = b[6:]
+	var out []byte
+	for {
+		if len(b) < 3 {
+			t.Fatal("Truncated zstd block header")
+		}
+		hdr := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		size := int(hdr >> 3)
+		if (hdr>>1)&3 != 0 || size > zstdMaxBlockSize || len(b) < 3+size {
+			t.Fatalf("Invalid zstd block header %x", hdr)
+		}
+		out = append(out, b[3:3+size]...)
+		b = b[3+size:]
+		if hdr&1 == 1 {
+			break
+		}
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d bytes after the last zstd block", len(b))
+	}
+	return out
+}
+
+// tarEntries lists "name mode size" for each entry in a tar stream.
+func tarEntries(t *testing.T, r io.Reader) []string {
+	var entries []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !hdr.ModTime.Equal(DefaultArchiveTime) || hdr.Uid != 0 || hdr.Uname != "" {
+			t.Fatalf("Entry %q is not reproducible: %+v", hdr.Name, hdr)
+		}
+		e := fmt.Sprintf("%s %o %d", hdr.Name, hdr.Mode, hdr.Size)
+		if hdr.Typeflag == tar.TypeSymlink {
+			e += " -> " + hdr.Linkname
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestWriteArchiveTar(t *testing.T) {
+	dir := makeArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	want := []string{
+		"pkg/ 755 0",
+		"pkg/README 644 18",
+		"pkg/bin/ 755 0",
+		"pkg/bin/run 755 19",
+		"pkg/etc/ 755 0",
+		"pkg/etc/conf 644 20",
+		"pkg/run 777 0 -> bin/run",
+	}
+	for _, format := range []ArchiveFormat{FormatTarGz, FormatTarZstd} {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, dir, &ArchiveOptions{Format: format, Prefix: "pkg/"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		var r io.Reader
+		if format == FormatTarGz {
+			gr, err := gzip.NewReader(&buf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			r = gr
+		} else {
+			r = bytes.NewReader(decodeStoredZstd(t, buf.Bytes()))
+		}
+		if got := tarEntries(t, r); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s entries:\n%v\nwant:\n%v", format.Extension(), got, want)
+		}
+	}
+}
+
+func TestWriteArchiveZip(t *testing.T) {
+	dir := makeArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, dir, &ArchiveOptions{Format: FormatZip, PreserveModes: true}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var got []string
+	for _, f := range zr.File {
+		e := fmt.Sprintf("%s %s", f.Name, f.Mode())
+		if !f.FileInfo().IsDir() {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			b, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			e += " " + string(b)
+		}
+		got = append(got, e)
+	}
+	want := []string{
+		"README -rw-rw-r-- contents of README",
+		"bin/ drwx------",
+		"bin/run -rwxr-x--- contents of bin/run",
+		"etc/ drwx------",
+		"etc/conf -rw------- contents of etc/conf",
+		"run Lrwxrwxrwx bin/run",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Zip entries:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestWriteArchiveReproducible(t *testing.T) {
+	dir := makeArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, format := range []ArchiveFormat{FormatTarGz, FormatZip, FormatTarZstd} {
+		var first, second bytes.Buffer
+		if err := WriteArchive(&first, dir, &ArchiveOptions{Format: format}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, "README"), later, later); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := os.Chmod(filepath.Join(dir, "README"), 0600); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := WriteArchive(&second, dir, &ArchiveOptions{Format: format}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Fatalf("%s archives differ after touching a file", format.Extension())
+		}
+	}
+}
+
+func TestStoredZstdWriter(t *testing.T) {
+	for _, size := range []int{0, 1, zstdMaxBlockSize, zstdMaxBlockSize + 1, 3 * zstdMaxBlockSize} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		var buf bytes.Buffer
+		zw := newStoredZstdWriter(&buf)
+		// Write in uneven pieces to exercise the block boundaries.
+		for p := data; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := zw.Write(p[:n]); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			p = p[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Unexpected error closing twice: %s", err)
+		}
+		if _, err := zw.Write([]byte{0}); err == nil {
+			t.Fatal("Expected error writing after Close")
+		}
+		if got := decodeStoredZstd(t, buf.Bytes()); !bytes.Equal(got, data) {
+			t.Fatalf("Round trip of %d bytes failed", size)
+		}
+		blocks := (size + zstdMaxBlockSize - 1) / zstdMaxBlockSize
+		if blocks == 0 {
+			blocks = 1
+		}
+		if want := 6 + 3*blocks + size; buf.Len() != want {
+			t.Fatalf("Frame for %d bytes is %d bytes; want %d", size, buf.Len(), want)
+		}
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+
+	dir := makeArchiveDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &ArchiveOptions{Format: FormatTarGz}
+	if err := uploader.UploadArchive("release.tar.gz", dir, opts, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var want bytes.Buffer
+	if err := WriteArchive(&want, dir, opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(m.object, want.Bytes()) {
+		t.Fatal("Uploaded archive does not match WriteArchive output")
+	}
+
+	// A failing archive aborts the upload.
+	m.aborted = false
+	if err := uploader.UploadArchive("missing.tar.gz", filepath.Join(dir, "missing"), opts, nil); err == nil {
+		t.Fatal("Expected an error archiving a missing directory")
+	}
+	if !m.aborted {
+		t.Fatal("Expected the failed upload to be aborted")
+	}
+}
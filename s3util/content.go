@@ -0,0 +1,160 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxMetadataSize is the most user metadata S3 stores with an object,
+// counting the names and values of the x-amz-meta-* headers.
+const maxMetadataSize = 2 << 10
+
+// StorageClasses are the storage classes an object can be uploaded with.
+var StorageClasses = []string{
+	"STANDARD",
+	"STANDARD_IA",
+	"REDUCED_REDUNDANCY",
+	"GLACIER",
+}
+
+// ObjectOptions are the headers stored with an uploaded object. The zero
+// value infers the content type and sets nothing else.
+type ObjectOptions struct {
+	// ContentType is the object's content type. When empty it is inferred
+	// from the key and the start of the data with DetectContentType.
+	ContentType string
+
+	// CacheControl is returned as the Cache-Control header when the object
+	// is served, such as "max-age=3600".
+	CacheControl string
+
+	// ContentDisposition is returned as the Content-Disposition header when
+	// the object is served, such as "attachment".
+	ContentDisposition string
+
+	// ContentEncoding is returned as the Content-Encoding header when the
+	// object is served.
+	ContentEncoding string
+
+	// StorageClass is one of StorageClasses. S3 uses STANDARD when empty.
+	StorageClass string
+
+	// Metadata is stored as x-amz-meta-* headers. Names are case
+	// insensitive and are returned in lower case by HeadObject.
+	Metadata map[string]string
+}
+
+// header returns the headers for an object with the given key whose data
+// starts with head.
+func (o *ObjectOptions) header(key string, head []byte) (http.Header, error) {
+	var opts ObjectOptions
+	if o != nil {
+		opts = *o
+	}
+	h := make(http.Header)
+
+	if opts.ContentType == "" {
+		opts.ContentType = DetectContentType(key, head)
+	}
+	h.Set("Content-Type", opts.ContentType)
+	if opts.CacheControl != "" {
+		h.Set("Cache-Control", opts.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		h.Set("Content-Disposition", opts.ContentDisposition)
+	}
+	if opts.ContentEncoding != "" {
+		h.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	if opts.StorageClass != "" {
+		if err := validateStorageClass(opts.StorageClass); err != nil {
+			return nil, err
+		}
+		h.Set("X-Amz-Storage-Class", opts.StorageClass)
+	}
+
+	size := 0
+	for k, v := range opts.Metadata {
+		if k == "" || strings.IndexFunc(k, invalidHeaderRune) >= 0 {
+			return nil, fmt.Errorf("invalid metadata name %q", k)
+		}
+		if strings.IndexFunc(v, invalidValueRune) >= 0 {
+			return nil, fmt.Errorf("invalid value for metadata %q", k)
+		}
+		size += len(k) + len(v)
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("metadata is %d bytes; S3 allows at most %d", size, maxMetadataSize)
+	}
+	return h, nil
+}
+
+// validateStorageClass checks that class is one of StorageClasses.
+func validateStorageClass(class string) error {
+	for _, c := range StorageClasses {
+		if class == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported storage class: %q", class)
+}
+
+// invalidHeaderRune reports whether r may not appear in a header name.
+func invalidHeaderRune(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// invalidValueRune reports whether r may not appear in a header value.
+func invalidValueRune(r rune) bool {
+	return r < ' ' && r != '\t' || r == 0x7f || r > 0x7e
+}
+
+// contentTypes maps extensions to content types for artifacts commonly
+// uploaded by build tools, which the system MIME tables often lack.
+var contentTypes = map[string]string{
+	".gz":   "application/x-gzip",
+	".tgz":  "application/x-gzip",
+	".tar":  "application/x-tar",
+	".zst":  "application/zstd",
+	".zip":  "application/zip",
+	".bz2":  "application/x-bzip2",
+	".xz":   "application/x-xz",
+	".json": "application/json",
+	".js":   "application/javascript",
+	".css":  "text/css; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".svg":  "image/svg+xml",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".wasm": "application/wasm",
+}
+
+// DetectContentType returns the content type for an object named name whose
+// data starts with head. The extension is consulted first, then the data is
+// sniffed as described at https://mimesniff.spec.whatwg.org/. Data that
+// cannot be identified is application/octet-stream.
+func DetectContentType(name string, head []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if ext != "" {
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	if len(head) == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head)
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{"release.tar.gz", "", "application/x-gzip"},
+		{"RELEASE.TGZ", "", "application/x-gzip"},
+		{"site/index.html", "", "text/html; charset=utf-8"},
+		{"archive.zip", "", "application/zip"},
+		{"build.tar.zst", "", "application/zstd"},
+		{"logo.png", "", "image/png"},
+		{"noext", "\x1f\x8b\x08", "application/x-gzip"},
+		{"noext", "PK\x03\x04", "application/zip"},
+		{"noext", "plain words", "text/plain; charset=utf-8"},
+		{"noext", "", "application/octet-stream"},
+		{"dir.v2/noext", "\x00\x01\x02", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := DetectContentType(tt.name, []byte(tt.head)); got != tt.want {
+			t.Errorf("DetectContentType(%q, %q) = %q; want %q", tt.name, tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestObjectOptionsHeader(t *testing.T) {
+	o := &ObjectOptions{
+		CacheControl: "max-age=60",
+		StorageClass: "STANDARD_IA",
+		Metadata:     map[string]string{"build-id": "1234"},
+	}
+	h, err := o.header("notes.txt", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := map[string]string{
+		"Content-Type":         "text/plain; charset=utf-8",
+		"Cache-Control":        "max-age=60",
+		"X-Amz-Storage-Class":  "STANDARD_IA",
+		"X-Amz-Meta-Build-Id":  "1234",
+		"Content-Disposition":  "",
+		"X-Amz-Meta-Something": "",
+	}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("Header %s = %q; want %q", k, got, v)
+		}
+	}
+
+	// An explicit content type wins over inference.
+	h, err = (&ObjectOptions{ContentType: "application/x-custom"}).header("a.zip", nil)
+	if err != nil || h.Get("Content-Type") != "application/x-custom" {
+		t.Fatalf("Expected the explicit content type; got %q, %v", h.Get("Content-Type"), err)
+	}
+
+	bad := []*ObjectOptions{
+		{StorageClass: "COLD"},
+		{Metadata: map[string]string{"bad name": "x"}},
+		{Metadata: map[string]string{"name": "line\nbreak"}},
+		{Metadata: map[string]string{"big": strings.Repeat("x", maxMetadataSize)}},
+	}
+	for _, o := range bad {
+		if _, err := o.header("key", nil); err == nil {
+			t.Errorf("Expected an error for %+v", o)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// These constants correspond to the expected credential-containing environment
+// variable keys.
+const (
+	AWS_ACCESS_KEY_ID           = "AWS_ACCESS_KEY_ID"
+	AWS_SECRET_ACCESS_KEY       = "AWS_SECRET_ACCESS_KEY"
+	AWS_SECRET_KEY              = "AWS_SECRET_KEY"
+	AWS_SESSION_TOKEN           = "AWS_SESSION_TOKEN"
+	AWS_PROFILE                 = "AWS_PROFILE"
+	AWS_SHARED_CREDENTIALS_FILE = "AWS_SHARED_CREDENTIALS_FILE"
+)
+
+// Credentials are the keys used to sign requests. SessionToken is only set
+// for temporary credentials.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// A CredentialsProvider supplies credentials to sign requests with. It is
+// consulted for every request, so implementations should be cheap or cache.
+type CredentialsProvider interface {
+	Credentials() (*Credentials, error)
+}
+
+// StaticCredentials provides a fixed set of credentials.
+type StaticCredentials Credentials
+
+// Credentials returns a copy of the static credentials.
+func (c *StaticCredentials) Credentials() (*Credentials, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("static credentials are missing a key")
+	}
+	creds := Credentials(*c)
+	return &creds, nil
+}
+
+// EnvCredentials reads credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. The older AWS_SECRET_KEY is
+// used when AWS_SECRET_ACCESS_KEY is not set.
+type EnvCredentials struct{}
+
+// Credentials reads the credentials from the environment.
+func (EnvCredentials) Credentials() (*Credentials, error) {
+	creds := &Credentials{
+		AccessKeyID:     os.Getenv(AWS_ACCESS_KEY_ID),
+		SecretAccessKey: os.Getenv(AWS_SECRET_ACCESS_KEY),
+		SessionToken:    os.Getenv(AWS_SESSION_TOKEN),
+	}
+	if creds.SecretAccessKey == "" {
+		creds.SecretAccessKey = os.Getenv(AWS_SECRET_KEY)
+	}
+	if creds.AccessKeyID == "" {
+		return nil, fmt.Errorf("could not get AWS access key")
+	}
+	if creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("could not get AWS secret key")
+	}
+	return creds, nil
+}
+
+// SharedFileCredentials reads credentials from a profile in the shared
+// credentials file written by the AWS command line tools. The profile is
+// parsed once and read again only when the file is modified.
+type SharedFileCredentials struct {
+	// Filename is the path of the credentials file. It defaults to
+	// AWS_SHARED_CREDENTIALS_FILE or, failing that, ~/.aws/credentials.
+	Filename string
+
+	// Profile is the section of the file to use. It defaults to AWS_PROFILE
+	// or, failing that, "default".
+	Profile string
+
+	// the credentials last read, and the file, profile and modification
+	// time they were read for
+	mu       sync.Mutex
+	creds    *Credentials
+	filename string
+	profile  string
+	modTime  time.Time
+	size     int64
+}
+
+// Credentials returns the selected profile from the credentials file.
+func (c *SharedFileCredentials) Credentials() (*Credentials, error) {
+	filename := c.Filename
+	if filename == "" {
+		filename = os.Getenv(AWS_SHARED_CREDENTIALS_FILE)
+	}
+	if filename == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		if home == "" {
+			return nil, fmt.Errorf("could not locate the AWS credentials file")
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := c.Profile
+	if profile == "" {
+		profile = os.Getenv(AWS_PROFILE)
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds == nil || c.filename != filename || c.profile != profile ||
+		!c.modTime.Equal(info.ModTime()) || c.size != info.Size() {
+		values, err := readProfile(filename, profile)
+		if err != nil {
+			return nil, err
+		}
+		creds := &Credentials{
+			AccessKeyID:     values["aws_access_key_id"],
+			SecretAccessKey: values["aws_secret_access_key"],
+			SessionToken:    values["aws_session_token"],
+		}
+		if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return nil, fmt.Errorf("profile %q in %s is missing a key", profile, filename)
+		}
+		c.creds, c.filename, c.profile = creds, filename, profile
+		c.modTime, c.size = info.ModTime(), info.Size()
+	}
+	creds := *c.creds
+	return &creds, nil
+}
+
+// readProfile returns the key/value pairs in one section of an INI file.
+func readProfile(filename, profile string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values map[string]string
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			if inProfile && values == nil {
+				values = make(map[string]string)
+			}
+		case inProfile:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 {
+				values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return nil, fmt.Errorf("profile %q not found in %s", profile, filename)
+	}
+	return values, nil
+}
+
+// A CredentialsChain tries each provider in turn and returns the first
+// credentials found.
+type CredentialsChain []CredentialsProvider
+
+// Credentials returns the credentials from the first provider that has them.
+func (chain CredentialsChain) Credentials() (*Credentials, error) {
+	var errs []string
+	for _, p := range chain {
+		creds, err := p.Credentials()
+		if err == nil {
+			return creds, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("could not find AWS credentials: %s", strings.Join(errs, "; "))
+}
+
+// DefaultCredentials looks for credentials in the environment and then in the
+// shared credentials file.
+var DefaultCredentials CredentialsProvider = CredentialsChain{
+	EnvCredentials{},
+	&SharedFileCredentials{},
+}
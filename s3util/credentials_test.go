@@ -0,0 +1,201 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setenv sets environment variables for the duration of a test and returns
+// a function restoring the previous values.
+func setenv(t *testing.T, kv map[string]string) func() {
+	prev := make(map[string]string, len(kv))
+	for k, v := range kv {
+		prev[k] = os.Getenv(k)
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("Error setting environment: %s", err)
+		}
+	}
+	return func() {
+		for k, v := range prev {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	defer setenv(t, map[string]string{
+		AWS_ACCESS_KEY_ID:     "id",
+		AWS_SECRET_ACCESS_KEY: "secret",
+		AWS_SECRET_KEY:        "legacy",
+		AWS_SESSION_TOKEN:     "token",
+	})()
+
+	creds, err := EnvCredentials{}.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *creds != (Credentials{"id", "secret", "token"}) {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	os.Setenv(AWS_SECRET_ACCESS_KEY, "")
+	creds, err = EnvCredentials{}.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if creds.SecretAccessKey != "legacy" {
+		t.Fatalf("Expected fallback to %s; got %q", AWS_SECRET_KEY, creds.SecretAccessKey)
+	}
+
+	os.Setenv(AWS_ACCESS_KEY_ID, "")
+	if _, err := (EnvCredentials{}).Credentials(); err == nil {
+		t.Fatal("Expected error without an access key")
+	}
+}
+
+func TestSharedFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3util")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "credentials")
+	data := `# comment
+[default]
+aws_access_key_id = default-id
+aws_secret_access_key = default-secret
+
+[ build ]
+aws_access_key_id=build-id
+aws_secret_access_key=build-secret
+aws_session_token=build-token
+
+[broken]
+aws_access_key_id = only-id
+`
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer setenv(t, map[string]string{AWS_SHARED_CREDENTIALS_FILE: filename, AWS_PROFILE: ""})()
+
+	creds, err := (&SharedFileCredentials{}).Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *creds != (Credentials{"default-id", "default-secret", ""}) {
+		t.Fatalf("Unexpected default credentials: %+v", creds)
+	}
+
+	os.Setenv(AWS_PROFILE, "build")
+	creds, err = (&SharedFileCredentials{}).Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *creds != (Credentials{"build-id", "build-secret", "build-token"}) {
+		t.Fatalf("Unexpected profile credentials: %+v", creds)
+	}
+
+	if _, err := (&SharedFileCredentials{Profile: "broken"}).Credentials(); err == nil {
+		t.Fatal("Expected error for incomplete profile")
+	}
+	if _, err := (&SharedFileCredentials{Profile: "missing"}).Credentials(); err == nil {
+		t.Fatal("Expected error for missing profile")
+	}
+	if _, err := (&SharedFileCredentials{Filename: filepath.Join(dir, "nope")}).Credentials(); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+
+	// The file is read again only once it changes.
+	provider := &SharedFileCredentials{Profile: "default"}
+	if _, err := provider.Credentials(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cached := provider.creds
+	if _, err := provider.Credentials(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if provider.creds != cached {
+		t.Fatal("Expected the unchanged file not to be parsed again")
+	}
+	data = "[default]\naws_access_key_id = new-id\naws_secret_access_key = new-secret\n"
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	creds, err = provider.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *creds != (Credentials{"new-id", "new-secret", ""}) {
+		t.Fatalf("Expected credentials from the modified file; got %+v", creds)
+	}
+}
+
+func TestCredentialsChain(t *testing.T) {
+	chain := CredentialsChain{
+		&StaticCredentials{AccessKeyID: "id"},
+		&StaticCredentials{AccessKeyID: "id", SecretAccessKey: "secret"},
+	}
+	creds, err := chain.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if creds.SecretAccessKey != "secret" {
+		t.Fatalf("Expected credentials from the second provider; got %+v", creds)
+	}
+
+	if _, err := (CredentialsChain{&StaticCredentials{}}).Credentials(); err == nil {
+		t.Fatal("Expected error when no provider has credentials")
+	}
+}
+
+func TestDefaultCredentialsPrefersEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3util")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "credentials")
+	data := "[default]\naws_access_key_id = file-id\naws_secret_access_key = file-secret\n"
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer setenv(t, map[string]string{
+		AWS_SHARED_CREDENTIALS_FILE: filename,
+		AWS_PROFILE:                 "",
+		AWS_ACCESS_KEY_ID:           "",
+		AWS_SECRET_ACCESS_KEY:       "",
+		AWS_SECRET_KEY:              "",
+		AWS_SESSION_TOKEN:           "",
+	})()
+
+	creds, err := DefaultCredentials.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if creds.AccessKeyID != "file-id" {
+		t.Fatalf("Expected credentials from the file; got %+v", creds)
+	}
+
+	// Credentials exported after the file was used still take precedence.
+	os.Setenv(AWS_ACCESS_KEY_ID, "env-id")
+	os.Setenv(AWS_SECRET_ACCESS_KEY, "env-secret")
+	os.Setenv(AWS_SESSION_TOKEN, "env-token")
+	creds, err = DefaultCredentials.Credentials()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *creds != (Credentials{"env-id", "env-secret", "env-token"}) {
+		t.Fatalf("Expected credentials from the environment; got %+v", creds)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Server-side encryption algorithms.
+// Docs: http://docs.aws.amazon.com/AmazonS3/latest/dev/serv-side-encryption.html
+const (
+	// SSEAES256 encrypts objects with keys managed by S3 (SSE-S3), or with
+	// a customer provided key (SSE-C).
+	SSEAES256 = "AES256"
+
+	// SSEKMS encrypts objects with keys managed by AWS KMS (SSE-KMS).
+	SSEKMS = "aws:kms"
+)
+
+// ServerSideEncryption asks S3 to encrypt objects at rest. Use NewSSES3,
+// NewSSEKMS or NewSSEC to create one.
+type ServerSideEncryption struct {
+	// Algorithm is SSEAES256 or SSEKMS. It is ignored when CustomerKey is
+	// set.
+	Algorithm string
+
+	// KMSKeyID is the KMS key used with SSEKMS. When empty, S3 uses the
+	// account's default key.
+	KMSKeyID string
+
+	// CustomerKey is a 256 bit key, held only by the client, that S3
+	// encrypts the object with (SSE-C). The same key must be given to read
+	// the object back. S3 only accepts customer keys over HTTPS.
+	CustomerKey []byte
+}
+
+// NewSSES3 returns options for encryption with keys managed by S3.
+func NewSSES3() *ServerSideEncryption {
+	return &ServerSideEncryption{Algorithm: SSEAES256}
+}
+
+// NewSSEKMS returns options for encryption with a KMS key, which may be empty
+// to use the account's default key.
+func NewSSEKMS(keyID string) *ServerSideEncryption {
+	return &ServerSideEncryption{Algorithm: SSEKMS, KMSKeyID: keyID}
+}
+
+// NewSSEC returns options for encryption with a 256 bit customer key.
+func NewSSEC(key []byte) *ServerSideEncryption {
+	return &ServerSideEncryption{CustomerKey: key}
+}
+
+// validate checks that the options are complete.
+func (e *ServerSideEncryption) validate() error {
+	if e.CustomerKey != nil {
+		if len(e.CustomerKey) != 32 {
+			return fmt.Errorf("SSE-C keys must be 32 bytes; got %d", len(e.CustomerKey))
+		}
+		return nil
+	}
+	switch e.Algorithm {
+	case SSEAES256:
+		if e.KMSKeyID != "" {
+			return errors.New("a KMS key ID requires the aws:kms algorithm")
+		}
+	case SSEKMS:
+	default:
+		return fmt.Errorf("unsupported server-side encryption algorithm: %q", e.Algorithm)
+	}
+	return nil
+}
+
+// setUploadHeaders adds the headers for writing an object.
+func (e *ServerSideEncryption) setUploadHeaders(h http.Header) {
+	if e == nil {
+		return
+	}
+	if e.CustomerKey != nil {
+		e.setCustomerHeaders(h, "X-Amz-Server-Side-Encryption-Customer-")
+		return
+	}
+	h.Set("X-Amz-Server-Side-Encryption", e.Algorithm)
+	if e.KMSKeyID != "" {
+		h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", e.KMSKeyID)
+	}
+}
+
+// setCustomerHeaders adds the customer key headers, which S3 requires for
+// every read and part upload of an SSE-C object, using the given header name
+// prefix. It does nothing unless a customer key is set.
+func (e *ServerSideEncryption) setCustomerHeaders(h http.Header, prefix string) {
+	if e == nil || e.CustomerKey == nil {
+		return
+	}
+	sum := md5.Sum(e.CustomerKey)
+	h.Set(prefix+"Algorithm", SSEAES256)
+	h.Set(prefix+"Key", base64.StdEncoding.EncodeToString(e.CustomerKey))
+	h.Set(prefix+"Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// setKeyHeaders adds the customer key headers needed to read an SSE-C
+// object or upload one of its parts.
+func (e *ServerSideEncryption) setKeyHeaders(h http.Header) {
+	e.setCustomerHeaders(h, "X-Amz-Server-Side-Encryption-Customer-")
+}
+
+// encryptBody adds the server-side encryption headers for a new object to h
+// and, with client-side encryption, returns the encrypted body.
+func (s *S3Uploader) encryptBody(body []byte, h http.Header) ([]byte, error) {
+	r, err := s.encryptStream(bytes.NewReader(body), h)
+	if err != nil || s.envelope == nil {
+		return body, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// encryptStream is like encryptBody for a stream.
+func (s *S3Uploader) encryptStream(r io.Reader, h http.Header) (io.Reader, error) {
+	s.sse.setUploadHeaders(h)
+	if s.envelope == nil {
+		return r, nil
+	}
+	return s.envelope.encrypt(r, h)
+}
+
+// decryptObject wraps the body of an object read from S3 so that it yields
+// the plaintext, and corrects info to describe the plaintext. Objects that
+// were not encrypted on the client are returned as they are.
+func (s *S3Uploader) decryptObject(body io.ReadCloser, info *ObjectInfo) (io.ReadCloser, error) {
+	if !isEnvelopeEncrypted(info) {
+		return body, nil
+	}
+	if s.envelope == nil {
+		return nil, fmt.Errorf("%s: object is encrypted on the client and no key is configured", info.Key)
+	}
+	r, err := s.envelope.decrypt(body, info)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = envelopePlaintextSize(info.Size)
+	return r, nil
+}
+
+// Metadata names, without the x-amz-meta- prefix, under which client-side
+// encrypted objects record how to decrypt them.
+const (
+	// EnvelopeCipherMetadataKey names the format of the encrypted data.
+	EnvelopeCipherMetadataKey = "s3util-cipher"
+
+	// EnvelopeKeyMetadataKey holds the object's data key, encrypted with the
+	// master key.
+	EnvelopeKeyMetadataKey = "s3util-key"
+
+	// EnvelopeKeyIDMetadataKey identifies the master key.
+	EnvelopeKeyIDMetadataKey = "s3util-key-id"
+)
+
+// envelopeCipher is the only supported encrypted data format: AES-256-GCM
+// applied to 64KiB segments of the object.
+const envelopeCipher = "AES256-GCM-STREAM-64K"
+
+const (
+	// envelopeSegmentSize is the plaintext size of every segment but the
+	// last, which is always present and shorter, possibly empty.
+	envelopeSegmentSize = 64 << 10
+
+	// envelopeOverhead is the size of the authentication tag on each
+	// segment.
+	envelopeOverhead = 16
+)
+
+// EnvelopeEncryption encrypts objects on the client before they are sent to
+// S3, so neither S3 nor anyone with access to the bucket can read them. Each
+// object is encrypted with its own random data key, which is stored in the
+// object's metadata encrypted with the master key.
+//
+// Objects are split into segments that are encrypted and authenticated
+// separately, so they can be streamed without buffering while still
+// detecting reordered, modified or truncated data. Reading a range of an
+// encrypted object is not supported.
+type EnvelopeEncryption struct {
+	// KeyID identifies the master key. It is stored with each object.
+	KeyID string
+
+	// Key is the 256 bit master key.
+	Key []byte
+}
+
+func (e *EnvelopeEncryption) validate() error {
+	if len(e.Key) != 32 {
+		return fmt.Errorf("envelope master keys must be 32 bytes; got %d", len(e.Key))
+	}
+	return nil
+}
+
+// newGCM returns an AES-GCM AEAD for a 256 bit key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt wraps r so that it yields the encrypted object, and adds the
+// metadata needed to decrypt it to h.
+func (e *EnvelopeEncryption) encrypt(r io.Reader, h http.Header) (io.Reader, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	master, err := newGCM(e.Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, master.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	wrapped := master.Seal(nonce, nonce, dataKey, []byte(envelopeCipher))
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h.Set("X-Amz-Meta-"+EnvelopeCipherMetadataKey, envelopeCipher)
+	h.Set("X-Amz-Meta-"+EnvelopeKeyMetadataKey, base64.StdEncoding.EncodeToString(wrapped))
+	if e.KeyID != "" {
+		h.Set("X-Amz-Meta-"+EnvelopeKeyIDMetadataKey, e.KeyID)
+	}
+	return &segmentReader{r: r, aead: aead, seal: true}, nil
+}
+
+// decrypt wraps r, which yields an object described by info, so that it
+// yields the decrypted data.
+func (e *EnvelopeEncryption) decrypt(r io.ReadCloser, info *ObjectInfo) (io.ReadCloser, error) {
+	if c := info.Metadata[EnvelopeCipherMetadataKey]; c != envelopeCipher {
+		return nil, fmt.Errorf("%s: unsupported client-side encryption %q", info.Key, c)
+	}
+	if id := info.Metadata[EnvelopeKeyIDMetadataKey]; id != e.KeyID {
+		return nil, fmt.Errorf("%s: encrypted with master key %q, not %q", info.Key, id, e.KeyID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(info.Metadata[EnvelopeKeyMetadataKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid data key: %s", info.Key, err)
+	}
+	master, err := newGCM(e.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < master.NonceSize() {
+		return nil, fmt.Errorf("%s: invalid data key", info.Key)
+	}
+	n := master.NonceSize()
+	dataKey, err := master.Open(nil, wrapped[:n], wrapped[n:], []byte(envelopeCipher))
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not decrypt data key: %s", info.Key, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{r: r, closer: r, aead: aead}, nil
+}
+
+// isEnvelopeEncrypted reports whether an object was encrypted on the client.
+func isEnvelopeEncrypted(info *ObjectInfo) bool {
+	return info.Metadata[EnvelopeCipherMetadataKey] != ""
+}
+
+// envelopeSize returns the encrypted size of plaintext of the given size.
+func envelopeSize(plaintext int64) int64 {
+	segments := plaintext/envelopeSegmentSize + 1
+	return plaintext + segments*envelopeOverhead
+}
+
+// envelopePlaintextSize returns the plaintext size of encrypted data of the
+// given size.
+func envelopePlaintextSize(encrypted int64) int64 {
+	const sealed = envelopeSegmentSize + envelopeOverhead
+	segments := (encrypted + sealed - 1) / sealed
+	if segments == 0 {
+		return 0
+	}
+	return encrypted - segments*envelopeOverhead
+}
+
+// ErrEnvelopeTruncated is returned when client-side encrypted data ends
+// before its final segment.
+var ErrEnvelopeTruncated = errors.New("s3util: encrypted object is truncated")
+
+// segmentReader encrypts or decrypts a stream a segment at a time. Each
+// segment's nonce is its index followed by a byte marking the last segment,
+// which is safe because every object has its own key. Every segment but the
+// last is full, and the last is always present, so truncation at a segment
+// boundary is detected.
+type segmentReader struct {
+	r      io.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	seal   bool
+
+	index uint64
+	in    []byte
+	out   []byte
+	done  bool
+	err   error
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			s.err = io.EOF
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// next reads and processes one segment.
+func (s *segmentReader) next() error {
+	size := envelopeSegmentSize
+	if !s.seal {
+		size += envelopeOverhead
+	}
+	if s.in == nil {
+		s.in = make([]byte, size)
+	}
+	n, err := io.ReadFull(s.r, s.in)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		s.done = true
+	case err != nil:
+		return err
+	}
+	if !s.seal && n < envelopeOverhead {
+		return ErrEnvelopeTruncated
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], s.index)
+	if s.done {
+		nonce[len(nonce)-1] = 1
+	}
+	s.index++
+
+	if s.seal {
+		s.out = s.aead.Seal(s.out[:0], nonce, s.in[:n], nil)
+		return nil
+	}
+	s.out, err = s.aead.Open(s.out[:0], nonce, s.in[:n], nil)
+	if err != nil {
+		if s.done {
+			// The final segment fails when the stream was cut short,
+			// including at a segment boundary.
+			return ErrEnvelopeTruncated
+		}
+		return fmt.Errorf("s3util: encrypted segment %d failed authentication", s.index-1)
+	}
+	return nil
+}
+
+func (s *segmentReader) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+var testMasterKey = &EnvelopeEncryption{KeyID: "test", Key: bytes.Repeat([]byte{7}, 32)}
+
+// encryptForTest encrypts data and returns the ciphertext with the object
+// description needed to decrypt it.
+func encryptForTest(t *testing.T, data []byte) ([]byte, *ObjectInfo) {
+	h := make(http.Header)
+	r, err := testMasterKey.encrypt(bytes.NewReader(data), h)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ct, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return ct, objectInfoFromHeader("key", h)
+}
+
+func decryptForTest(ct []byte, info *ObjectInfo) ([]byte, error) {
+	r, err := testMasterKey.decrypt(ioutil.NopCloser(bytes.NewReader(ct)), info)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, envelopeSegmentSize - 1, envelopeSegmentSize, envelopeSegmentSize + 1, 3*envelopeSegmentSize + 17}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+		ct, info := encryptForTest(t, data)
+		if int64(len(ct)) != envelopeSize(int64(size)) {
+			t.Fatalf("Ciphertext of %d bytes is %d bytes; want %d", size, len(ct), envelopeSize(int64(size)))
+		}
+		if envelopePlaintextSize(int64(len(ct))) != int64(size) {
+			t.Fatalf("Plaintext size of %d bytes computed as %d", size, envelopePlaintextSize(int64(len(ct))))
+		}
+		pt, err := decryptForTest(ct, info)
+		if err != nil {
+			t.Fatalf("Unexpected error decrypting %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(pt, data) {
+			t.Fatalf("Round trip of %d bytes failed", size)
+		}
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	data := make([]byte, 2*envelopeSegmentSize+100)
+	rand.Read(data)
+	ct, info := encryptForTest(t, data)
+	sealed := envelopeSegmentSize + envelopeOverhead
+
+	// Truncation at a segment boundary, within a segment and of the whole
+	// final segment are all detected.
+	for _, n := range []int{sealed, 2 * sealed, sealed + 100, len(ct) - 1} {
+		if _, err := decryptForTest(ct[:n], info); err != ErrEnvelopeTruncated {
+			t.Errorf("Truncating to %d bytes: expected ErrEnvelopeTruncated; got %v", n, err)
+		}
+	}
+
+	flipped := append([]byte(nil), ct...)
+	flipped[10] ^= 1
+	if _, err := decryptForTest(flipped, info); err == nil {
+		t.Error("Expected a modified segment to fail")
+	}
+
+	swapped := append(append(append([]byte(nil), ct[sealed:2*sealed]...), ct[:sealed]...), ct[2*sealed:]...)
+	if _, err := decryptForTest(swapped, info); err == nil {
+		t.Error("Expected reordered segments to fail")
+	}
+
+	other := &EnvelopeEncryption{KeyID: "test", Key: bytes.Repeat([]byte{8}, 32)}
+	if _, err := other.decrypt(ioutil.NopCloser(bytes.NewReader(ct)), info); err == nil {
+		t.Error("Expected the wrong master key to fail")
+	}
+}
+
+func TestServerSideEncryptionHeaders(t *testing.T) {
+	h := make(http.Header)
+	NewSSEKMS("alias/builds").setUploadHeaders(h)
+	if h.Get("X-Amz-Server-Side-Encryption") != "aws:kms" ||
+		h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "alias/builds" {
+		t.Fatalf("Unexpected SSE-KMS headers %v", h)
+	}
+
+	h = make(http.Header)
+	NewSSES3().setKeyHeaders(h)
+	if len(h) != 0 {
+		t.Fatalf("SSE-S3 should not send headers on reads; got %v", h)
+	}
+
+	h = make(http.Header)
+	NewSSEC(bytes.Repeat([]byte{1}, 32)).setKeyHeaders(h)
+	if h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" ||
+		h.Get("X-Amz-Server-Side-Encryption-Customer-Key") != "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=" ||
+		h.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") != "4Funlf7OsLF0HL+vKU+fkg==" {
+		t.Fatalf("Unexpected SSE-C headers %v", h)
+	}
+
+	bad := []*ServerSideEncryption{
+		{Algorithm: "DES"},
+		{Algorithm: SSEAES256, KMSKeyID: "key"},
+		NewSSEC([]byte("short")),
+	}
+	for _, e := range bad {
+		if err := e.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", e)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apcera/util/internal/sigv4"
+)
+
+// Limits imposed by S3 on multipart uploads.
+// Docs: http://docs.aws.amazon.com/AmazonS3/latest/dev/qfacts.html
+const (
+	// MinPartSize is the smallest size allowed for any part but the last.
+	MinPartSize = 5 << 20
+
+	// MaxParts is the largest number of parts in a single upload.
+	MaxParts = 10000
+
+	// DefaultPartSize is the part size used when none is given.
+	DefaultPartSize = 8 << 20
+
+	// DefaultConcurrency is the number of parts uploaded at once when no
+	// concurrency is given.
+	DefaultConcurrency = 4
+
+	// DefaultPartRetries is the number of times a failed part is retried when
+	// no retry count is given.
+	DefaultPartRetries = 3
+)
+
+// retryBackoff is the delay before the first retry of a part. It doubles with
+// each further attempt.
+var retryBackoff = 500 * time.Millisecond
+
+// maxParts is the number of parts an upload is limited to. It is MaxParts
+// except in tests.
+var maxParts = MaxParts
+
+// MultipartOptions controls how UploadMultipart splits and sends data. The
+// zero value uses the defaults.
+type MultipartOptions struct {
+	// PartSize is the size of each part. It must be at least MinPartSize.
+	PartSize int64
+
+	// Concurrency is the number of parts uploaded at once. At most
+	// Concurrency+1 parts are held in memory.
+	Concurrency int
+
+	// Retries is the number of times each part is retried after a temporary
+	// failure. A negative value disables retries.
+	Retries int
+
+	// ObjectOptions are the headers stored with the assembled object.
+	ObjectOptions
+}
+
+// withDefaults returns a copy of the options with unset fields defaulted.
+func (o *MultipartOptions) withDefaults() (MultipartOptions, error) {
+	var r MultipartOptions
+	if o != nil {
+		r = *o
+	}
+	if r.PartSize == 0 {
+		r.PartSize = DefaultPartSize
+	} else if r.PartSize < MinPartSize {
+		return r, fmt.Errorf("part size %d is smaller than the minimum of %d", r.PartSize, MinPartSize)
+	}
+	if r.Concurrency <= 0 {
+		r.Concurrency = DefaultConcurrency
+	}
+	if r.Retries == 0 {
+		r.Retries = DefaultPartRetries
+	} else if r.Retries < 0 {
+		r.Retries = 0
+	}
+	return r, nil
+}
+
+// sniffLen is the amount of data http.DetectContentType considers.
+const sniffLen = 512
+
+// readerSize returns the number of bytes left in r, or -1 if it cannot be
+// determined without reading.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface {
+		Len() int
+	}:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - pos
+	}
+	return -1
+}
+
+// completedPart identifies an uploaded part when completing an upload.
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// byPartNumber sorts parts into the order S3 requires.
+type byPartNumber []completedPart
+
+func (p byPartNumber) Len() int           { return len(p) }
+func (p byPartNumber) Less(i, j int) bool { return p[i].PartNumber < p[j].PartNumber }
+func (p byPartNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// UploadMultipart streams r to the named object using a multipart upload, so
+// that the data never needs to be held in memory in full. Parts are uploaded
+// concurrently, each with its own MD5, and retried individually on temporary
+// failures. If any part cannot be uploaded, the upload is aborted so S3 does
+// not keep the parts that were stored. Unless given, the content type is
+// inferred from the key and the start of the data.
+func (s *S3Uploader) UploadMultipart(key string, r io.Reader, opts *MultipartOptions) error {
+	o, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	// Peek at the start of the data in case the content type is sniffed.
+	total := readerSize(r)
+	if s.envelope != nil && total >= 0 {
+		total = envelopeSize(total)
+	}
+	progress := s.newProgress(key, total)
+	defer progress.done()
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	header, err := o.header(key, head)
+	if err != nil {
+		return err
+	}
+	body, err := s.encryptStream(br, header)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(s.out, "Uploading %q to s3 bucket %q in parts...", key, s.s3url.String())
+	uploadID, err := s.initiateMultipart(key, header)
+	if err != nil {
+		fmt.Fprintln(s.out, " error")
+		return err
+	}
+
+	parts, err := s.uploadParts(key, uploadID, body, o, progress)
+	if err == nil {
+		err = s.completeMultipart(key, uploadID, parts)
+	}
+	if err != nil {
+		fmt.Fprintln(s.out, " error")
+		if aerr := s.abortMultipart(key, uploadID); aerr != nil {
+			fmt.Fprintf(s.out, "Failed to abort upload %q: %s\n", uploadID, aerr)
+		}
+		return err
+	}
+	fmt.Fprintln(s.out, " done")
+	return nil
+}
+
+// initiateMultipart starts a multipart upload of an object with the given
+// headers and returns its ID.
+func (s *S3Uploader) initiateMultipart(key string, header http.Header) (string, error) {
+	req, err := s.newRequest("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Amz-Acl", s.permission)
+
+	var result initiateMultipartUploadResult
+	if err := s.doXML(req, nil, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("S3 did not return an upload ID for %q", key)
+	}
+	return result.UploadID, nil
+}
+
+// uploadParts reads r in PartSize chunks and uploads them with a bounded
+// number of workers. It stops at the first part that fails.
+func (s *S3Uploader) uploadParts(key, uploadID string, r io.Reader, o MultipartOptions, progress *progressTracker) ([]completedPart, error) {
+	type part struct {
+		number int
+		data   []byte
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		parts    []completedPart
+	)
+	work := make(chan part)
+	failed := make(chan struct{})
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				etag, err := s.uploadPart(key, uploadID, p.number, p.data, o.Retries, progress)
+				if err != nil {
+					fail(fmt.Errorf("part %d: %s", p.number, err))
+					continue
+				}
+				mu.Lock()
+				parts = append(parts, completedPart{PartNumber: p.number, ETag: etag})
+				mu.Unlock()
+			}
+		}()
+	}
+
+read:
+	for n := 1; ; n++ {
+		buf := make([]byte, o.PartSize)
+		m, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+		// Only data beyond the last allowed part is too much, so a stream
+		// that exactly fills maxParts parts is accepted.
+		if m > 0 && n > maxParts {
+			fail(fmt.Errorf("upload exceeds %d parts; use a larger part size", maxParts))
+			break
+		}
+		// An empty stream is still uploaded as a single empty part.
+		if m > 0 || n == 1 {
+			select {
+			case work <- part{number: n, data: buf[:m]}:
+			case <-failed:
+				break read
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Sort(byPartNumber(parts))
+	return parts, nil
+}
+
+// uploadPart uploads a single part, retrying temporary failures, and returns
+// its ETag.
+func (s *S3Uploader) uploadPart(key, uploadID string, number int, data []byte, retries int, progress *progressTracker) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {uploadID},
+	}
+	payloadHash := sigv4.PayloadSha256(data)
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff << uint(attempt-1))
+		}
+
+		var req *http.Request
+		req, err = s.newRequest("PUT", key, query, data)
+		if err != nil {
+			return "", err
+		}
+		s.sse.setKeyHeaders(req.Header)
+		if err = s.sign(req, payloadHash); err != nil {
+			return "", err
+		}
+		var body *progressReader
+		if progress != nil {
+			body = progress.reader(req.Body)
+			req.Body = body
+		}
+		var resp *http.Response
+		resp, err = s.do(req, http.StatusOK)
+		if err != nil {
+			if body != nil {
+				body.rewind()
+			}
+			if s3err, ok := err.(*S3Error); ok && !s3err.temporary() {
+				return "", err
+			}
+			continue
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("Etag")
+		if etag == "" {
+			return "", fmt.Errorf("S3 did not return an ETag")
+		}
+		return etag, nil
+	}
+	return "", err
+}
+
+// completeMultipart assembles the uploaded parts into the final object.
+func (s *S3Uploader) completeMultipart(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest("POST", key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	return s.doXML(req, body, nil)
+}
+
+// abortMultipart discards an upload along with any parts already stored.
+func (s *S3Uploader) abortMultipart(key, uploadID string) error {
+	req, err := s.newRequest("DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.sign(req, sigv4.PayloadSha256(nil)); err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
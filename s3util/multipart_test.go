@@ -0,0 +1,219 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// multipartServer is a minimal stand-in for the S3 multipart API.
+type multipartServer struct {
+	mu        sync.Mutex
+	parts     map[int][]byte
+	attempts  map[int]int
+	object    []byte
+	aborted   bool
+	failPart  int
+	failTimes int
+	failCode  int
+}
+
+func (m *multipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case r.Method == "POST" && q.Get("uploads") == "" && len(q["uploads"]) == 1:
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == "PUT" && q.Get("uploadId") == "upload-1":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		m.attempts[n]++
+		b, _ := ioutil.ReadAll(r.Body)
+		if n == m.failPart && m.attempts[n] <= m.failTimes {
+			w.WriteHeader(m.failCode)
+			fmt.Fprintf(w, "<Error><Code>Injected</Code><Message>part %d</Message></Error>", n)
+			return
+		}
+		h := md5.Sum(b)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(h[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.parts[n] = b
+		w.Header().Set("ETag", `"`+hex.EncodeToString(h[:])+`"`)
+	case r.Method == "POST" && q.Get("uploadId") == "upload-1":
+		var c completeMultipartUpload
+		if err := xml.NewDecoder(r.Body).Decode(&c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		for i, p := range c.Parts {
+			if p.PartNumber != i+1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			buf.Write(m.parts[p.PartNumber])
+		}
+		m.object = buf.Bytes()
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"x-3"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == "DELETE" && q.Get("uploadId") == "upload-1":
+		m.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newMultipartTest(t *testing.T) (*S3Uploader, *multipartServer, func()) {
+	if err := os.Setenv(AWS_SECRET_KEY, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	if err := os.Setenv(AWS_ACCESS_KEY_ID, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	uploader, err := NewS3Uploader("test-uploads", "private", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	m := &multipartServer{parts: make(map[int][]byte), attempts: make(map[int]int)}
+	ts := httptest.NewServer(m)
+	uploader.s3url, err = url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	return uploader, m, func() {
+		retryBackoff = backoff
+		ts.Close()
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+
+	data := make([]byte, 2*MinPartSize+100)
+	rand.Read(data)
+	m.failPart, m.failTimes, m.failCode = 2, 2, http.StatusInternalServerError
+
+	opts := &MultipartOptions{PartSize: MinPartSize, Concurrency: 2}
+	if err := uploader.UploadMultipart("big.tgz", bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(m.parts) != 3 {
+		t.Fatalf("Expected 3 parts; got %d", len(m.parts))
+	}
+	if m.attempts[2] != 3 {
+		t.Fatalf("Expected part 2 to be attempted 3 times; got %d", m.attempts[2])
+	}
+	if !bytes.Equal(m.object, data) {
+		t.Fatal("Assembled object does not match uploaded data")
+	}
+	if m.aborted {
+		t.Fatal("Successful upload should not be aborted")
+	}
+}
+
+func TestUploadMultipartEmpty(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+
+	if err := uploader.UploadMultipart("empty", bytes.NewReader(nil), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(m.parts) != 1 || len(m.object) != 0 {
+		t.Fatalf("Expected a single empty part; got %d parts", len(m.parts))
+	}
+}
+
+func TestUploadMultipartAbort(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+
+	data := make([]byte, MinPartSize+1)
+	m.failPart, m.failTimes, m.failCode = 2, 1, http.StatusForbidden
+
+	err := uploader.UploadMultipart("big.tgz", bytes.NewReader(data), &MultipartOptions{PartSize: MinPartSize})
+	if err == nil {
+		t.Fatal("Expected upload to fail")
+	}
+	if m.attempts[2] != 1 {
+		t.Fatalf("Permanent errors should not be retried; got %d attempts", m.attempts[2])
+	}
+	if !m.aborted {
+		t.Fatal("Expected failed upload to be aborted")
+	}
+	if m.object != nil {
+		t.Fatal("Failed upload should not be completed")
+	}
+}
+
+func TestUploadMultipartMaxParts(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+
+	limit := maxParts
+	maxParts = 3
+	defer func() { maxParts = limit }()
+
+	// A stream that exactly fills the last allowed part fits.
+	data := make([]byte, 3*MinPartSize)
+	rand.Read(data)
+	opts := &MultipartOptions{PartSize: MinPartSize}
+	if err := uploader.UploadMultipart("exact.tgz", bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(m.parts) != 3 || !bytes.Equal(m.object, data) {
+		t.Fatalf("Expected 3 parts matching the data; got %d parts", len(m.parts))
+	}
+
+	// One more byte does not.
+	data = append(data, 0)
+	if err := uploader.UploadMultipart("over.tgz", bytes.NewReader(data), opts); err == nil {
+		t.Fatal("Expected upload exceeding the part limit to fail")
+	}
+	if !m.aborted {
+		t.Fatal("Expected failed upload to be aborted")
+	}
+}
+
+func TestMultipartOptions(t *testing.T) {
+	if _, err := (&MultipartOptions{PartSize: 1024}).withDefaults(); err == nil {
+		t.Fatal("Expected error for part size below the minimum")
+	}
+	o, err := (*MultipartOptions)(nil).withDefaults()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if o.PartSize != DefaultPartSize || o.Concurrency != DefaultConcurrency || o.Retries != DefaultPartRetries {
+		t.Fatalf("Unexpected defaults: %+v", o)
+	}
+	o, _ = (&MultipartOptions{Retries: -1}).withDefaults()
+	if o.Retries != 0 {
+		t.Fatalf("Expected negative retries to disable retrying; got %d", o.Retries)
+	}
+}
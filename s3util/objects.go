@@ -0,0 +1,566 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apcera/util/internal/sigv4"
+)
+
+// maxDeleteKeys is the most keys S3 accepts in a single batch delete.
+const maxDeleteKeys = 1000
+
+// DefaultReadRetries is the number of times an object download is resumed
+// after a dropped connection.
+const DefaultReadRetries = 3
+
+// An ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	ContentType  string
+	StorageClass string
+
+	// Metadata holds the user defined x-amz-meta-* headers, keyed by the
+	// lower case name without the prefix.
+	Metadata map[string]string
+}
+
+// objectInfoFromHeader builds an ObjectInfo from the headers of a HEAD or GET
+// response.
+func objectInfoFromHeader(key string, h http.Header) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:          key,
+		ETag:         h.Get("Etag"),
+		ContentType:  h.Get("Content-Type"),
+		StorageClass: h.Get("X-Amz-Storage-Class"),
+		Metadata:     make(map[string]string),
+	}
+	info.Size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if cr := h.Get("Content-Range"); cr != "" {
+		// Content-Range: bytes 0-9/443
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				info.Size = total
+			}
+		}
+	}
+	info.LastModified, _ = http.ParseTime(h.Get("Last-Modified"))
+	for k, v := range h {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-meta-") && len(v) > 0 {
+			info.Metadata[strings.TrimPrefix(lk, "x-amz-meta-")] = v[0]
+		}
+	}
+	return info
+}
+
+// HeadObject returns the metadata of the named object without downloading
+// it. Use IsNotFound to check for a missing object.
+func (s *S3Uploader) HeadObject(key string) (*ObjectInfo, error) {
+	req, err := s.newRequest("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sse.setKeyHeaders(req.Header)
+	if err := s.sign(req, sigv4.PayloadSha256(nil)); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := objectInfoFromHeader(key, resp.Header)
+	if isEnvelopeEncrypted(info) {
+		info.Size = envelopePlaintextSize(info.Size)
+	}
+	return info, nil
+}
+
+// GetOptions selects part of an object to download.
+type GetOptions struct {
+	// Offset is the first byte to return.
+	Offset int64
+
+	// Length is the number of bytes to return. Zero means the rest of the
+	// object.
+	Length int64
+
+	// IfMatch, when set, fails the download if the object's ETag differs.
+	IfMatch string
+
+	// Retries is the number of times the download resumes after a dropped
+	// connection. It defaults to DefaultReadRetries and a negative value
+	// disables resuming.
+	Retries int
+}
+
+// GetObject downloads the named object, or the range of it selected by opts,
+// which may be nil. The returned reader transparently resumes from the last
+// byte read if the connection drops, using the object's ETag to make sure it
+// has not changed in the meantime. The ObjectInfo describes the whole object.
+// Objects encrypted on the client are decrypted as they are read.
+func (s *S3Uploader) GetObject(key string, opts *GetOptions) (io.ReadCloser, *ObjectInfo, error) {
+	var o GetOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Offset < 0 || o.Length < 0 {
+		return nil, nil, fmt.Errorf("invalid range: offset %d, length %d", o.Offset, o.Length)
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultReadRetries
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+
+	r := &objectReader{
+		s:       s,
+		key:     key,
+		etag:    o.IfMatch,
+		offset:  o.Offset,
+		end:     -1,
+		retries: o.Retries,
+	}
+	if o.Length > 0 {
+		r.end = o.Offset + o.Length
+	}
+	info, err := r.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if isEnvelopeEncrypted(info) && (o.Offset > 0 || o.Length > 0) {
+		r.Close()
+		return nil, nil, fmt.Errorf("%s: ranges of client-side encrypted objects cannot be read", key)
+	}
+	body, err := s.decryptObject(r, info)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return body, info, nil
+}
+
+// An objectReader reads an object, reopening it at the current offset when
+// a read fails.
+type objectReader struct {
+	s    *S3Uploader
+	key  string
+	etag string
+	body io.ReadCloser
+
+	// offset is the next byte to read and end is one past the last byte
+	// wanted, or -1 for the end of the object.
+	offset int64
+	end    int64
+
+	retries int
+}
+
+// open requests the object from the current offset.
+func (r *objectReader) open() (*ObjectInfo, error) {
+	req, err := r.s.newRequest("GET", r.key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ranged := r.offset > 0 || r.end >= 0
+	if ranged {
+		rng := fmt.Sprintf("bytes=%d-", r.offset)
+		if r.end >= 0 {
+			rng += strconv.FormatInt(r.end-1, 10)
+		}
+		req.Header.Set("Range", rng)
+	}
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	}
+	r.s.sse.setKeyHeaders(req.Header)
+	if err := r.s.sign(req, sigv4.PayloadSha256(nil)); err != nil {
+		return nil, err
+	}
+
+	expected := http.StatusOK
+	if ranged {
+		expected = http.StatusPartialContent
+	}
+	resp, err := r.s.do(req, expected)
+	if err != nil {
+		return nil, err
+	}
+	info := objectInfoFromHeader(r.key, resp.Header)
+	r.etag = info.ETag
+	r.body = resp.Body
+	return info, nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if _, err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || r.retries == 0 {
+			return n, err
+		}
+
+		// The connection dropped; resume from where we are on the next read.
+		r.retries--
+		r.body.Close()
+		r.body = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// DownloadFile downloads the named object to path. Data is first written to
+// path+".partial" and renamed into place when complete. If a previous
+// download of the same object version was interrupted, it continues from the
+// end of the partial file instead of starting over.
+func (s *S3Uploader) DownloadFile(key, path string) error {
+	info, err := s.HeadObject(key)
+	if err != nil {
+		return err
+	}
+
+	partial := path + ".partial"
+	etagFile := partial + ".etag"
+
+	var offset int64
+	// Client-side encrypted objects can only be read from the start.
+	if b, err := ioutil.ReadFile(etagFile); err == nil && string(b) == info.ETag && !isEnvelopeEncrypted(info) {
+		if fi, err := os.Stat(partial); err == nil && fi.Size() <= info.Size {
+			offset = fi.Size()
+		}
+	}
+	if offset == 0 {
+		if err := ioutil.WriteFile(etagFile, []byte(info.ETag), 0644); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		return err
+	}
+
+	if offset < info.Size {
+		fmt.Fprintf(s.out, "Downloading %q from s3 bucket %q...", key, s.s3url.String())
+		r, _, err := s.GetObject(key, &GetOptions{Offset: offset, IfMatch: info.ETag})
+		if err != nil {
+			fmt.Fprintln(s.out, " error")
+			return err
+		}
+		_, err = io.Copy(f, r)
+		r.Close()
+		if err != nil {
+			fmt.Fprintln(s.out, " error")
+			return err
+		}
+		fmt.Fprintln(s.out, " done")
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+	return os.Remove(etagFile)
+}
+
+// ListOptions filters the results of ListObjects.
+type ListOptions struct {
+	// Prefix limits the results to keys beginning with it.
+	Prefix string
+
+	// Delimiter groups keys sharing the same prefix up to the delimiter into
+	// a single common prefix, such as "/" to list one level of a tree.
+	Delimiter string
+
+	// StartAfter lists only keys that sort after it.
+	StartAfter string
+
+	// MaxKeys limits the number of keys in a single page. S3 defaults to
+	// 1000.
+	MaxKeys int
+}
+
+// A ListPage is a single page of listing results.
+type ListPage struct {
+	Objects        []ObjectInfo
+	CommonPrefixes []string
+
+	// NextToken is set when there are more results, and can be passed to
+	// ListObjectsPage to get the next page.
+	NextToken string
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// ListObjectsPage returns a single page of objects in the bucket, starting at
+// the continuation token if it is not empty.
+func (s *S3Uploader) ListObjectsPage(opts *ListOptions, token string) (*ListPage, error) {
+	var o ListOptions
+	if opts != nil {
+		o = *opts
+	}
+	query := url.Values{"list-type": {"2"}}
+	if o.Prefix != "" {
+		query.Set("prefix", o.Prefix)
+	}
+	if o.Delimiter != "" {
+		query.Set("delimiter", o.Delimiter)
+	}
+	if o.StartAfter != "" {
+		query.Set("start-after", o.StartAfter)
+	}
+	if o.MaxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(o.MaxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+
+	req, err := s.newRequest("GET", "", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result listBucketResult
+	if err := s.doXML(req, nil, &result); err != nil {
+		return nil, err
+	}
+
+	page := &ListPage{}
+	for _, c := range result.Contents {
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          c.Key,
+			Size:         c.Size,
+			ETag:         c.ETag,
+			LastModified: c.LastModified,
+			StorageClass: c.StorageClass,
+		})
+	}
+	for _, p := range result.CommonPrefixes {
+		page.CommonPrefixes = append(page.CommonPrefixes, p.Prefix)
+	}
+	if result.IsTruncated {
+		page.NextToken = result.NextContinuationToken
+	}
+	return page, nil
+}
+
+// ListObjects returns every object and common prefix in the bucket matching
+// opts, which may be nil, following continuation tokens as needed.
+func (s *S3Uploader) ListObjects(opts *ListOptions) ([]ObjectInfo, []string, error) {
+	var objects []ObjectInfo
+	var prefixes []string
+	token := ""
+	for {
+		page, err := s.ListObjectsPage(opts, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, page.Objects...)
+		prefixes = append(prefixes, page.CommonPrefixes...)
+		if page.NextToken == "" {
+			return objects, prefixes, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// putObject stores body as the named object in a single request, adding the
+// given headers, and returns the new ETag.
+func (s *S3Uploader) putObject(key string, body []byte, header http.Header) (string, error) {
+	body, err := s.encryptBody(body, header)
+	if err != nil {
+		return "", err
+	}
+	req, err := s.newRequest("PUT", key, nil, body)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Amz-Acl", s.permission)
+	if err := s.sign(req, sigv4.PayloadSha256(body)); err != nil {
+		return "", err
+	}
+	progress := s.newProgress(key, int64(len(body)))
+	if progress != nil {
+		req.Body = progress.reader(req.Body)
+		defer progress.done()
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Etag"), nil
+}
+
+// DeleteObject removes the named object. Deleting an object that does not
+// exist is not an error.
+func (s *S3Uploader) DeleteObject(key string) error {
+	req, err := s.newRequest("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.sign(req, sigv4.PayloadSha256(nil)); err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// A DeleteError describes a key that could not be removed by DeleteObjects.
+type DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+// A BatchDeleteError is returned by DeleteObjects when some keys could not be
+// removed.
+type BatchDeleteError struct {
+	Errors []DeleteError
+}
+
+func (e *BatchDeleteError) Error() string {
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("failed to delete %q: %s", e.Errors[0].Key, e.Errors[0].Message)
+	}
+	return fmt.Sprintf("failed to delete %d objects, including %q: %s",
+		len(e.Errors), e.Errors[0].Key, e.Errors[0].Message)
+}
+
+type deleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	Errors []DeleteError `xml:"Error"`
+}
+
+// DeleteObjects removes many objects using as few requests as possible. If
+// some keys could not be removed, a *BatchDeleteError lists them.
+func (s *S3Uploader) DeleteObjects(keys []string) error {
+	var failed []DeleteError
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+
+		d := deleteRequest{Quiet: true}
+		for _, k := range keys[:n] {
+			d.Objects = append(d.Objects, struct{ Key string }{k})
+		}
+		keys = keys[n:]
+
+		body, err := xml.Marshal(d)
+		if err != nil {
+			return err
+		}
+		req, err := s.newRequest("POST", "", url.Values{"delete": {""}}, body)
+		if err != nil {
+			return err
+		}
+		var result deleteResult
+		if err := s.doXML(req, body, &result); err != nil {
+			return err
+		}
+		failed = append(failed, result.Errors...)
+	}
+	if len(failed) > 0 {
+		return &BatchDeleteError{Errors: failed}
+	}
+	return nil
+}
+
+type copyObjectResult struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// CopyObject copies an object within S3 without downloading it. If
+// srcBucket is empty the source is in this uploader's bucket. The copy keeps
+// the source's metadata and gets this uploader's permission. It returns the
+// ETag of the new object.
+func (s *S3Uploader) CopyObject(srcBucket, srcKey, dstKey string) (string, error) {
+	if srcBucket == "" {
+		srcBucket = s.bucketName
+	}
+	req, err := s.newRequest("PUT", dstKey, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Amz-Copy-Source", sigv4.URIEncode("/"+srcBucket+"/"+srcKey, false))
+	req.Header.Set("X-Amz-Metadata-Directive", "COPY")
+	req.Header.Set("X-Amz-Acl", s.permission)
+	// The copy is encrypted like a new upload, and a customer key is needed
+	// to read the source too.
+	s.sse.setUploadHeaders(req.Header)
+	s.sse.setCustomerHeaders(req.Header, "X-Amz-Copy-Source-Server-Side-Encryption-Customer-")
+
+	var result copyObjectResult
+	if err := s.doXML(req, nil, &result); err != nil {
+		return "", err
+	}
+	return result.ETag, nil
+}
@@ -0,0 +1,366 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// objectServer is a minimal stand-in for the S3 object API.
+type objectServer struct {
+	mu      sync.Mutex
+	objects map[string]string
+
+	// dropAfter, when positive, cuts off the next GET response after that
+	// many bytes.
+	dropAfter int
+}
+
+func etagOf(data string) string {
+	return fmt.Sprintf(`"%x"`, len(data)*31+len(data)%7)
+}
+
+func (o *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && key == "" && q.Get("list-type") == "2":
+		o.list(w, q)
+	case r.Method == "POST" && key == "" && len(q["delete"]) == 1:
+		var d deleteRequest
+		xml.NewDecoder(r.Body).Decode(&d)
+		var res deleteResult
+		for _, obj := range d.Objects {
+			if obj.Key == "locked" {
+				res.Errors = append(res.Errors, DeleteError{Key: obj.Key, Code: "AccessDenied", Message: "Access Denied"})
+				continue
+			}
+			delete(o.objects, obj.Key)
+		}
+		b, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+			deleteResult
+		}{deleteResult: res})
+		w.Write(b)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.QueryUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		data, ok := o.objects[strings.TrimPrefix(src, "/test-uploads/")]
+		if !ok {
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>missing source</Message></Error>")
+			return
+		}
+		o.objects[key] = data
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>2016-01-02T03:04:05.000Z</LastModified></CopyObjectResult>", etagOf(data))
+	case r.Method == "DELETE":
+		delete(o.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := o.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && m != etagOf(data) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", etagOf(data))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Last-Modified", "Sat, 02 Jan 2016 03:04:05 GMT")
+		w.Header().Set("X-Amz-Meta-Build", "42")
+		start, end := 0, len(data)
+		code := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+			start, _ = strconv.Atoi(parts[0])
+			if parts[1] != "" {
+				end, _ = strconv.Atoi(parts[1])
+				end++
+			}
+			code = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+		}
+		body := data[start:end]
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(code)
+		if r.Method == "HEAD" {
+			return
+		}
+		if o.dropAfter > 0 && o.dropAfter < len(body) {
+			w.Write([]byte(body[:o.dropAfter]))
+			o.dropAfter = 0
+			w.(http.Flusher).Flush()
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(body))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (o *objectServer) list(w http.ResponseWriter, q url.Values) {
+	var keys []string
+	for k := range o.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	max, _ := strconv.Atoi(q.Get("max-keys"))
+	if max == 0 {
+		max = 1000
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<ListBucketResult>")
+	seen := make(map[string]bool)
+	count := 0
+	for _, k := range keys {
+		if count == max {
+			fmt.Fprintf(&buf, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[count-1])
+			break
+		}
+		count++
+		if d := q.Get("delimiter"); d != "" {
+			rest := strings.TrimPrefix(k, q.Get("prefix"))
+			if i := strings.Index(rest, d); i >= 0 {
+				p := q.Get("prefix") + rest[:i+len(d)]
+				if !seen[p] {
+					seen[p] = true
+					fmt.Fprintf(&buf, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", p)
+				}
+				continue
+			}
+		}
+		fmt.Fprintf(&buf, "<Contents><Key>%s</Key><LastModified>2016-01-02T03:04:05.000Z</LastModified>"+
+			"<ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>",
+			k, etagOf(o.objects[k]), len(o.objects[k]))
+	}
+	buf.WriteString("</ListBucketResult>")
+	w.Write(buf.Bytes())
+}
+
+func newObjectTest(t *testing.T) (*S3Uploader, *objectServer, func()) {
+	if err := os.Setenv(AWS_SECRET_KEY, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	if err := os.Setenv(AWS_ACCESS_KEY_ID, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	uploader, err := NewS3Uploader("test-uploads", "private", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	o := &objectServer{objects: map[string]string{
+		"a.txt":        "0123456789",
+		"dir/b.txt":    "bbb",
+		"dir/c.txt":    "ccc",
+		"dir/sub/d.gz": "ddd",
+	}}
+	ts := httptest.NewServer(o)
+	uploader.s3url, err = url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return uploader, o, ts.Close
+}
+
+func TestHeadObject(t *testing.T) {
+	uploader, _, done := newObjectTest(t)
+	defer done()
+
+	info, err := uploader.HeadObject("a.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Size != 10 || info.ETag != etagOf("0123456789") || info.ContentType != "text/plain" {
+		t.Fatalf("Unexpected object info: %+v", info)
+	}
+	if info.Metadata["build"] != "42" {
+		t.Fatalf("Expected user metadata; got %v", info.Metadata)
+	}
+	if info.LastModified.Year() != 2016 {
+		t.Fatalf("Unexpected last modified time %s", info.LastModified)
+	}
+
+	if _, err := uploader.HeadObject("missing"); !IsNotFound(err) {
+		t.Fatalf("Expected not found error; got %v", err)
+	}
+}
+
+func TestGetObjectRange(t *testing.T) {
+	uploader, _, done := newObjectTest(t)
+	defer done()
+
+	r, info, err := uploader.GetObject("a.txt", &GetOptions{Offset: 2, Length: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(b) != "23456" {
+		t.Fatalf("Expected range 23456; got %q", string(b))
+	}
+	if info.Size != 10 {
+		t.Fatalf("Expected size of the whole object; got %d", info.Size)
+	}
+
+	if _, _, err := uploader.GetObject("a.txt", &GetOptions{IfMatch: `"nope"`}); err == nil {
+		t.Fatal("Expected precondition failure")
+	}
+}
+
+func TestGetObjectResume(t *testing.T) {
+	uploader, o, done := newObjectTest(t)
+	defer done()
+
+	o.dropAfter = 4
+	r, _, err := uploader.GetObject("a.txt", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("Expected resumed download to be complete; got %q", string(b))
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	uploader, _, done := newObjectTest(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "s3util")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+
+	// Simulate an interrupted download of the same version.
+	if err := ioutil.WriteFile(path+".partial", []byte("0123"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(path+".partial.etag", []byte(etagOf("0123456789")), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := uploader.DownloadFile("a.txt", path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("Unexpected downloaded contents %q", string(b))
+	}
+	if _, err := os.Stat(path + ".partial.etag"); !os.IsNotExist(err) {
+		t.Fatal("Expected resume state to be removed")
+	}
+
+	// A partial file from another version is discarded.
+	if err := ioutil.WriteFile(path+".partial", []byte("xxxxxxxx"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := uploader.DownloadFile("dir/b.txt", path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "bbb" {
+		t.Fatalf("Unexpected downloaded contents %q", string(b))
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	uploader, _, done := newObjectTest(t)
+	defer done()
+
+	objects, prefixes, err := uploader.ListObjects(&ListOptions{Prefix: "dir/", Delimiter: "/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "dir/b.txt" || objects[1].Size != 3 {
+		t.Fatalf("Unexpected objects: %+v", objects)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "dir/sub/" {
+		t.Fatalf("Unexpected prefixes: %v", prefixes)
+	}
+
+	page, err := uploader.ListObjectsPage(&ListOptions{MaxKeys: 3}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(page.Objects) != 3 || page.NextToken == "" {
+		t.Fatalf("Expected a truncated first page; got %+v", page)
+	}
+
+	objects, _, err = uploader.ListObjects(&ListOptions{MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(objects) != 4 {
+		t.Fatalf("Expected all 4 objects across pages; got %d", len(objects))
+	}
+}
+
+func TestDeleteAndCopyObjects(t *testing.T) {
+	uploader, o, done := newObjectTest(t)
+	defer done()
+
+	etag, err := uploader.CopyObject("", "a.txt", "copy.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if etag != etagOf("0123456789") || o.objects["copy.txt"] != "0123456789" {
+		t.Fatalf("Unexpected copy result %q", etag)
+	}
+	if _, err := uploader.CopyObject("", "missing", "copy2.txt"); err == nil {
+		t.Fatal("Expected copy of a missing object to fail")
+	}
+
+	if err := uploader.DeleteObject("copy.txt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := o.objects["copy.txt"]; ok {
+		t.Fatal("Expected object to be deleted")
+	}
+
+	o.objects["locked"] = "x"
+	err = uploader.DeleteObjects([]string{"dir/b.txt", "dir/c.txt", "locked"})
+	berr, ok := err.(*BatchDeleteError)
+	if !ok || len(berr.Errors) != 1 || berr.Errors[0].Key != "locked" {
+		t.Fatalf("Expected batch delete error for the locked key; got %v", err)
+	}
+	if len(o.objects) != 3 {
+		t.Fatalf("Expected two objects to be deleted; have %v", o.objects)
+	}
+}
@@ -14,6 +14,9 @@ import (
 
 // Zipper zips file contents at a path. Helper to prepare zipped data for upload
 // to S3.
+//
+// Deprecated: Zipper holds the whole archive in memory and handles a single
+// file. Use WriteArchive or UploadArchive instead.
 func Zipper(zipPath string) (*bytes.Buffer, error) {
 	f, err := os.Open(zipPath)
 	if err != nil {
@@ -63,6 +66,9 @@ func Zipper(zipPath string) (*bytes.Buffer, error) {
 
 // Gzipper gzips the file at the path. Helper to prepare gzipped data for upload
 // to S3.
+//
+// Deprecated: Gzipper holds the whole file in memory and stamps it with the
+// current time. Use WriteArchive or UploadArchive instead.
 func Gzipper(gzipPath string) (*bytes.Buffer, error) {
 	f, err := os.Open(gzipPath)
 	if err != nil {
@@ -0,0 +1,224 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is the shortest time between two progress reports for
+// the same upload. The final report is always delivered.
+var progressInterval = 200 * time.Millisecond
+
+// Progress describes how far an upload has got.
+type Progress struct {
+	// Key is the object being uploaded.
+	Key string
+
+	// Sent is the number of bytes sent so far. It can go down when a part
+	// is retried.
+	Sent int64
+
+	// Total is the size of the upload, or -1 if it is not known in advance.
+	Total int64
+
+	// Elapsed is the time since the upload started.
+	Elapsed time.Duration
+
+	// Done is set on the last report of an upload, whether it succeeded or
+	// failed.
+	Done bool
+}
+
+// Rate returns the average throughput so far in bytes per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Sent) / p.Elapsed.Seconds()
+}
+
+// ETA returns the estimated time until the upload completes at the average
+// rate so far, or -1 if it cannot be estimated.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if p.Total < 0 || rate <= 0 {
+		return -1
+	}
+	if p.Sent >= p.Total {
+		return 0
+	}
+	return time.Duration(float64(p.Total-p.Sent) / rate * float64(time.Second))
+}
+
+// Fraction returns the completed fraction of the upload between 0 and 1, or
+// -1 if the total is not known.
+func (p Progress) Fraction() float64 {
+	switch {
+	case p.Total < 0:
+		return -1
+	case p.Total == 0 || p.Sent >= p.Total:
+		return 1
+	}
+	return float64(p.Sent) / float64(p.Total)
+}
+
+// A ProgressReporter is told how uploads are progressing. Reports for one
+// upload arrive in order, but concurrent uploads, such as those started by
+// Sync, report from several goroutines at once.
+type ProgressReporter interface {
+	Progress(p Progress)
+}
+
+// ProgressFunc adapts a function to a ProgressReporter.
+type ProgressFunc func(p Progress)
+
+// Progress calls f(p).
+func (f ProgressFunc) Progress(p Progress) {
+	f(p)
+}
+
+// progressBarWidth is the number of characters in a TextProgress bar.
+const progressBarWidth = 30
+
+// TextProgress draws a single line progress bar on a terminal, such as
+//
+//	release.tar.gz [=========>          ]  33%  4.2MiB/s  ETA 12s
+//
+// The line is redrawn in place and ended when the upload is done.
+type TextProgress struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// NewTextProgress returns a TextProgress that draws on w.
+func NewTextProgress(w io.Writer) *TextProgress {
+	return &TextProgress{W: w}
+}
+
+// Progress redraws the bar.
+func (t *TextProgress) Progress(p Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var line string
+	if f := p.Fraction(); f >= 0 {
+		n := int(f * progressBarWidth)
+		bar := strings.Repeat("=", n)
+		if n < progressBarWidth {
+			bar += ">" + strings.Repeat(" ", progressBarWidth-n-1)
+		}
+		line = fmt.Sprintf("%s [%s] %3.0f%%  %s/s", p.Key, bar, f*100, formatBytes(p.Rate()))
+	} else {
+		line = fmt.Sprintf("%s %s  %s/s", p.Key, formatBytes(float64(p.Sent)), formatBytes(p.Rate()))
+	}
+	if eta := p.ETA(); eta > 0 && !p.Done {
+		line += fmt.Sprintf("  ETA %s", eta/time.Second*time.Second)
+	}
+	end := ""
+	if p.Done {
+		end = "\n"
+	}
+	// Clear to the end of the line in case the previous line was longer.
+	fmt.Fprintf(t.W, "\r%s\x1b[K%s", line, end)
+}
+
+// formatBytes formats a byte count using binary units.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// progressTracker accumulates the bytes sent for one upload and passes
+// throttled reports on to a ProgressReporter. A nil tracker does nothing.
+type progressTracker struct {
+	reporter ProgressReporter
+	key      string
+	total    int64
+	start    time.Time
+
+	mu   sync.Mutex
+	sent int64
+	last time.Time
+}
+
+// newProgress starts tracking an upload of total bytes, which may be -1.
+func (s *S3Uploader) newProgress(key string, total int64) *progressTracker {
+	if s.progress == nil {
+		return nil
+	}
+	return &progressTracker{reporter: s.progress, key: key, total: total, start: time.Now()}
+}
+
+// add records n more bytes sent. n is negative when bytes are resent.
+func (t *progressTracker) add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent += n
+	now := time.Now()
+	if now.Sub(t.last) < progressInterval {
+		return
+	}
+	t.last = now
+	t.reporter.Progress(t.report(now, false))
+}
+
+// done sends the final report.
+func (t *progressTracker) done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reporter.Progress(t.report(time.Now(), true))
+}
+
+func (t *progressTracker) report(now time.Time, done bool) Progress {
+	return Progress{Key: t.key, Sent: t.sent, Total: t.total, Elapsed: now.Sub(t.start), Done: done}
+}
+
+// reader returns a reader that records the bytes read from r as sent.
+func (t *progressTracker) reader(r io.Reader) *progressReader {
+	return &progressReader{r: r, t: t}
+}
+
+// progressReader counts the bytes read through it, which for a request body
+// are the bytes handed to the connection.
+type progressReader struct {
+	r io.Reader
+	t *progressTracker
+	n int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	r.t.add(int64(n))
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return nil
+}
+
+// rewind takes back the bytes counted so far, before the body is sent again.
+func (r *progressReader) rewind() {
+	r.t.add(-r.n)
+	r.n = 0
+}
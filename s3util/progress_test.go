@@ -0,0 +1,90 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressEstimates(t *testing.T) {
+	p := Progress{Sent: 25, Total: 100, Elapsed: 5 * time.Second}
+	if p.Rate() != 5 {
+		t.Fatalf("Expected a rate of 5B/s; got %f", p.Rate())
+	}
+	if p.ETA() != 15*time.Second {
+		t.Fatalf("Expected an ETA of 15s; got %s", p.ETA())
+	}
+	if p.Fraction() != 0.25 {
+		t.Fatalf("Expected a fraction of 0.25; got %f", p.Fraction())
+	}
+
+	p.Total = -1
+	if p.ETA() != -1 || p.Fraction() != -1 {
+		t.Fatalf("Expected no estimate for an unknown total; got %s, %f", p.ETA(), p.Fraction())
+	}
+}
+
+func TestTextProgress(t *testing.T) {
+	var buf bytes.Buffer
+	tp := NewTextProgress(&buf)
+	tp.Progress(Progress{Key: "a.tgz", Sent: 1536, Total: 3072, Elapsed: time.Second})
+	if got := buf.String(); !strings.Contains(got, "a.tgz [===============>              ]  50%  1.5KiB/s  ETA 1s") {
+		t.Fatalf("Unexpected progress line %q", got)
+	}
+	buf.Reset()
+	tp.Progress(Progress{Key: "a.tgz", Sent: 3072, Total: 3072, Elapsed: 2 * time.Second, Done: true})
+	if got := buf.String(); !strings.HasSuffix(got, "100%  1.5KiB/s\x1b[K\n") {
+		t.Fatalf("Unexpected final progress line %q", got)
+	}
+}
+
+// progressRecorder keeps every report it receives.
+type progressRecorder struct {
+	mu      sync.Mutex
+	reports []Progress
+}
+
+func (r *progressRecorder) Progress(p Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, p)
+}
+
+func TestUploadMultipartProgress(t *testing.T) {
+	uploader, m, done := newMultipartTest(t)
+	defer done()
+	rec := &progressRecorder{}
+	uploader.progress = rec
+
+	interval := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = interval }()
+
+	data := make([]byte, 2*MinPartSize+100)
+	rand.Read(data)
+	// The retried part must not be counted twice.
+	m.failPart, m.failTimes, m.failCode = 1, 1, http.StatusInternalServerError
+
+	opts := &MultipartOptions{PartSize: MinPartSize, Concurrency: 2}
+	if err := uploader.UploadMultipart("big.tgz", bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(rec.reports) < 3 {
+		t.Fatalf("Expected several progress reports; got %d", len(rec.reports))
+	}
+	last := rec.reports[len(rec.reports)-1]
+	if !last.Done || last.Sent != int64(len(data)) || last.Total != int64(len(data)) || last.Key != "big.tgz" {
+		t.Fatalf("Unexpected final report %+v", last)
+	}
+	for _, p := range rec.reports[:len(rec.reports)-1] {
+		if p.Done || p.Sent > p.Total {
+			t.Fatalf("Unexpected intermediate report %+v", p)
+		}
+	}
+}
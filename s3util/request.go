@@ -0,0 +1,170 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/apcera/util/internal/sigv4"
+)
+
+// An S3Error is returned when S3 responds to a request with an error.
+// Docs: http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type S3Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int `xml:"-"`
+
+	// Code is the S3 error code, such as "NoSuchKey".
+	Code string
+
+	// Message is the human readable description of the error.
+	Message string
+
+	// RequestID identifies the failed request to AWS support.
+	RequestID string `xml:"RequestId"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("received code %d from S3: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("received code %d from S3: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// temporary reports whether the request may succeed if retried.
+func (e *S3Error) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout ||
+		e.Code == "SlowDown" || e.Code == "RequestTimeout"
+}
+
+// newS3Error builds an S3Error from a response, consuming its body.
+func newS3Error(resp *http.Response) *S3Error {
+	e := &S3Error{StatusCode: resp.StatusCode}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(b) == 0 {
+		e.Message = http.StatusText(resp.StatusCode)
+		return e
+	}
+	if err := xml.Unmarshal(b, e); err != nil || e.Code == "" {
+		e.Message = string(b)
+	}
+	return e
+}
+
+// objectURL returns the URL of the named object with the given query. An
+// empty key refers to the bucket itself.
+func (s *S3Uploader) objectURL(key string, query url.Values) *url.URL {
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucketName
+		if key != "" {
+			p += "/" + key
+		}
+	}
+	return &url.URL{
+		Scheme:   s.s3url.Scheme,
+		Host:     s.s3url.Host,
+		Path:     p,
+		RawQuery: sigv4.CanonicalQueryString(query),
+	}
+}
+
+// newRequest builds a signed request for the named object. When body is not
+// nil it is sent along with its MD5 so S3 can verify delivery.
+func (s *S3Uploader) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// See the comment in buildS3Request.
+	req.Close = true
+	req.ContentLength = int64(len(body))
+	if body != nil {
+		h := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(h[:]))
+	}
+	return req, nil
+}
+
+// sign signs req for this uploader's region. Headers added afterwards are not
+// covered by the signature.
+func (s *S3Uploader) sign(req *http.Request, payloadHash string) error {
+	signer, err := s.signer()
+	if err != nil {
+		return err
+	}
+	signer.Sign(req, payloadHash, time.Now())
+	return nil
+}
+
+// do sends req and returns the response if it has the expected status. Any
+// other status is converted to an S3Error.
+func (s *S3Uploader) do(req *http.Request, expected int) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expected {
+		defer resp.Body.Close()
+		return nil, newS3Error(resp)
+	}
+	return resp, nil
+}
+
+// doXML signs and sends a request built by newRequest with the given body and
+// decodes the XML response into v, which may be nil.
+func (s *S3Uploader) doXML(req *http.Request, body []byte, v interface{}) error {
+	if err := s.sign(req, sigv4.PayloadSha256(body)); err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Some operations, such as copies, report failure inside a 200 response.
+	if rootElement(b) == "Error" {
+		e := &S3Error{StatusCode: resp.StatusCode}
+		if xml.Unmarshal(b, e) == nil {
+			return e
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, v)
+}
+
+// rootElement returns the name of the first element in an XML document.
+func rootElement(b []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return se.Name.Local
+		}
+	}
+}
+
+// IsNotFound returns true if err is an S3Error for a missing bucket or
+// object.
+func IsNotFound(err error) bool {
+	e, ok := err.(*S3Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
@@ -6,18 +6,18 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/apcera/util/hmac"
+	"github.com/apcera/util/internal/sigv4"
 )
 
 const (
@@ -27,6 +27,13 @@ const (
 	scheme = "https"
 )
 
+// These constants correspond to the environment variables that select the
+// region when none is configured.
+const (
+	AWS_REGION         = "AWS_REGION"
+	AWS_DEFAULT_REGION = "AWS_DEFAULT_REGION"
+)
+
 // An S3Uploader is a helper object for uploading S3 requests.
 type S3Uploader struct {
 	// s3url is the parsed URL of the s3 account we're uploading to.
@@ -38,29 +45,149 @@ type S3Uploader struct {
 	// permission is the permission we're uploading with.
 	permission string
 
+	// region is the AWS region the bucket lives in, used to scope request
+	// signatures.
+	region string
+
+	// pathStyle puts the bucket name in the path rather than the host name.
+	pathStyle bool
+
+	// credentials supplies the keys requests are signed with.
+	credentials CredentialsProvider
+
+	// progress, if set, receives progress reports for uploads.
+	progress ProgressReporter
+
+	// sse and envelope, if set, encrypt objects on the server and on the
+	// client.
+	sse      *ServerSideEncryption
+	envelope *EnvelopeEncryption
+
 	// out is where output is written.
 	out io.Writer
 }
 
+// A Config describes the bucket an S3Uploader works with and how to reach
+// it.
+type Config struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// Permission is the canned ACL applied to uploaded objects.
+	Permission string
+
+	// Quiet suppresses progress output.
+	Quiet bool
+
+	// Progress, if set, is told how each upload is progressing.
+	Progress ProgressReporter
+
+	// Encryption, if set, has S3 encrypt uploaded objects at rest. With a
+	// customer key, the key is also sent when reading objects.
+	Encryption *ServerSideEncryption
+
+	// ClientEncryption, if set, encrypts objects before they are uploaded
+	// and decrypts them when they are read.
+	ClientEncryption *EnvelopeEncryption
+
+	// Region is the region the bucket lives in. It defaults to AWS_REGION,
+	// then AWS_DEFAULT_REGION, then DefaultRegion.
+	Region string
+
+	// Endpoint is the base URL of an S3 compatible service, such as
+	// "http://localhost:9000" for a local MinIO. It defaults to the AWS
+	// endpoint for the region.
+	Endpoint string
+
+	// PathStyle addresses the bucket as the first element of the path
+	// instead of as part of the host name. Most S3 compatible services
+	// require it.
+	PathStyle bool
+
+	// Credentials supplies the keys to sign requests with. It defaults to
+	// DefaultCredentials.
+	Credentials CredentialsProvider
+}
+
 // NewS3Uploader configures a new S3 uploader from a uri.
 func NewS3Uploader(bucket, permission string, quiet bool) (*S3Uploader, error) {
-	u := &url.URL{
-		Scheme: scheme,
-		Host:   fmt.Sprintf("%s.%s", bucket, S3_URL),
-	}
+	return NewS3UploaderFromConfig(&Config{
+		Bucket:     bucket,
+		Permission: permission,
+		Quiet:      quiet,
+	})
+}
 
-	permission = strings.ToLower(permission)
+// NewS3UploaderFromConfig configures a new S3 uploader for any region or S3
+// compatible service.
+func NewS3UploaderFromConfig(c *Config) (*S3Uploader, error) {
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("a bucket name is required")
+	}
+	permission := strings.ToLower(c.Permission)
 	if err := validatePermission(permission); err != nil {
 		return nil, err
 	}
+	if c.Encryption != nil {
+		if err := c.Encryption.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.ClientEncryption != nil {
+		if err := c.ClientEncryption.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	region := c.Region
+	if region == "" {
+		region = os.Getenv(AWS_REGION)
+	}
+	if region == "" {
+		region = os.Getenv(AWS_DEFAULT_REGION)
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	var u *url.URL
+	if c.Endpoint != "" {
+		var err error
+		u, err = url.Parse(c.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %s", c.Endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q: expected an http or https URL", c.Endpoint)
+		}
+		u = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	} else {
+		host := S3_URL
+		if region != DefaultRegion {
+			host = fmt.Sprintf("s3.%s.amazonaws.com", region)
+		}
+		u = &url.URL{Scheme: scheme, Host: host}
+	}
+	if !c.PathStyle {
+		u.Host = c.Bucket + "." + u.Host
+	}
 
 	uploader := &S3Uploader{
-		s3url:      u,
-		bucketName: bucket,
-		permission: permission,
-		out:        os.Stdout,
+		s3url:       u,
+		bucketName:  c.Bucket,
+		permission:  permission,
+		region:      region,
+		pathStyle:   c.PathStyle,
+		credentials: c.Credentials,
+		progress:    c.Progress,
+		sse:         c.Encryption,
+		envelope:    c.ClientEncryption,
+		out:         os.Stdout,
+	}
+	if uploader.credentials == nil {
+		uploader.credentials = DefaultCredentials
 	}
-	if quiet {
+	if c.Quiet {
 		uploader.out = ioutil.Discard
 	}
 	return uploader, nil
@@ -88,15 +215,27 @@ func validatePermission(permission string) error {
 
 // UploadToS3 prepares a buffer for upload to S3.
 func (s *S3Uploader) UploadToS3(fPath string, buf *bytes.Buffer) error {
+	return s.UploadToS3WithOptions(fPath, buf, nil)
+}
+
+// UploadToS3WithOptions uploads a buffer to S3 under the base name of fPath
+// with the given object headers. The content type is inferred when not set.
+func (s *S3Uploader) UploadToS3WithOptions(fPath string, buf *bytes.Buffer, opts *ObjectOptions) error {
 	fmt.Fprintf(s.out, "Preparing %q for upload to s3 bucket %q...", filepath.Base(fPath), s.s3url.String())
 
-	req, err := s.buildS3Request(filepath.Base(fPath), buf)
+	req, err := s.buildS3Request(filepath.Base(fPath), buf, opts)
 	if err != nil {
 		fmt.Fprintln(s.out, " error")
 		return err
 	}
 	fmt.Fprintln(s.out, " done")
 
+	progress := s.newProgress(filepath.Base(fPath), req.ContentLength)
+	if progress != nil {
+		req.Body = progress.reader(req.Body)
+		defer progress.done()
+	}
+
 	fmt.Fprint(s.out, "Uploading...")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -115,24 +254,38 @@ func (s *S3Uploader) UploadToS3(fPath string, buf *bytes.Buffer) error {
 		if err == nil {
 			errMsg = fmt.Sprintf("%s\n\nReceived S3 Response: %q", errMsg, string(b))
 		}
-		return fmt.Errorf(errMsg)
+		return errors.New(errMsg)
 	}
 	fmt.Fprintln(s.out, " done")
 	return nil
 }
 
 // buildS3Request constructs an http request for the upload
-func (s *S3Uploader) buildS3Request(fileBase string, buffer *bytes.Buffer) (*http.Request, error) {
-	u := &url.URL{
-		Scheme: s.s3url.Scheme,
-		Host:   s.s3url.Host,
-		Path:   fileBase,
+func (s *S3Uploader) buildS3Request(fileBase string, buffer *bytes.Buffer, opts *ObjectOptions) (*http.Request, error) {
+	head := buffer.Bytes()
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
 	}
+	header, err := opts.header(fileBase, head)
+	if err != nil {
+		return nil, err
+	}
+	if s.sse != nil || s.envelope != nil {
+		data, err := s.encryptBody(buffer.Bytes(), header)
+		if err != nil {
+			return nil, err
+		}
+		buffer = bytes.NewBuffer(data)
+	}
+
 	// This is a PUT request containing the data buffer.
-	req, err := http.NewRequest("PUT", u.String(), buffer)
+	req, err := http.NewRequest("PUT", s.objectURL(fileBase, nil).String(), buffer)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	// FIXME: Send 'Connection: close' header on HTTP requests
 	// as reusing the connection is still prone to EOF/Connection reset errors
@@ -142,71 +295,54 @@ func (s *S3Uploader) buildS3Request(fileBase string, buffer *bytes.Buffer) (*htt
 	req.Close = true
 
 	// Generate MD5 to ensure reliable delivery
-	h := md5.New()
-	if _, err := h.Write(buffer.Bytes()); err != nil {
-		return nil, err
-	}
-	md5 := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	h := md5.Sum(buffer.Bytes())
+	md5 := base64.StdEncoding.EncodeToString(h[:])
 
-	// Get current time in UTC format for Date header.
-	curTime := time.Now().UTC().Format(time.RFC1123)
-	req.Header.Add("Date", curTime)
 	req.Header.Add("Content-Md5", md5)
-	req.Header.Add("Content-Type", "application/x-gzip")
 	req.Header.Add("X-Amz-Acl", s.permission)
 
-	authHeader, err := s.buildAuthHeader(md5, curTime, fileBase)
+	signer, err := s.signer()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", authHeader)
+	signer.Sign(req, sigv4.PayloadSha256(buffer.Bytes()), time.Now())
 
 	// Set content length so we avoid chunked requests.
 	req.ContentLength = int64(buffer.Len())
 	return req, nil
 }
 
-// buildAuthHeader builds an authorization header for S3.
-func (s *S3Uploader) buildAuthHeader(md5, headerTime, fileName string) (string, error) {
-	access, err := getAuthCredentials()
+// signer returns a Signature Version 4 signer for this uploader's region
+// using the current credentials.
+func (s *S3Uploader) signer() (*sigv4.Signer, error) {
+	creds, err := s.credentials.Credentials()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	// Docs: http://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
-	verStr := fmt.Sprintf("PUT\n%s\napplication/x-gzip\n%s\nx-amz-acl:%s\n/%s", md5, headerTime, s.permission,
-		path.Join(s.bucketName, fileName))
-	encodedStr := hmac.ComputeHmacSha1(verStr, access.SecretKey)
-	return fmt.Sprintf("AWS %s:%s", access.AccessKey, encodedStr), nil
-}
-
-// An awsAccess is a helper struct for organizing AWS credentials. Fields are
-// exported for json marshalling. (currently not implemented)
-type awsAccess struct {
-	AccessKey string `json:"aws_access_key_id"`
-	SecretKey string `json:"aws_secret_key"`
+	return &sigv4.Signer{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Region:          s.region,
+		Service:         "s3",
+	}, nil
 }
 
-// These constants correspond to the expected credential-containing environment
-// variable keys.
-const (
-	AWS_ACCESS_KEY_ID = "AWS_ACCESS_KEY_ID"
-	AWS_SECRET_KEY    = "AWS_SECRET_KEY"
-)
-
-// getAuthCredentials retrieves authorization credentials from configuration.
-// TODO(alex): write to/retrieve from disk json file.
-func getAuthCredentials() (*awsAccess, error) {
-	awsAccessKeyId := os.Getenv(AWS_ACCESS_KEY_ID)
-	if awsAccessKeyId == "" {
-		return nil, fmt.Errorf("could not get AWS access key")
+// PresignURL returns a URL granting the bearer access to perform method on
+// the named object without credentials until it expires. The expiry may be at
+// most seven days.
+func (s *S3Uploader) PresignURL(method, fileBase string, expires time.Duration) (string, error) {
+	req, err := http.NewRequest(method, s.objectURL(fileBase, nil).String(), nil)
+	if err != nil {
+		return "", err
+	}
+	signer, err := s.signer()
+	if err != nil {
+		return "", err
 	}
-	awsSecretKey := os.Getenv(AWS_SECRET_KEY)
-	if awsSecretKey == "" {
-		return nil, fmt.Errorf("could not get AWS secret key")
+	signed, err := signer.Presign(req, expires, time.Now())
+	if err != nil {
+		return "", err
 	}
-	return &awsAccess{
-		AccessKey: awsAccessKeyId,
-		SecretKey: awsSecretKey,
-	}, nil
+	return signed.String(), nil
 }
@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewS3Uploader(t *testing.T) {
@@ -39,6 +40,56 @@ func TestNewS3Uploader(t *testing.T) {
 	}
 }
 
+func TestNewS3UploaderFromConfig(t *testing.T) {
+	defer setenv(t, map[string]string{AWS_REGION: "", AWS_DEFAULT_REGION: "eu-west-1"})()
+
+	uploader, err := NewS3UploaderFromConfig(&Config{Bucket: "b", Permission: "private"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if uploader.region != "eu-west-1" {
+		t.Fatalf("Expected region from the environment; got %q", uploader.region)
+	}
+	if u := uploader.objectURL("k", nil).String(); u != "https://b.s3.eu-west-1.amazonaws.com/k" {
+		t.Fatalf("Unexpected regional object URL %q", u)
+	}
+
+	creds := &StaticCredentials{AccessKeyID: "minio", SecretAccessKey: "minio123"}
+	uploader, err = NewS3UploaderFromConfig(&Config{
+		Bucket:      "b",
+		Permission:  "private",
+		Region:      "local",
+		Endpoint:    "http://localhost:9000/ignored",
+		PathStyle:   true,
+		Credentials: creds,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if u := uploader.objectURL("dir/k", nil).String(); u != "http://localhost:9000/b/dir/k" {
+		t.Fatalf("Unexpected path style object URL %q", u)
+	}
+	if u := uploader.objectURL("", nil).String(); u != "http://localhost:9000/b" {
+		t.Fatalf("Unexpected path style bucket URL %q", u)
+	}
+	signer, err := uploader.signer()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if signer.AccessKeyID != "minio" || signer.Region != "local" {
+		t.Fatalf("Expected signer to use configured credentials and region; got %+v", signer)
+	}
+
+	for _, endpoint := range []string{"localhost:9000", "ftp://host", "http://"} {
+		if _, err := NewS3UploaderFromConfig(&Config{Bucket: "b", Permission: "private", Endpoint: endpoint}); err == nil {
+			t.Fatalf("Expected error for endpoint %q", endpoint)
+		}
+	}
+	if _, err := NewS3UploaderFromConfig(&Config{Permission: "private"}); err == nil {
+		t.Fatal("Expected error without a bucket")
+	}
+}
+
 func TestZipper(t *testing.T) {
 	dir := filepath.Join(os.TempDir(), strconv.Itoa(rand.Int()))
 	if err := os.Mkdir(dir, 0755); err != nil {
@@ -120,10 +171,10 @@ func TestBuildS3Request(t *testing.T) {
 		t.Fatalf("Error setting environment: %s", err)
 	}
 
-	fileBase := "foo"
+	fileBase := "foo.tgz"
 	buffer := bytes.NewBuffer(nil)
 	buffer.WriteString("some data")
-	req, err := uploader.buildS3Request(fileBase, buffer)
+	req, err := uploader.buildS3Request(fileBase, buffer, nil)
 	if err != nil {
 		t.Fatalf("Unexpected error building request: %s", err)
 	}
@@ -150,16 +201,61 @@ func TestBuildS3Request(t *testing.T) {
 	}
 
 	md5 := req.Header["Content-Md5"][0]
-	date := req.Header["Date"][0]
-	authHeader, err := uploader.buildAuthHeader(md5, date, fileBase)
-	if err != nil {
-		t.Fatalf("Encountered error build auth header: %s", err)
-	}
 	if md5 != "HlAhCgICSX+3m8OLat5sNA==" {
 		t.Fatalf("Expected md5 of 'HlAhCgICSX+3m8OLat5sNA==', got %q", md5)
 	}
-	if !strings.Contains(authHeader, fileBase) {
-		t.Fatalf("Expected authHeader (%s) to contain fileBase %s", authHeader, fileBase)
+	sha := req.Header.Get("X-Amz-Content-Sha256")
+	if sha != "1307990e6ba5ca145eb35e99182a9bec46531bc54ddf656a602c780fa0240dee" {
+		t.Fatalf("Expected payload sha256 of 'some data', got %q", sha)
+	}
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "AWS4-HMAC-SHA256 Credential=foo/") {
+		t.Fatalf("Expected authHeader (%s) to use AWS Signature Version 4", authHeader)
+	}
+	if !strings.Contains(authHeader, "/us-east-1/s3/aws4_request") {
+		t.Fatalf("Expected authHeader (%s) to be scoped to the default region", authHeader)
+	}
+	if !strings.Contains(authHeader, "content-md5;content-type;host;x-amz-acl") {
+		t.Fatalf("Expected authHeader (%s) to sign the upload headers", authHeader)
+	}
+}
+
+func TestPresignURL(t *testing.T) {
+	uploader, err := NewS3Uploader("test-uploads", "private", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := os.Setenv(AWS_SECRET_KEY, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	if err := os.Setenv(AWS_ACCESS_KEY_ID, "foo"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	if err := os.Setenv(AWS_SESSION_TOKEN, "token"); err != nil {
+		t.Fatalf("Error setting environment: %s", err)
+	}
+	defer os.Unsetenv(AWS_SESSION_TOKEN)
+
+	s, err := uploader.PresignURL("GET", "some file.tgz", time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if u.Path != "/some file.tgz" {
+		t.Fatalf("Expected presigned path to be the object key; got %q", u.Path)
+	}
+	q := u.Query()
+	if q.Get("X-Amz-Expires") != "3600" {
+		t.Fatalf("Expected expiry of 3600 seconds; got %q", q.Get("X-Amz-Expires"))
+	}
+	if q.Get("X-Amz-Security-Token") != "token" {
+		t.Fatalf("Expected session token in presigned URL %q", s)
+	}
+	if len(q.Get("X-Amz-Signature")) != 64 {
+		t.Fatalf("Expected signature in presigned URL %q", s)
 	}
 }
 
@@ -203,8 +299,9 @@ func TestUploadToS3(t *testing.T) {
 	sMux := http.NewServeMux()
 	sMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		code := http.StatusOK
+		// The zip archive's content type is sniffed from its contents.
 		ct := r.Header.Get("Content-Type")
-		if ct != "application/x-gzip" {
+		if ct != "application/zip" {
 			code = http.StatusBadRequest
 		}
 		ah := r.Header.Get("Authorization")
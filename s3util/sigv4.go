@@ -0,0 +1,16 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"github.com/apcera/util/internal/sigv4"
+)
+
+const (
+	// UnsignedPayload may be used in place of the payload hash when the body
+	// is not known ahead of time.
+	UnsignedPayload = sigv4.UnsignedPayload
+
+	// DefaultRegion is the region used when none has been configured.
+	DefaultRegion = "us-east-1"
+)
@@ -0,0 +1,318 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sha256MetadataKey is the user metadata key, without the x-amz-meta- prefix,
+// under which Sync stores the SHA-256 of each file it uploads. It lets files
+// uploaded in parts, whose ETags are not content hashes, be compared. With
+// client-side encryption the hash of the plaintext remains visible to anyone
+// who can read the object's metadata.
+const Sha256MetadataKey = "sha256"
+
+// SyncOptions controls how Sync mirrors a directory. The zero value uploads
+// changed files to the root of the bucket and keeps remote extras.
+type SyncOptions struct {
+	// Prefix is prepended to the slash separated path of each file to form
+	// its key. Only keys under Prefix are considered remote copies.
+	Prefix string
+
+	// Delete removes remote objects under Prefix that have no local file.
+	Delete bool
+
+	// DryRun reports what would be done without changing anything.
+	DryRun bool
+
+	// Concurrency is the number of files uploaded at once. It defaults to
+	// DefaultConcurrency.
+	Concurrency int
+
+	// ObjectOptions are the headers given to uploaded files. The content
+	// type is inferred for each file unless set.
+	ObjectOptions
+
+	// Multipart configures uploads of files larger than one part.
+	Multipart *MultipartOptions
+}
+
+// A SyncAction is something Sync did, or would do in a dry run.
+type SyncAction struct {
+	// Op is "upload" or "delete".
+	Op string
+
+	// Key is the remote object.
+	Key string
+
+	// Path is the local file for uploads.
+	Path string
+
+	// Size is the size of the uploaded file.
+	Size int64
+}
+
+// A SyncResult describes the outcome of Sync.
+type SyncResult struct {
+	// Actions lists the uploads and deletes, sorted by key.
+	Actions []SyncAction
+
+	// Unchanged is the number of files already up to date.
+	Unchanged int
+
+	// Bytes is the total size of the uploads.
+	Bytes int64
+}
+
+// localFile is a regular file found while walking the directory.
+type localFile struct {
+	path string
+	key  string
+	size int64
+}
+
+// fileDigests returns the hex MD5 and SHA-256 of a file in a single pass.
+func fileDigests(name string) (string, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	m, s := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(m.Sum(nil)), hex.EncodeToString(s.Sum(nil)), nil
+}
+
+// walkLocal returns the regular files below dir keyed by their object key.
+// Symlinks and other special files are skipped.
+func walkLocal(dir, prefix string) (map[string]localFile, error) {
+	files := make(map[string]localFile)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		files[key] = localFile{path: p, key: key, size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// Sync makes the objects under opts.Prefix mirror the files below dir. A
+// file is uploaded when no object has its key, the sizes differ, or its
+// content differs. Content is compared using the ETag when it is a plain
+// MD5, and otherwise using the SHA-256 that Sync stores in each object's
+// metadata. Uploads run concurrently; the first error stops further work
+// and is returned along with what was done.
+func (s *S3Uploader) Sync(dir string, opts *SyncOptions) (*SyncResult, error) {
+	var o SyncOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Prefix != "" && !strings.HasSuffix(o.Prefix, "/") {
+		o.Prefix += "/"
+	}
+	mo, err := o.Multipart.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	mo.ObjectOptions = o.ObjectOptions
+
+	local, err := walkLocal(dir, o.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	remoteList, _, err := s.ListObjects(&ListOptions{Prefix: o.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]ObjectInfo, len(remoteList))
+	for _, obj := range remoteList {
+		remote[obj.Key] = obj
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		result   = &SyncResult{}
+	)
+	work := make(chan localFile)
+	failed := make(chan struct{})
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				uploaded, err := s.syncFile(f, remote, o, mo)
+				if err != nil {
+					fail(fmt.Errorf("%s: %s", f.path, err))
+					continue
+				}
+				mu.Lock()
+				if uploaded {
+					result.Actions = append(result.Actions, SyncAction{Op: "upload", Key: f.key, Path: f.path, Size: f.size})
+					result.Bytes += f.size
+				} else {
+					result.Unchanged++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	keys := make([]string, 0, len(local))
+	for k := range local {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+send:
+	for _, k := range keys {
+		select {
+		case work <- local[k]:
+		case <-failed:
+			break send
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr == nil && o.Delete {
+		var extra []string
+		for _, obj := range remoteList {
+			if _, ok := local[obj.Key]; !ok {
+				extra = append(extra, obj.Key)
+			}
+		}
+		for _, k := range extra {
+			fmt.Fprintf(s.out, "delete %s\n", k)
+			result.Actions = append(result.Actions, SyncAction{Op: "delete", Key: k})
+		}
+		if !o.DryRun && len(extra) > 0 {
+			firstErr = s.DeleteObjects(extra)
+		}
+	}
+
+	sort.Sort(byActionKey(result.Actions))
+	return result, firstErr
+}
+
+// syncFile uploads f unless the remote copy matches it, and reports whether
+// an upload was needed.
+func (s *S3Uploader) syncFile(f localFile, remote map[string]ObjectInfo, o SyncOptions, mo MultipartOptions) (bool, error) {
+	md5sum, sha, err := fileDigests(f.path)
+	if err != nil {
+		return false, err
+	}
+	size := f.size
+	if s.envelope != nil {
+		size = envelopeSize(size)
+	}
+	if obj, ok := remote[f.key]; ok && obj.Size == size {
+		etag := strings.Trim(obj.ETag, `"`)
+		if s.etagIsMD5(etag) {
+			if etag == md5sum {
+				return false, nil
+			}
+		} else {
+			info, err := s.HeadObject(f.key)
+			if err != nil && !IsNotFound(err) {
+				return false, err
+			}
+			if err == nil && info.Metadata[Sha256MetadataKey] == sha {
+				return false, nil
+			}
+		}
+	}
+
+	fmt.Fprintf(s.out, "upload %s -> %s\n", f.path, f.key)
+	if o.DryRun {
+		return true, nil
+	}
+
+	if f.size <= mo.PartSize {
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return false, err
+		}
+		head := data
+		if len(head) > sniffLen {
+			head = head[:sniffLen]
+		}
+		header, err := o.ObjectOptions.header(f.key, head)
+		if err != nil {
+			return false, err
+		}
+		header.Set("X-Amz-Meta-"+Sha256MetadataKey, sha)
+		_, err = s.putObject(f.key, data, header)
+		return true, err
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	// Copy the metadata so concurrent uploads do not share the map.
+	metadata := map[string]string{Sha256MetadataKey: sha}
+	for k, v := range mo.Metadata {
+		metadata[k] = v
+	}
+	mo.Metadata = metadata
+	return true, s.UploadMultipart(f.key, file, &mo)
+}
+
+// etagIsMD5 reports whether an ETag is the MD5 of the file that was
+// uploaded. Multipart ETags have a "-N" suffix, and objects encrypted with
+// KMS or customer keys, or on the client, have ETags unrelated to the file.
+func (s *S3Uploader) etagIsMD5(etag string) bool {
+	if strings.Contains(etag, "-") || s.envelope != nil {
+		return false
+	}
+	return s.sse == nil || s.sse.CustomerKey == nil && s.sse.Algorithm == SSEAES256
+}
+
+// byActionKey sorts sync actions by key.
+type byActionKey []SyncAction
+
+func (a byActionKey) Len() int           { return len(a) }
+func (a byActionKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+func (a byActionKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
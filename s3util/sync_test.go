@@ -0,0 +1,143 @@
+// Copyright 2016 Apcera, Inc. All rights reserved.
+
+package s3util_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apcera/util/s3test"
+	"github.com/apcera/util/s3util"
+)
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func actionsOf(r *s3util.SyncResult) []string {
+	var actions []string
+	for _, a := range r.Actions {
+		actions = append(actions, a.Op+" "+a.Key)
+	}
+	return actions
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := s3test.NewServer(nil)
+	defer srv.Close()
+	u, err := s3util.NewS3UploaderFromConfig(srv.Config("builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, dir, map[string]string{
+		"index.html":   "<html></html>",
+		"js/app.js":    "alert(1)",
+		"img/logo.png": "png",
+	})
+	if err := os.Symlink("index.html", filepath.Join(dir, "link.html")); err != nil {
+		t.Fatal(err)
+	}
+	srv.PutObject("builds", "site/stale.txt", []byte("old"))
+	srv.PutObject("builds", "other/keep.txt", []byte("keep"))
+
+	// A dry run changes nothing but reports everything.
+	opts := &s3util.SyncOptions{Prefix: "site", Delete: true, DryRun: true}
+	res, err := u.Sync(dir, opts)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	want := []string{
+		"upload site/img/logo.png",
+		"upload site/index.html",
+		"upload site/js/app.js",
+		"delete site/stale.txt",
+	}
+	if !reflect.DeepEqual(actionsOf(res), want) {
+		t.Fatalf("dry run actions = %v, want %v", actionsOf(res), want)
+	}
+	if keys := srv.Keys("builds"); len(keys) != 2 {
+		t.Fatalf("dry run changed the bucket: %v", keys)
+	}
+
+	opts.DryRun = false
+	if _, err := u.Sync(dir, opts); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	wantKeys := []string{"other/keep.txt", "site/img/logo.png", "site/index.html", "site/js/app.js"}
+	if keys := srv.Keys("builds"); !reflect.DeepEqual(keys, wantKeys) {
+		t.Fatalf("keys = %v, want %v", keys, wantKeys)
+	}
+	h, _ := srv.Header("builds", "site/js/app.js")
+	if h.Get("X-Amz-Meta-Sha256") == "" {
+		t.Fatal("uploaded object has no SHA-256 metadata")
+	}
+
+	// Only the changed file is uploaded the second time, even though its
+	// size is the same.
+	writeTree(t, dir, map[string]string{"js/app.js": "alert(2)"})
+	res, err = u.Sync(dir, opts)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if got := actionsOf(res); !reflect.DeepEqual(got, []string{"upload site/js/app.js"}) || res.Unchanged != 2 {
+		t.Fatalf("second sync = %v, %d unchanged", got, res.Unchanged)
+	}
+	if data, _ := srv.Object("builds", "site/js/app.js"); string(data) != "alert(2)" {
+		t.Fatalf("object = %q", data)
+	}
+}
+
+func TestSyncMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := s3test.NewServer(nil)
+	defer srv.Close()
+	u, err := s3util.NewS3UploaderFromConfig(srv.Config("builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("x"), s3util.MinPartSize+10)
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &s3util.SyncOptions{Multipart: &s3util.MultipartOptions{PartSize: s3util.MinPartSize}}
+	if _, err := u.Sync(dir, opts); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if data, _ := srv.Object("builds", "big"); !bytes.Equal(data, big) {
+		t.Fatal("multipart upload differs")
+	}
+
+	// The multipart ETag is not an MD5, so the stored SHA-256 is used.
+	res, err := u.Sync(dir, opts)
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	if len(res.Actions) != 0 || res.Unchanged != 1 {
+		t.Fatalf("unexpected second sync %+v", res)
+	}
+}